@@ -0,0 +1,73 @@
+// Replay an access trace against the caches and print hit ratios as CSV.
+//
+//	cachesim -format arc -capacities 1000,10000,100000 -shards 1,16 trace.arc
+//
+// With no file the trace is read from standard input.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cachesim"
+)
+
+func main() {
+	format := flag.String("format", cachesim.SimpleFormat, "The trace format: simple, arc or lirs.")
+	capacities := flag.String("capacities", "100,1000,10000", "Comma separated cache capacities.")
+	shards := flag.String("shards", "1", "Comma separated shard counts.")
+	policies := flag.String("policies", "", "Comma separated policies. All are used by default.")
+	flag.Parse()
+
+	var in io.Reader = os.Stdin
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	selected := cachesim.Policies
+	if *policies != "" {
+		selected = []cachesim.Policy{}
+		for _, name := range strings.Split(*policies, ",") {
+			found := false
+			for _, p := range cachesim.Policies {
+				if p.Name == name {
+					selected = append(selected, p)
+					found = true
+				}
+			}
+			if !found {
+				log.Fatalf("Unknown policy %s.", name)
+			}
+		}
+	}
+
+	results, err := cachesim.SimulateTrace(in, *format, selected, parseInts(*capacities), parseInts(*shards))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := cachesim.WriteCSV(os.Stdout, results); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func parseInts(s string) []int {
+	ints := []int{}
+	for _, f := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || i <= 0 {
+			log.Fatalf("Expected positive integers but found %q.", f)
+		}
+		ints = append(ints, i)
+	}
+	return ints
+}
@@ -0,0 +1,31 @@
+// A cache server that speaks the memcached ASCII protocol.
+//
+//	memcached -listen :11211 -ring 16 -size 10000
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/memcache"
+)
+
+func main() {
+	listen := flag.String("listen", ":11211", "The address to listen on.")
+	ringSize := flag.Int("ring", 16, "The number of cache shards.")
+	cacheSize := flag.Int("size", 10000, "The number of keys each shard may hold.")
+	flag.Parse()
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Listening on %s.", l.Addr())
+
+	server := memcache.NewServer(cache.NewConcurrentRingCache(*ringSize, *cacheSize, -1))
+
+	log.Fatal(server.Serve(l))
+}
@@ -0,0 +1,33 @@
+// A cache server that speaks a subset of the Redis RESP2 protocol.
+//
+//	respcached -listen :6379 -ring 16 -size 10000
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/resp"
+)
+
+func main() {
+	listen := flag.String("listen", ":6379", "The address to listen on.")
+	ringSize := flag.Int("ring", 16, "The number of cache shards.")
+	cacheSize := flag.Int("size", 10000, "The number of keys each shard may hold.")
+	maxBulk := flag.Int("max-bulk", resp.DefaultMaxBulkLength, "The longest value a client may send.")
+	flag.Parse()
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Listening on %s.", l.Addr())
+
+	server := resp.NewServer(cache.NewConcurrentRingCache(*ringSize, *cacheSize, -1))
+	server.MaxBulkLength = *maxBulk
+
+	log.Fatal(server.Serve(l))
+}
@@ -5,18 +5,17 @@ import (
 	"time"
 
 	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
 )
 
 func TestExpiration(t *testing.T) {
-	c := cache.NewConcurrentRingCache(10, 10, 1)
+	c := cache.NewConcurrentRingCache(10, 10, time.Millisecond)
 
-	c.SetTimeFunction(func() int64 {
-		return time.Now().UnixNano()
-	})
+	clk := clock.NewFake(time.Now())
+	c.SetClock(clk)
 
 	c.Put("Hi", "Hi")
-	d, _ := time.ParseDuration("10ms")
-	time.Sleep(d)
+	clk.Advance(10 * time.Millisecond)
 
 	if str, ok := c.Get("Hi"); ok {
 		t.Error("key found")
@@ -0,0 +1,89 @@
+package bloom
+
+import (
+	"sync/atomic"
+)
+
+// A Bloom filter that is safe for concurrent use. Items may be added while
+// others are checked, such as when it is the Filter of a cache.
+type AtomicFilter struct {
+	m    uint64
+	k    uint32
+	bits []uint64
+}
+
+// Create a filter with m bits and k hash functions.
+func NewAtomicFilter(m uint64, k uint32) *AtomicFilter {
+	f := NewFilter(m, k)
+
+	return &AtomicFilter{m: f.m, k: f.k, bits: f.bits}
+}
+
+// Create a filter sized to hold n items with a false positive rate of p.
+func NewAtomicFilterWithEstimates(n uint64, p float64) *AtomicFilter {
+	return NewAtomicFilter(OptimalSize(n, p))
+}
+
+// The number of bits in the filter.
+func (f *AtomicFilter) Bits() uint64 {
+	return f.m
+}
+
+// The number of hash functions.
+func (f *AtomicFilter) Hashes() uint32 {
+	return f.k
+}
+
+func (f *AtomicFilter) Add(data []byte) {
+	h1, h2 := baseHashes(data)
+	for i := uint32(0); i < f.k; i++ {
+		l := location(h1, h2, i, f.m)
+		w := &f.bits[l/64]
+		bit := uint64(1) << (l % 64)
+
+		for {
+			old := atomic.LoadUint64(w)
+			if old&bit != 0 || atomic.CompareAndSwapUint64(w, old, old|bit) {
+				break
+			}
+		}
+	}
+}
+
+func (f *AtomicFilter) AddString(s string) {
+	f.Add([]byte(s))
+}
+
+// Return false if data was certainly never added.
+func (f *AtomicFilter) MayContain(data []byte) bool {
+	h1, h2 := baseHashes(data)
+	for i := uint32(0); i < f.k; i++ {
+		l := location(h1, h2, i, f.m)
+		if atomic.LoadUint64(&f.bits[l/64])&(1<<(l%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *AtomicFilter) MayContainString(s string) bool {
+	return f.MayContain([]byte(s))
+}
+
+// Remove every item. Items added during a Clear may or may not remain.
+func (f *AtomicFilter) Clear() {
+	for i := range f.bits {
+		atomic.StoreUint64(&f.bits[i], 0)
+	}
+}
+
+// A copy of the filter as a Filter, which may be serialized.
+func (f *AtomicFilter) Filter() *Filter {
+	bits := make([]uint64, len(f.bits))
+	for i := range f.bits {
+		bits[i] = atomic.LoadUint64(&f.bits[i])
+	}
+
+	return &Filter{m: f.m, k: f.k, bits: bits}
+}
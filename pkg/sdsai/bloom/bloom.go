@@ -0,0 +1,227 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+// Return the number of bits, m, and hash functions, k, for a filter that
+// holds n items with a false positive rate of p.
+func OptimalSize(n uint64, p float64) (uint64, uint32) {
+	if n == 0 {
+		n = 1
+	}
+
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+
+	if k < 1 {
+		k = 1
+	}
+
+	return uint64(m), uint32(k)
+}
+
+// Compute the two hashes used to derive the k bit positions of data.
+func baseHashes(data []byte) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write(data)
+	sum := h.Sum(nil)
+
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16])
+
+	// An even h2 would revisit positions when m is even.
+	return h1, h2 | 1
+}
+
+// The i-th position of data in a filter of m positions.
+func location(h1, h2 uint64, i uint32, m uint64) uint64 {
+	return (h1 + uint64(i)*h2) % m
+}
+
+// A Bloom filter. It never reports that an added item is missing, and
+// reports that a missing item is present at a rate set when it is created.
+//
+// A Filter is not safe for concurrent modification. See AtomicFilter.
+type Filter struct {
+	m    uint64
+	k    uint32
+	bits []uint64
+}
+
+// Create a filter with m bits and k hash functions.
+func NewFilter(m uint64, k uint32) *Filter {
+	if m == 0 {
+		m = 1
+	}
+
+	if k == 0 {
+		k = 1
+	}
+
+	return &Filter{
+		m:    m,
+		k:    k,
+		bits: make([]uint64, (m+63)/64),
+	}
+}
+
+// Create a filter sized to hold n items with a false positive rate of p.
+func NewFilterWithEstimates(n uint64, p float64) *Filter {
+	return NewFilter(OptimalSize(n, p))
+}
+
+// The number of bits in the filter.
+func (f *Filter) Bits() uint64 {
+	return f.m
+}
+
+// The number of hash functions.
+func (f *Filter) Hashes() uint32 {
+	return f.k
+}
+
+func (f *Filter) Add(data []byte) {
+	h1, h2 := baseHashes(data)
+	for i := uint32(0); i < f.k; i++ {
+		l := location(h1, h2, i, f.m)
+		f.bits[l/64] |= 1 << (l % 64)
+	}
+}
+
+func (f *Filter) AddString(s string) {
+	f.Add([]byte(s))
+}
+
+// Return false if data was certainly never added.
+func (f *Filter) MayContain(data []byte) bool {
+	h1, h2 := baseHashes(data)
+	for i := uint32(0); i < f.k; i++ {
+		l := location(h1, h2, i, f.m)
+		if f.bits[l/64]&(1<<(l%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *Filter) MayContainString(s string) bool {
+	return f.MayContain([]byte(s))
+}
+
+// Add every item in other to this filter. Both must have the same size and hashes.
+func (f *Filter) Union(other *Filter) error {
+	if f.m != other.m || f.k != other.k {
+		return errors.New("Filters must have the same bits and hashes to be joined.")
+	}
+
+	for i := range f.bits {
+		f.bits[i] |= other.bits[i]
+	}
+
+	return nil
+}
+
+// Remove every item.
+func (f *Filter) Clear() {
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+}
+
+// The false positive rate expected from the bits currently set.
+func (f *Filter) EstimatedFalsePositiveRate() float64 {
+	set := 0
+	for _, w := range f.bits {
+		for ; w != 0; w &= w - 1 {
+			set++
+		}
+	}
+
+	return math.Pow(float64(set)/float64(f.m), float64(f.k))
+}
+
+var filterMagic = []byte("BLM1")
+
+// Encode the filter as "BLM1", k as a uint32, m as a uint64 and the bits
+// as uint64 words, all little endian.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 16+8*len(f.bits))
+	copy(data, filterMagic)
+	putHeader(data, f.k, f.m)
+
+	for i, w := range f.bits {
+		binary.LittleEndian.PutUint64(data[16+8*i:], w)
+	}
+
+	return data, nil
+}
+
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	k, m, body, err := unmarshalHeader(data, filterMagic)
+	if err != nil {
+		return err
+	}
+
+	words := m / 64
+	if m%64 != 0 {
+		words++
+	}
+
+	if uint64(len(body))/8 != words || len(body)%8 != 0 {
+		return errors.New("Filter data is the wrong length.")
+	}
+
+	f.k = k
+	f.m = m
+	f.bits = make([]uint64, words)
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(body[8*i:])
+	}
+
+	return nil
+}
+
+// The most hash functions a serialized filter may have. Optimal filters
+// need about one per bit of false positive rate, so this is far more than
+// any real filter uses.
+const MaxHashes = 256
+
+// Write k and m after the magic.
+func putHeader(data []byte, k uint32, m uint64) {
+	binary.LittleEndian.PutUint32(data[4:], k)
+	binary.LittleEndian.PutUint64(data[8:], m)
+}
+
+// Check the magic and return k, m and the rest of the data.
+func unmarshalHeader(data []byte, magic []byte) (uint32, uint64, []byte, error) {
+	if len(data) < 16 || string(data[0:4]) != string(magic) {
+		return 0, 0, nil, errors.New("Data is not a serialized filter.")
+	}
+
+	k := binary.LittleEndian.Uint32(data[4:])
+	m := binary.LittleEndian.Uint64(data[8:])
+
+	if k == 0 || m == 0 {
+		return 0, 0, nil, errors.New("Filter has no bits or hashes.")
+	}
+
+	if k > MaxHashes {
+		return 0, 0, nil, errors.New("Filter has too many hashes.")
+	}
+
+	// Every format stores at least a bit per bit, so a larger m is a lie.
+	if body := data[16:]; m > uint64(len(body))*8 {
+		return 0, 0, nil, errors.New("Filter has more bits than data.")
+	}
+
+	return k, m, data[16:], nil
+}
@@ -0,0 +1,173 @@
+package bloom
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+)
+
+func TestOptimalSize(t *testing.T) {
+	m, k := OptimalSize(1000, 0.01)
+
+	// About 9.6 bits per item and 7 hashes.
+	if m < 9500 || m > 9600 || k != 7 {
+		t.Errorf("Unexpected size m=%d k=%d.", m, k)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := NewFilterWithEstimates(1000, 0.01)
+
+	for i := 0; i < 1000; i++ {
+		f.AddString(fmt.Sprintf("in-%d", i))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !f.MayContainString(fmt.Sprintf("in-%d", i)) {
+			t.Fatalf("False negative for in-%d.", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.MayContainString(fmt.Sprintf("out-%d", i)) {
+			falsePositives++
+		}
+	}
+
+	if falsePositives > 300 {
+		t.Errorf("Too many false positives: %d of 10000.", falsePositives)
+	}
+
+	data, _ := f.MarshalBinary()
+	g := &Filter{}
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if g.Bits() != f.Bits() || g.Hashes() != f.Hashes() || !g.MayContainString("in-1") {
+		t.Error("Filter did not survive serialization.")
+	}
+
+	if err := g.UnmarshalBinary(data[:20]); err == nil {
+		t.Error("Truncated data should fail.")
+	}
+
+	putHeader(data, MaxHashes+1, f.Bits())
+	if err := g.UnmarshalBinary(data); err == nil {
+		t.Error("Too many hashes should fail.")
+	}
+
+	// A huge m must not wrap around to match a short body.
+	putHeader(data, f.Hashes(), math.MaxUint64)
+	if err := g.UnmarshalBinary(data[:16]); err == nil {
+		t.Error("More bits than data should fail.")
+	}
+	if err := g.UnmarshalBinary(data); err == nil {
+		t.Error("More bits than data should fail.")
+	}
+
+	other := NewFilter(f.Bits(), f.Hashes())
+	other.AddString("other")
+	if err := f.Union(other); err != nil || !f.MayContainString("other") {
+		t.Errorf("Union failed: %v", err)
+	}
+
+	if err := f.Union(NewFilter(10, 1)); err == nil {
+		t.Error("Union of different sizes should fail.")
+	}
+}
+
+func TestCountingFilter(t *testing.T) {
+	f := NewCountingFilterWithEstimates(100, 0.01)
+
+	f.AddString("a")
+	f.AddString("a")
+	f.AddString("b")
+
+	if !f.RemoveString("a") || !f.MayContainString("a") {
+		t.Error("a was added twice and should still be present.")
+	}
+
+	f.RemoveString("a")
+	if f.MayContainString("a") {
+		t.Error("a should be gone.")
+	}
+
+	if !f.MayContainString("b") || f.RemoveString("c") {
+		t.Error("b should remain and c should not be removable.")
+	}
+
+	data, _ := f.MarshalBinary()
+	g := &CountingFilter{}
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Union(f); err != nil {
+		t.Fatal(err)
+	}
+
+	// b is now counted twice.
+	g.RemoveString("b")
+	if !g.MayContainString("b") || !g.Filter().MayContainString("b") {
+		t.Error("b should still be present after the union.")
+	}
+}
+
+func TestFilterWithLoadingCache(t *testing.T) {
+	exists := NewFilterWithEstimates(100, 0.001)
+	exists.AddString("real")
+
+	c := cache.NewConcurrentRingCache(2, 10, -1)
+	c.Filter = exists
+
+	loads := 0
+	loader := func(key string) (interface{}, error) {
+		loads++
+		return key, nil
+	}
+
+	if v, err := c.GetOrLoad("real", loader); err != nil || v != "real" {
+		t.Errorf("Unexpected load %v %v.", v, err)
+	}
+
+	if _, err := c.GetOrLoad("fake", loader); err != cache.ErrKeyAbsent {
+		t.Errorf("Expected ErrKeyAbsent but got %v.", err)
+	}
+
+	if loads != 1 {
+		t.Errorf("Expected 1 load but found %d.", loads)
+	}
+}
+
+func TestAtomicFilter(t *testing.T) {
+	f := NewAtomicFilterWithEstimates(1000, 0.01)
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 1000; i += 4 {
+				f.AddString(fmt.Sprintf("in-%d", i))
+				f.MayContainString(fmt.Sprintf("out-%d", i))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	copied := f.Filter()
+	for i := 0; i < 1000; i++ {
+		if !f.MayContainString(fmt.Sprintf("in-%d", i)) || !copied.MayContainString(fmt.Sprintf("in-%d", i)) {
+			t.Fatalf("False negative for in-%d.", i)
+		}
+	}
+
+	f.Clear()
+	if f.MayContainString("in-1") {
+		t.Error("Expected in-1 to be cleared.")
+	}
+}
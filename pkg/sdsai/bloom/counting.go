@@ -0,0 +1,168 @@
+package bloom
+
+import (
+	"errors"
+	"math"
+)
+
+// A Bloom filter with a small counter in place of each bit so that items
+// may be removed.
+//
+// Counters stop at 255. A counter that reaches 255 is never decremented,
+// so heavily shared positions stay set rather than causing false negatives.
+//
+// A CountingFilter is not safe for concurrent modification.
+type CountingFilter struct {
+	m        uint64
+	k        uint32
+	counters []uint8
+}
+
+// Create a filter with m counters and k hash functions.
+func NewCountingFilter(m uint64, k uint32) *CountingFilter {
+	if m == 0 {
+		m = 1
+	}
+
+	if k == 0 {
+		k = 1
+	}
+
+	return &CountingFilter{
+		m:        m,
+		k:        k,
+		counters: make([]uint8, m),
+	}
+}
+
+// Create a filter sized to hold n items with a false positive rate of p.
+func NewCountingFilterWithEstimates(n uint64, p float64) *CountingFilter {
+	return NewCountingFilter(OptimalSize(n, p))
+}
+
+func (f *CountingFilter) Counters() uint64 {
+	return f.m
+}
+
+func (f *CountingFilter) Hashes() uint32 {
+	return f.k
+}
+
+func (f *CountingFilter) Add(data []byte) {
+	h1, h2 := baseHashes(data)
+	for i := uint32(0); i < f.k; i++ {
+		l := location(h1, h2, i, f.m)
+		if f.counters[l] < math.MaxUint8 {
+			f.counters[l]++
+		}
+	}
+}
+
+func (f *CountingFilter) AddString(s string) {
+	f.Add([]byte(s))
+}
+
+// Remove data. Removing data that was never added may cause false negatives.
+// Returns false, changing nothing, if data is certainly not present.
+func (f *CountingFilter) Remove(data []byte) bool {
+	if !f.MayContain(data) {
+		return false
+	}
+
+	h1, h2 := baseHashes(data)
+	for i := uint32(0); i < f.k; i++ {
+		l := location(h1, h2, i, f.m)
+		if f.counters[l] < math.MaxUint8 {
+			f.counters[l]--
+		}
+	}
+
+	return true
+}
+
+func (f *CountingFilter) RemoveString(s string) bool {
+	return f.Remove([]byte(s))
+}
+
+// Return false if data is certainly not present.
+func (f *CountingFilter) MayContain(data []byte) bool {
+	h1, h2 := baseHashes(data)
+	for i := uint32(0); i < f.k; i++ {
+		if f.counters[location(h1, h2, i, f.m)] == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *CountingFilter) MayContainString(s string) bool {
+	return f.MayContain([]byte(s))
+}
+
+// Add the counts of other to this filter. Both must have the same size and hashes.
+func (f *CountingFilter) Union(other *CountingFilter) error {
+	if f.m != other.m || f.k != other.k {
+		return errors.New("Filters must have the same counters and hashes to be joined.")
+	}
+
+	for i, c := range other.counters {
+		if sum := int(f.counters[i]) + int(c); sum > math.MaxUint8 {
+			f.counters[i] = math.MaxUint8
+		} else {
+			f.counters[i] = uint8(sum)
+		}
+	}
+
+	return nil
+}
+
+// Remove every item.
+func (f *CountingFilter) Clear() {
+	for i := range f.counters {
+		f.counters[i] = 0
+	}
+}
+
+// Return a plain Filter with a bit set wherever a counter is not zero.
+func (f *CountingFilter) Filter() *Filter {
+	b := NewFilter(f.m, f.k)
+	for i, c := range f.counters {
+		if c > 0 {
+			b.bits[i/64] |= 1 << (uint(i) % 64)
+		}
+	}
+
+	return b
+}
+
+var countingFilterMagic = []byte("CBF1")
+
+// Encode the filter as "CBF1", k as a uint32, m as a uint64, all little
+// endian, and then one byte per counter.
+func (f *CountingFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 16+len(f.counters))
+	copy(data, countingFilterMagic)
+	putHeader(data, f.k, f.m)
+	copy(data[16:], f.counters)
+
+	return data, nil
+}
+
+func (f *CountingFilter) UnmarshalBinary(data []byte) error {
+	k, m, body, err := unmarshalHeader(data, countingFilterMagic)
+	if err != nil {
+		return err
+	}
+
+	if uint64(len(body)) != m {
+		return errors.New("Filter data is the wrong length.")
+	}
+
+	f.k = k
+	f.m = m
+	f.counters = make([]uint8, m)
+	copy(f.counters, body)
+
+	return nil
+}
@@ -0,0 +1,393 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
+)
+
+// The bytes before the key and value of every ByteCache entry:
+// the added time in Unix nanoseconds, the key length and the value length.
+const byteEntryHeader = 8 + 2 + 4
+
+// The longest key a ByteCache stores.
+const MaxByteCacheKey = 1<<16 - 1
+
+// The largest ByteCache shard. Offsets into a shard are 32 bits.
+const MaxByteCacheShard = 1 << 32
+
+// Returned when an entry is larger than a whole ByteCache shard.
+var ErrEntryTooLarge = errors.New("The entry is larger than a shard.")
+
+// Returned when a key is longer than MaxByteCacheKey.
+var ErrKeyTooLarge = errors.New("The key is too long.")
+
+// A cache of []byte values kept in large pre-allocated ring buffers.
+//
+// Each shard holds one buffer that entries are appended to. When it is
+// full, the oldest entries are overwritten. Entries are found through a map
+// from a hash of the key to the entry's offset. Neither the buffer nor the
+// map holds pointers, so the garbage collector does not scan them no matter
+// how many entries there are.
+//
+// Replacing or removing a key leaves its old bytes in the buffer until they
+// are overwritten. StaleBytes reports how much of the buffers they take.
+// Values are copied in and out of the cache.
+//
+// Keys are assigned to shards with KeyHash, as in ConcurrentRingCache.
+type ByteCache struct {
+	RingSize int
+
+	// How old an entry may be before Get stops returning it.
+	// If this is less than 0, no limit is applied.
+	AgeLimit time.Duration
+
+	// Picks the shard of a key. See ConcurrentRingCache.KeyHash.
+	KeyHash func(key string, ringSize int) int
+
+	// Used to find the age of entries.
+	Clock clock.Clock
+
+	shards []*byteShard
+}
+
+// One ring buffer and its index.
+type byteShard struct {
+	lock sync.RWMutex
+
+	// The entries, oldest at tail and newest just before head.
+	buf []byte
+
+	// Map a hash of each live key to the offset of its newest entry.
+	index map[uint64]uint32
+
+	// Where the next entry is written.
+	head int
+
+	// Where the oldest entry starts.
+	tail int
+
+	// If true, entries run from tail to wrapAt and then from 0 to head.
+	wrapped bool
+	wrapAt  int
+
+	// Entries in the buffer, live or not.
+	entries int
+
+	// The bytes of entries in the buffer that are no longer indexed.
+	stale int
+
+	// If set to non-nil, stats are collected.
+	Stats *CacheStats
+}
+
+// Create a cache of ringSize shards, each with a buffer of shardBytes.
+// This panics if shardBytes is more than MaxByteCacheShard.
+//
+// ageLimit is how old an entry may be if it may be returned.
+// If this is less than 0, no limit is applied.
+func NewByteCache(ringSize int, shardBytes int, ageLimit time.Duration) *ByteCache {
+	if uint64(shardBytes) > MaxByteCacheShard {
+		panic(errors.New("Shards may not be larger than MaxByteCacheShard bytes."))
+	}
+
+	c := &ByteCache{
+		RingSize: ringSize,
+		AgeLimit: ageLimit,
+		KeyHash:  crc32KeyHash,
+		Clock:    clock.Real{},
+		shards:   make([]*byteShard, ringSize),
+	}
+
+	for i := range c.shards {
+		c.shards[i] = &byteShard{
+			buf:   make([]byte, shardBytes),
+			index: make(map[uint64]uint32),
+		}
+	}
+
+	return c
+}
+
+// Copy a value into the cache, overwriting the oldest entries of the
+// key's shard if there is no room.
+func (c *ByteCache) Put(key string, value []byte) error {
+	if len(key) > MaxByteCacheKey {
+		return ErrKeyTooLarge
+	}
+
+	s := c.shards[c.KeyHash(key, c.RingSize)]
+
+	size := byteEntryHeader + len(key) + len(value)
+	if size > len(s.buf) {
+		return ErrEntryTooLarge
+	}
+
+	now := c.Clock.Now().UnixNano()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.Stats != nil {
+		s.Stats.Put()
+	}
+
+	off := s.reserve(size)
+
+	h := byteKeyHash(key)
+
+	// The previous entry, unless reserve just dropped it, is now stale.
+	if old, ok := s.index[h]; ok {
+		s.stale += s.entrySize(int(old))
+
+		if s.Stats != nil {
+			if s.entryKey(int(old)) == key {
+				s.Stats.EvictFor(EvictionReplaced)
+			} else {
+				// Another key with the same hash is pushed out.
+				s.Stats.Evict()
+			}
+		}
+	}
+
+	e := s.buf[off : off+size]
+	binary.LittleEndian.PutUint64(e, uint64(now))
+	binary.LittleEndian.PutUint16(e[8:], uint16(len(key)))
+	binary.LittleEndian.PutUint32(e[10:], uint32(len(value)))
+	copy(e[byteEntryHeader:], key)
+	copy(e[byteEntryHeader+len(key):], value)
+
+	s.index[h] = uint32(off)
+	s.entries++
+
+	return nil
+}
+
+// Return a copy of the value for key.
+//
+// If the key is missing, expired or its hash collided with a newer key,
+// (nil, false) is returned.
+func (c *ByteCache) Get(key string) ([]byte, bool) {
+	s := c.shards[c.KeyHash(key, c.RingSize)]
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	added, value, ok := s.get(key)
+
+	if ok && c.AgeLimit >= 0 && c.Clock.Now().UnixNano()-added > int64(c.AgeLimit) {
+		ok = false
+	}
+
+	if s.Stats != nil {
+		if ok {
+			s.Stats.Hit()
+		} else {
+			s.Stats.Miss()
+		}
+	}
+
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte(nil), value...), true
+}
+
+// Remove a key, returning true if it was present.
+func (c *ByteCache) Remove(key string) bool {
+	s := c.shards[c.KeyHash(key, c.RingSize)]
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, _, ok := s.get(key); !ok {
+		return false
+	}
+
+	h := byteKeyHash(key)
+	s.stale += s.entrySize(int(s.index[h]))
+	delete(s.index, h)
+
+	if s.Stats != nil {
+		s.Stats.EvictFor(EvictionRemoved)
+	}
+
+	return true
+}
+
+// The number of keys in the cache, including expired ones not yet overwritten.
+func (c *ByteCache) Len() int {
+	n := 0
+
+	for _, s := range c.shards {
+		s.lock.RLock()
+		n += len(s.index)
+		s.lock.RUnlock()
+	}
+
+	return n
+}
+
+// Remove every entry.
+func (c *ByteCache) Clear() {
+	for _, s := range c.shards {
+		s.lock.Lock()
+
+		if s.Stats != nil {
+			for range s.index {
+				s.Stats.EvictFor(EvictionCleared)
+			}
+		}
+
+		s.index = make(map[uint64]uint32)
+		s.head, s.tail, s.wrapAt, s.wrapped, s.entries, s.stale = 0, 0, 0, false, 0, 0
+
+		s.lock.Unlock()
+	}
+}
+
+// The bytes held by replaced and removed entries that are not yet overwritten.
+func (c *ByteCache) StaleBytes() int {
+	n := 0
+
+	for _, s := range c.shards {
+		s.lock.RLock()
+		n += s.stale
+		s.lock.RUnlock()
+	}
+
+	return n
+}
+
+// Collect stats in every shard.
+func (c *ByteCache) EnableStats() {
+	for _, s := range c.shards {
+		s.lock.Lock()
+		s.Stats = &CacheStats{}
+		s.lock.Unlock()
+	}
+}
+
+// Return the stats of every shard added together.
+// Shards without stats are skipped.
+func (c *ByteCache) MergedStats() CacheStatsSnapshot {
+	merged := CacheStatsSnapshot{}
+
+	for _, s := range c.shards {
+		s.lock.RLock()
+		if s.Stats != nil {
+			merged.Add(s.Stats.Snapshot())
+		}
+		s.lock.RUnlock()
+	}
+
+	return merged
+}
+
+// The size of the entry at off, header included. The caller must hold the lock.
+func (s *byteShard) entrySize(off int) int {
+	e := s.buf[off:]
+	keyLen := int(binary.LittleEndian.Uint16(e[8:]))
+	valueLen := int(binary.LittleEndian.Uint32(e[10:]))
+
+	return byteEntryHeader + keyLen + valueLen
+}
+
+// The key of the entry at off. The caller must hold the lock.
+func (s *byteShard) entryKey(off int) string {
+	keyLen := int(binary.LittleEndian.Uint16(s.buf[off+8:]))
+
+	return string(s.buf[off+byteEntryHeader : off+byteEntryHeader+keyLen])
+}
+
+// Find the newest entry for key. The caller must hold the lock.
+func (s *byteShard) get(key string) (int64, []byte, bool) {
+	off, ok := s.index[byteKeyHash(key)]
+	if !ok {
+		return 0, nil, false
+	}
+
+	e := s.buf[off:]
+	keyLen := int(binary.LittleEndian.Uint16(e[8:]))
+	valueLen := int(binary.LittleEndian.Uint32(e[10:]))
+
+	// Another key with the same hash.
+	if string(e[byteEntryHeader:byteEntryHeader+keyLen]) != key {
+		return 0, nil, false
+	}
+
+	value := e[byteEntryHeader+keyLen : byteEntryHeader+keyLen+valueLen]
+
+	return int64(binary.LittleEndian.Uint64(e)), value, true
+}
+
+// Return the offset of size free bytes, dropping the oldest entries to
+// make room. The caller must hold the lock and size must fit in the buffer.
+func (s *byteShard) reserve(size int) int {
+	for {
+		if s.entries == 0 {
+			s.head, s.tail, s.wrapAt, s.wrapped = 0, 0, 0, false
+		}
+
+		if !s.wrapped {
+			if s.head+size <= len(s.buf) {
+				break
+			}
+
+			// Leave the end of the buffer unused and continue from the start.
+			s.wrapped = true
+			s.wrapAt = s.head
+			s.head = 0
+		}
+
+		if s.head+size <= s.tail {
+			break
+		}
+
+		s.dropOldest()
+	}
+
+	off := s.head
+	s.head += size
+
+	return off
+}
+
+// Drop the entry at the tail. The caller must hold the lock.
+func (s *byteShard) dropOldest() {
+	size := s.entrySize(s.tail)
+
+	// Only unindex the key if this is its newest entry.
+	h := byteKeyHash(s.entryKey(s.tail))
+	if off, ok := s.index[h]; ok && int(off) == s.tail {
+		delete(s.index, h)
+
+		if s.Stats != nil {
+			s.Stats.Evict()
+		}
+	} else {
+		s.stale -= size
+	}
+
+	s.entries--
+	s.tail += size
+
+	if s.wrapped && s.tail >= s.wrapAt {
+		s.wrapped = false
+		s.tail = 0
+	}
+}
+
+// The 64 bit FNV-1a hash of a key.
+func byteKeyHash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
+)
+
+func TestByteCache(t *testing.T) {
+	cache := NewByteCache(4, 1024, -1)
+
+	cache.Put("a", []byte("apple"))
+	cache.Put("b", []byte("banana"))
+	cache.Put("a", []byte("avocado"))
+
+	if v, ok := cache.Get("a"); !ok || string(v) != "avocado" {
+		t.Errorf("Expected avocado but found %q.", v)
+	}
+
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 but found %d.", cache.Len())
+	}
+
+	if !cache.Remove("b") || cache.Remove("b") {
+		t.Error("Only the first remove should succeed.")
+	}
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("b should be removed.")
+	}
+
+	// Values are copied.
+	v, _ := cache.Get("a")
+	v[0] = 'X'
+	if v, _ := cache.Get("a"); string(v) != "avocado" {
+		t.Errorf("Expected avocado but found %q.", v)
+	}
+
+	if err := cache.Put("big", make([]byte, 1024)); err != ErrEntryTooLarge {
+		t.Errorf("Expected ErrEntryTooLarge but found %v.", err)
+	}
+
+	if err := cache.Put(strings.Repeat("k", MaxByteCacheKey+1), nil); err != ErrKeyTooLarge {
+		t.Errorf("Expected ErrKeyTooLarge but found %v.", err)
+	}
+
+	cache.Clear()
+	if cache.Len() != 0 {
+		t.Errorf("Expected 0 but found %d.", cache.Len())
+	}
+}
+
+func TestByteCacheOverwritesOldest(t *testing.T) {
+	// Each entry is 14 + 6 + 10 = 30 bytes, so 10 fit with 4 bytes to spare.
+	cache := NewByteCache(1, 304, -1)
+	cache.EnableStats()
+
+	for i := 0; i < 100; i++ {
+		cache.Put(fmt.Sprintf("key-%02d", i), []byte(fmt.Sprintf("value-%04d", i)))
+
+		if v, ok := cache.Get(fmt.Sprintf("key-%02d", i)); !ok || string(v) != fmt.Sprintf("value-%04d", i) {
+			t.Fatalf("Lost key-%02d.", i)
+		}
+	}
+
+	if cache.Len() != 10 {
+		t.Errorf("Expected 10 but found %d.", cache.Len())
+	}
+
+	for i := 0; i < 100; i++ {
+		_, ok := cache.Get(fmt.Sprintf("key-%02d", i))
+		if ok != (i >= 90) {
+			t.Errorf("Key %d present is %t.", i, ok)
+		}
+	}
+
+	if s := cache.MergedStats(); s.Evictions[EvictionSize] != 90 || s.Puts != 100 {
+		t.Errorf("Expected 90 evictions and 100 puts but found %d and %d.", s.Evictions[EvictionSize], s.Puts)
+	}
+}
+
+func TestByteCacheMixedSizes(t *testing.T) {
+	cache := NewByteCache(1, 4096, -1)
+
+	// The newest entries that fit must always be readable.
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("k%d", i%50)
+		value := bytes.Repeat([]byte{byte(i)}, (i*37)%300)
+		if err := cache.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+
+		if v, ok := cache.Get(key); !ok || !bytes.Equal(v, value) {
+			t.Fatalf("Wrong value for %s at %d.", key, i)
+		}
+	}
+}
+
+func TestByteCacheReplace(t *testing.T) {
+	// Each entry is 14 + 1 + 10 = 25 bytes, so exactly 4 fit.
+	cache := NewByteCache(1, 100, -1)
+	cache.EnableStats()
+
+	for i := 0; i < 3; i++ {
+		cache.Put("a", []byte(fmt.Sprintf("value-%04d", i)))
+	}
+
+	if s := cache.MergedStats(); s.Evictions[EvictionReplaced] != 2 || cache.StaleBytes() != 50 {
+		t.Errorf("Expected 2 replacements and 50 stale bytes but found %d and %d.", s.Evictions[EvictionReplaced], cache.StaleBytes())
+	}
+
+	// The fifth entry overwrites the first, which was stale.
+	cache.Put("a", []byte("value-0003"))
+	cache.Put("a", []byte("value-0004"))
+
+	s := cache.MergedStats()
+	if s.Evictions[EvictionReplaced] != 4 || s.Evictions[EvictionSize] != 0 || cache.StaleBytes() != 75 {
+		t.Errorf("Expected 4 replacements, 0 size evictions and 75 stale bytes but found %d, %d and %d.", s.Evictions[EvictionReplaced], s.Evictions[EvictionSize], cache.StaleBytes())
+	}
+
+	cache.Remove("a")
+	if cache.StaleBytes() != 100 {
+		t.Errorf("Expected 100 stale bytes but found %d.", cache.StaleBytes())
+	}
+
+	cache.Clear()
+	if cache.StaleBytes() != 0 {
+		t.Errorf("Expected 0 stale bytes but found %d.", cache.StaleBytes())
+	}
+}
+
+func TestByteCacheShardTooLarge(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("A shard this large does not fit in an int.")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic.")
+		}
+	}()
+
+	size := uint64(MaxByteCacheShard) + 1
+	NewByteCache(1, int(size), -1)
+}
+
+func TestByteCacheExpiry(t *testing.T) {
+	cache := NewByteCache(2, 1024, time.Minute)
+	clk := clock.NewFake(time.Unix(0, 0))
+	cache.Clock = clk
+
+	cache.Put("a", []byte("1"))
+	clk.Advance(time.Minute)
+
+	if _, ok := cache.Get("a"); !ok {
+		t.Error("a should not be expired yet.")
+	}
+
+	clk.Advance(time.Second)
+
+	if _, ok := cache.Get("a"); ok {
+		t.Error("a should be expired.")
+	}
+}
+
+func TestByteCacheShards(t *testing.T) {
+	cache := NewByteCache(8, 1024, -1)
+	ring := NewConcurrentRingCache(8, 10, -1)
+
+	cache.Put("key", []byte("v"))
+
+	h := ring.KeyHash("key", 8)
+	if len(cache.shards[h].index) != 1 {
+		t.Errorf("Key should be in shard %d.", h)
+	}
+}
+
+func BenchmarkByteCacheGC(b *testing.B) {
+	cache := NewByteCache(16, 64<<20, -1)
+	value := make([]byte, 32)
+	for i := 0; i < 1000000; i++ {
+		cache.Put(fmt.Sprintf("key-%d", i), value)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+}
+
+func BenchmarkLIFOCacheGC(b *testing.B) {
+	cache := NewConcurrentRingCache(16, 1000000, -1)
+	for i := 0; i < 1000000; i++ {
+		cache.Put(fmt.Sprintf("key-%d", i), make([]byte, 32))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+}
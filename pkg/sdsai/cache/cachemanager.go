@@ -0,0 +1,319 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A set of named cache groups that share a single cost budget.
+//
+// Each group reserves a minimum amount of the budget that other groups
+// may not take from it. When the budget is exceeded, items are evicted
+// from the group that is using the most space beyond its reservation.
+//
+// Eviction handlers are called after the operation that evicted their
+// items, once the manager's lock is released, so they may use the manager.
+type CacheManager struct {
+	// The total cost all groups may use.
+	Budget int64
+
+	// The cost currently used by all groups. Updated atomically.
+	used int64
+
+	// The sum of all group reservations.
+	reserved int64
+
+	// Held while groups are added or removed and while the budget is enforced.
+	lock   sync.Mutex
+	groups map[string]*CacheGroup
+
+	// Eviction handler calls waiting for the lock to be released.
+	pendingLock sync.Mutex
+	pending     []func()
+}
+
+// A named cache whose items count against the budget of a CacheManager.
+type CacheGroup struct {
+	// The cost currently used by this group. Updated atomically.
+	used int64
+
+	// The name this group is registered under in its manager.
+	Name string
+
+	// The cost this group may always use without being evicted by others.
+	Reserved int64
+
+	// The underlying cache. Not exported, as items put in it directly
+	// would not count against the budget.
+	cache *ConcurrentRingCache
+
+	// Hits, misses and evictions for this group.
+	Stats *CacheStats
+
+	manager *CacheManager
+
+	// Read locked by puts and write locked by RemoveGroup to set removed,
+	// so no put can finish after RemoveGroup has emptied the group.
+	putLock sync.RWMutex
+	removed bool
+}
+
+// What is actually stored in a group's cache.
+type groupEntry struct {
+	item     interface{}
+	cost     int64
+	released int32
+	group    *CacheGroup
+}
+
+// Return this entry's cost to the group and manager. Safe to call more than once.
+func (e *groupEntry) release() {
+	if atomic.CompareAndSwapInt32(&e.released, 0, 1) {
+		atomic.AddInt64(&e.group.used, -e.cost)
+		atomic.AddInt64(&e.group.manager.used, -e.cost)
+	}
+}
+
+// Create a manager with the given total cost budget.
+func NewCacheManager(budget int64) *CacheManager {
+	return &CacheManager{
+		Budget: budget,
+		groups: make(map[string]*CacheGroup),
+	}
+}
+
+// Create and register a new group.
+//
+// reserved is the portion of the budget that is kept for this group.
+// ringSize and ageLimit are given to NewConcurrentRingCache.
+//
+// An error is returned if the name is taken or if the reservations of all
+// groups would exceed the budget.
+func (m *CacheManager) NewGroup(name string, reserved int64, ringSize int, ageLimit time.Duration) (*CacheGroup, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.groups[name]; ok {
+		return nil, errors.New("A group with that name already exists.")
+	}
+
+	if reserved < 0 {
+		return nil, errors.New("Reservations may not be negative.")
+	}
+
+	if m.reserved+reserved > m.Budget {
+		return nil, errors.New("Reservations exceed the budget.")
+	}
+
+	g := &CacheGroup{
+		Name:     name,
+		Reserved: reserved,
+		cache:    NewConcurrentRingCache(ringSize, 0, ageLimit),
+		Stats:    &CacheStats{},
+		manager:  m,
+	}
+
+	m.reserved += reserved
+	m.groups[name] = g
+
+	return g, nil
+}
+
+// Fetch a group by name.
+func (m *CacheManager) Group(name string) (*CacheGroup, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	g, ok := m.groups[name]
+	return g, ok
+}
+
+// Unregister a group and evict all its items, releasing its cost and reservation.
+//
+// Puts to the group that finish after this are dropped, so nothing is
+// left in it holding the budget.
+func (m *CacheManager) RemoveGroup(name string) bool {
+	m.lock.Lock()
+	g, ok := m.groups[name]
+	if ok {
+		delete(m.groups, name)
+		m.reserved -= g.Reserved
+	}
+	m.lock.Unlock()
+
+	if ok {
+		g.putLock.Lock()
+		g.removed = true
+		g.putLock.Unlock()
+
+		for _, _, ok := g.cache.EvictNext(); ok; _, _, ok = g.cache.EvictNext() {
+		}
+		m.runPending()
+	}
+
+	return ok
+}
+
+// Queue an eviction handler call for runPending.
+func (m *CacheManager) later(f func()) {
+	m.pendingLock.Lock()
+	m.pending = append(m.pending, f)
+	m.pendingLock.Unlock()
+}
+
+// Call queued eviction handlers. The caller must not hold m.lock.
+func (m *CacheManager) runPending() {
+	for {
+		m.pendingLock.Lock()
+		pending := m.pending
+		m.pending = nil
+		m.pendingLock.Unlock()
+
+		if len(pending) == 0 {
+			return
+		}
+
+		for _, f := range pending {
+			f()
+		}
+	}
+}
+
+// The names of all registered groups.
+func (m *CacheManager) GroupNames() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	names := make([]string, 0, len(m.groups))
+	for name := range m.groups {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// The cost used by all groups.
+func (m *CacheManager) Used() int64 {
+	return atomic.LoadInt64(&m.used)
+}
+
+// Evict items until the budget is met or no group is over its reservation.
+// Expired items are evicted first, as they would otherwise hold the budget
+// until their sub-cache is next written.
+//
+// The caller must hold m.lock.
+func (m *CacheManager) enforceBudget() {
+	if atomic.LoadInt64(&m.used) <= m.Budget {
+		return
+	}
+
+	for _, g := range m.groups {
+		g.cache.Expire()
+	}
+
+	for atomic.LoadInt64(&m.used) > m.Budget {
+		var victim *CacheGroup
+		var victimExcess int64
+
+		for _, g := range m.groups {
+			if excess := g.Used() - g.Reserved; excess > victimExcess {
+				victim = g
+				victimExcess = excess
+			}
+		}
+
+		if victim == nil {
+			return
+		}
+
+		if _, _, ok := victim.cache.EvictNext(); !ok {
+			return
+		}
+
+		victim.Stats.Evict()
+	}
+}
+
+// Add an item with the given cost to the group.
+// Items in other groups may be evicted to stay within the budget.
+func (g *CacheGroup) Put(key string, item interface{}, cost int64) {
+	g.PutWithHandler(key, item, cost, func(string, interface{}) {})
+}
+
+// Add an item with the given cost and eviction handler to the group.
+// Items in other groups may be evicted to stay within the budget.
+//
+// The item is dropped if the group has been removed from its manager.
+//
+// The manager's lock is only taken when the put goes over the budget.
+func (g *CacheGroup) PutWithHandler(key string, item interface{}, cost int64, evictionHandler func(string, interface{})) {
+	e := &groupEntry{item: item, cost: cost, group: g}
+	m := g.manager
+
+	g.putLock.RLock()
+
+	if g.removed {
+		g.putLock.RUnlock()
+		return
+	}
+
+	// Any item this replaces is released by its eviction handler.
+	atomic.AddInt64(&g.used, cost)
+	atomic.AddInt64(&m.used, cost)
+
+	g.cache.PutWithHandler(key, e, func(k string, v interface{}) {
+		entry := v.(*groupEntry)
+		entry.release()
+		m.later(func() { evictionHandler(k, entry.item) })
+	})
+
+	g.putLock.RUnlock()
+
+	if atomic.LoadInt64(&m.used) > m.Budget {
+		m.lock.Lock()
+		m.enforceBudget()
+		m.lock.Unlock()
+	}
+
+	m.runPending()
+}
+
+// Get an item from the group. See ConcurrentRingCache.Get.
+func (g *CacheGroup) Get(key string) (interface{}, bool) {
+	v, ok := g.cache.Get(key)
+
+	if ok {
+		g.Stats.Hit()
+	} else {
+		g.Stats.Miss()
+	}
+
+	if v == nil {
+		return nil, ok
+	}
+
+	return v.(*groupEntry).item, ok
+}
+
+// Remove an item from the group. Its eviction handler releases its cost.
+func (g *CacheGroup) Remove(key string) (interface{}, bool) {
+	v, ok := g.cache.Remove(key)
+	g.manager.runPending()
+	if !ok {
+		return nil, false
+	}
+
+	return v.(*groupEntry).item, true
+}
+
+// The cost used by this group.
+func (g *CacheGroup) Used() int64 {
+	return atomic.LoadInt64(&g.used)
+}
+
+// The number of items in this group.
+func (g *CacheGroup) Len() int {
+	return g.cache.Size()
+}
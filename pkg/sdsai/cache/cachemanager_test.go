@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
+)
+
+func TestCacheManager(t *testing.T) {
+	m := NewCacheManager(100)
+
+	small, err := m.NewGroup("small", 20, 4, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big, err := m.NewGroup("big", 10, 4, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.NewGroup("big", 0, 4, -1); err == nil {
+		t.Error("Duplicate group names should fail.")
+	}
+
+	if _, err := m.NewGroup("greedy", 80, 4, -1); err == nil {
+		t.Error("Reservations over the budget should fail.")
+	}
+
+	for i := 0; i < 20; i++ {
+		small.Put(fmt.Sprintf("s%d", i), i, 1)
+	}
+
+	clock := int64(0)
+	big.cache.SetTimeFunction(func() int64 {
+		clock++
+		return clock
+	})
+
+	evicted := 0
+	for i := 0; i < 100; i++ {
+		big.PutWithHandler(fmt.Sprintf("b%d", i), i, 1, func(string, interface{}) {
+			evicted++
+		})
+	}
+
+	if m.Used() != 100 {
+		t.Errorf("Expected 100 used but found %d.", m.Used())
+	}
+
+	// The small group stayed within its reservation so only big was evicted.
+	if small.Len() != 20 || small.Used() != 20 {
+		t.Errorf("Small group should be untouched but has %d items.", small.Len())
+	}
+
+	if big.Len() != 80 || evicted != 20 {
+		t.Errorf("Expected 80 items and 20 evictions but found %d and %d.", big.Len(), evicted)
+	}
+
+	if _, ok := big.Get("b0"); ok {
+		t.Error("The oldest item should have been evicted.")
+	}
+
+	if v, ok := big.Get("b99"); !ok || v != 99 {
+		t.Errorf("Expected 99 but found %v.", v)
+	}
+
+	if hit, miss, evict := big.Stats.GetStats(); hit != 1 || miss != 1 || evict != 20 {
+		t.Errorf("Unexpected stats %d %d %d.", hit, miss, evict)
+	}
+
+	// Replacing an item releases the old cost. The extra cost evicts 4 items.
+	big.Put("b99", 99, 5)
+	if big.Used() != 80 || big.Len() != 76 {
+		t.Errorf("Expected 80 used but found %d.", big.Used())
+	}
+
+	if _, ok := big.Remove("b99"); !ok || big.Used() != 75 {
+		t.Errorf("Expected 75 used but found %d.", big.Used())
+	}
+
+	if !m.RemoveGroup("big") || m.Used() != 20 {
+		t.Errorf("Expected 20 used but found %d.", m.Used())
+	}
+}
+
+func TestCacheManagerReentrantHandler(t *testing.T) {
+	m := NewCacheManager(2)
+	g, _ := m.NewGroup("g", 0, 1, -1)
+	other, _ := m.NewGroup("other", 0, 1, -1)
+
+	// Handlers run without the manager's lock, so they may use it.
+	for i := 0; i < 3; i++ {
+		g.PutWithHandler(fmt.Sprintf("k%d", i), i, 1, func(k string, v interface{}) {
+			if _, ok := m.Group("g"); !ok {
+				t.Error("Expected to find the group.")
+			}
+			other.Put(k, v, 0)
+		})
+	}
+
+	if other.Len() != 1 || m.Used() != 2 {
+		t.Errorf("Expected 1 item moved and 2 used but found %d and %d.", other.Len(), m.Used())
+	}
+}
+
+func TestCacheManagerPutAfterRemoveGroup(t *testing.T) {
+	m := NewCacheManager(10)
+	g, _ := m.NewGroup("g", 0, 1, -1)
+
+	m.RemoveGroup("g")
+	g.Put("a", 1, 1)
+
+	if g.Len() != 0 || m.Used() != 0 {
+		t.Errorf("Expected the put to be dropped but found %d items and %d used.", g.Len(), m.Used())
+	}
+}
+
+func TestCacheManagerEvictsExpiredFirst(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	m := NewCacheManager(4)
+	old, _ := m.NewGroup("old", 0, 1, time.Minute)
+	old.cache.SetClock(clk)
+	fresh, _ := m.NewGroup("fresh", 0, 1, -1)
+
+	old.Put("a", 1, 2)
+	clk.Advance(time.Second)
+	fresh.Put("b", 2, 2)
+
+	// a has expired, so it goes before the older items of larger groups.
+	clk.Advance(2 * time.Minute)
+	fresh.Put("c", 3, 2)
+
+	if old.Len() != 0 || fresh.Len() != 2 || m.Used() != 4 {
+		t.Errorf("Expected 0 and 2 items and 4 used but found %d, %d and %d.", old.Len(), fresh.Len(), m.Used())
+	}
+}
+
+func TestCacheManagerConcurrentPuts(t *testing.T) {
+	m := NewCacheManager(100)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		g, _ := m.NewGroup(fmt.Sprintf("group %d", i), 0, 4, -1)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				g.Put(fmt.Sprintf("key %d", j), j, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if m.Used() > 100 {
+		t.Errorf("Expected at most 100 used but found %d.", m.Used())
+	}
+}
@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// Copies values as they enter or leave a ConcurrentRingCache so that
+// callers may not change the cached copy. See ConcurrentRingCache.Cloner.
+type Cloner interface {
+	// Return a deep copy of item.
+	Clone(item interface{}) interface{}
+}
+
+// Adapt a function to the Cloner interface.
+type ClonerFunc func(item interface{}) interface{}
+
+func (f ClonerFunc) Clone(item interface{}) interface{} {
+	return f(item)
+}
+
+// A Cloner that copies a value by encoding and decoding it with gob.
+//
+// Only exported fields are copied. Types stored in interface values must be
+// registered with gob.Register. Values gob cannot encode cause a panic.
+type GobCloner struct{}
+
+func (GobCloner) Clone(item interface{}) interface{} {
+	if item == nil {
+		return nil
+	}
+
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(item); err != nil {
+		panic(fmt.Sprintf("Cannot clone %T: %s", item, err))
+	}
+
+	v := reflect.New(reflect.TypeOf(item))
+	if err := gob.NewDecoder(&buf).DecodeValue(v); err != nil {
+		panic(fmt.Sprintf("Cannot clone %T: %s", item, err))
+	}
+
+	return v.Elem().Interface()
+}
+
+// When a ConcurrentRingCache calls its Cloner.
+type CloneMode int
+
+// Never clone.
+const CloneNever CloneMode = 0
+
+const (
+	// Store a copy of what is put, so callers may change what they put.
+	CloneOnPut CloneMode = 1 << iota
+
+	// Return a copy of what is stored, so callers may change what they get.
+	CloneOnGet
+
+	// Clone in both directions.
+	CloneAlways = CloneOnPut | CloneOnGet
+)
+
+// Called when a cached value changed after it was put.
+// See ConcurrentRingCache.DetectMutations.
+type MutationHandler func(key string, item interface{})
+
+// Hash a value and everything it refers to.
+//
+// Pointers are followed, so two distinct values with the same contents
+// have the same hash. Maps are hashed without regard to order.
+// Functions and channels are hashed by identity.
+func valueHash(item interface{}) uint64 {
+	h := fnv.New64a()
+	hashValue(h, reflect.ValueOf(item), map[uintptr]bool{})
+	return h.Sum64()
+}
+
+func hashValue(h hash.Hash64, v reflect.Value, seen map[uintptr]bool) {
+	var n [8]byte
+	writeUint := func(u uint64) {
+		binary.LittleEndian.PutUint64(n[:], u)
+		h.Write(n[:])
+	}
+
+	if !v.IsValid() {
+		h.Write([]byte{0})
+		return
+	}
+
+	h.Write([]byte{byte(v.Kind())})
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			writeUint(1)
+		} else {
+			writeUint(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeUint(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		writeUint(math.Float64bits(v.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		writeUint(math.Float64bits(real(v.Complex())))
+		writeUint(math.Float64bits(imag(v.Complex())))
+	case reflect.String:
+		writeUint(uint64(v.Len()))
+		h.Write([]byte(v.String()))
+	case reflect.Array, reflect.Slice:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			writeUint(uint64(v.Len()))
+			h.Write(v.Bytes())
+			return
+		}
+		writeUint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			hashValue(h, v.Index(i), seen)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			hashValue(h, v.Field(i), seen)
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			writeUint(0)
+			return
+		}
+
+		// Only a pointer back to a target still being hashed is skipped,
+		// so cycles end but shared targets hash the same wherever they are.
+		p := v.Pointer()
+		if seen[p] {
+			writeUint(1)
+			return
+		}
+		seen[p] = true
+
+		hashValue(h, v.Elem(), seen)
+
+		delete(seen, p)
+	case reflect.Interface:
+		hashValue(h, v.Elem(), seen)
+	case reflect.Map:
+		// Add the hashes of the entries so their order does not matter.
+		sums := make([]uint64, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			eh := fnv.New64a()
+			hashValue(eh, iter.Key(), seen)
+			hashValue(eh, iter.Value(), seen)
+			sums = append(sums, eh.Sum64())
+		}
+		sort.Slice(sums, func(i, j int) bool { return sums[i] < sums[j] })
+		writeUint(uint64(len(sums)))
+		for _, s := range sums {
+			writeUint(s)
+		}
+	default:
+		// Functions, channels and unsafe pointers.
+		writeUint(uint64(v.Pointer()))
+	}
+}
@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"testing"
+)
+
+type profile struct {
+	Name  string
+	Tags  []string
+	Attrs map[string]int
+	Next  *profile
+}
+
+func TestCloneOnGetAndPut(t *testing.T) {
+	cache := NewConcurrentRingCache(2, 10, -1)
+	cache.Cloner = GobCloner{}
+	cache.CloneMode = CloneAlways
+
+	p := &profile{Name: "a", Tags: []string{"x"}, Attrs: map[string]int{"n": 1}}
+	cache.Put("a", p)
+
+	// Changing what was put does not change the cache.
+	p.Tags[0] = "changed"
+
+	v, _ := cache.Get("a")
+	got := v.(*profile)
+	if got.Tags[0] != "x" {
+		t.Errorf("Expected x but found %s.", got.Tags[0])
+	}
+
+	// Changing what was got does not change the cache.
+	got.Attrs["n"] = 2
+
+	v, _ = cache.Get("a")
+	if v.(*profile).Attrs["n"] != 1 {
+		t.Errorf("Expected 1 but found %d.", v.(*profile).Attrs["n"])
+	}
+
+	loaded, _ := cache.GetOrLoad("b", func(string) (interface{}, error) {
+		return &profile{Name: "b"}, nil
+	})
+	loaded.(*profile).Name = "changed"
+
+	if v, _ := cache.Get("b"); v.(*profile).Name != "b" {
+		t.Errorf("Expected b but found %s.", v.(*profile).Name)
+	}
+}
+
+func TestCloneOnGetOnly(t *testing.T) {
+	cache := NewConcurrentRingCache(2, 10, -1)
+	clones := 0
+	cache.Cloner = ClonerFunc(func(item interface{}) interface{} {
+		clones++
+		s := append([]int(nil), item.([]int)...)
+		return s
+	})
+	cache.CloneMode = CloneOnGet
+
+	cache.Put("a", []int{1, 2})
+	if clones != 0 {
+		t.Errorf("Expected 0 clones but found %d.", clones)
+	}
+
+	v, _ := cache.Get("a")
+	v.([]int)[0] = 100
+
+	if v, _ := cache.Get("a"); v.([]int)[0] != 1 || clones != 2 {
+		t.Errorf("Expected 1 after 2 clones but found %d after %d.", v.([]int)[0], clones)
+	}
+
+	// Markers are never cloned.
+	cache.PutMissing("m")
+	if v, _ := cache.Get("m"); v != Missing {
+		t.Errorf("Expected Missing but found %v.", v)
+	}
+}
+
+func TestDetectMutations(t *testing.T) {
+	cache := NewConcurrentRingCache(2, 10, -1)
+
+	changed := []string{}
+	cache.DetectMutations(func(key string, item interface{}) {
+		changed = append(changed, key)
+	})
+
+	shared := &profile{Name: "a", Attrs: map[string]int{"x": 1, "y": 2}}
+	shared.Next = shared
+	cache.Put("a", shared)
+	cache.Put("b", []byte("bytes"))
+
+	cache.Get("a")
+	cache.Get("b")
+	if len(changed) != 0 {
+		t.Errorf("Unexpected mutations %v.", changed)
+	}
+
+	shared.Attrs["x"] = 3
+	cache.Get("a")
+	cache.Get("b")
+	if len(changed) != 1 || changed[0] != "a" {
+		t.Errorf("Expected [a] but found %v.", changed)
+	}
+
+	// Putting again records the new contents.
+	cache.Put("a", shared)
+	cache.Get("a")
+	if len(changed) != 1 {
+		t.Errorf("Expected 1 mutation but found %v.", changed)
+	}
+
+	// Removed keys forget their hashes.
+	cache.Remove("a")
+	if _, ok := cache.sums[cache.KeyHash("a", 2)]["a"]; ok {
+		t.Error("The hash of a removed key should be forgotten.")
+	}
+}
+
+func TestDetectMutationsPanics(t *testing.T) {
+	cache := NewConcurrentRingCache(1, 10, -1)
+	cache.DetectMutations(nil)
+
+	s := []int{1}
+	cache.Put("a", s)
+	s[0] = 2
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic.")
+		}
+	}()
+
+	cache.Get("a")
+}
+
+func TestValueHashSharedPointers(t *testing.T) {
+	shared := &[]int{1, 2, 3}
+	value := struct{ M map[int]*[]int }{map[int]*[]int{}}
+	for i := 0; i < 20; i++ {
+		value.M[i] = shared
+	}
+
+	// Map order changes between calls, but the hash must not.
+	first := valueHash(value)
+	for i := 0; i < 200; i++ {
+		if h := valueHash(value); h != first {
+			t.Fatalf("Expected hash %d but found %d.", first, h)
+		}
+	}
+
+	(*shared)[0] = 9
+	if valueHash(value) == first {
+		t.Error("A change through a shared pointer should change the hash.")
+	}
+}
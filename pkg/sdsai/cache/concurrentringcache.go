@@ -1,8 +1,15 @@
 package cache
 
 import (
+	"errors"
+	"fmt"
 	"hash/crc32"
+	"math"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
 )
 
 // A cache that is comprised other caches in a ring.
@@ -13,16 +20,127 @@ import (
 // Keys are hashed into the ring and added to their respective
 // caches.
 //
+// The sub-caches and their locks are the lock stripes: keys in different
+// sub-caches never contend, and a larger ring spreads load further. There is
+// no lock-free map; Get takes its sub-cache's read lock.
+//
+// Get only takes a read lock and never changes a sub-cache. When it finds
+// an expired item it records that in the sub-cache's pending expiry and the
+// next write to that sub-cache evicts the expired items.
+//
+// Keys given to the Observer are buffered per sub-cache and delivered in
+// batches, so a slow or locking Observer is called once per batch rather
+// than on every Get.
+//
 type ConcurrentRingCache struct {
 	SizeLimit int
 	RingSize  int
-	AgeLimit  int64
+	AgeLimit  time.Duration
 	Caches    []*LIFOCache
 	Locks     []*sync.RWMutex
 
+	// How long a key put with PutMissing is known to be missing.
+	// If this is less than 0, no limit is applied.
+	NegativeTTL time.Duration
+
+	// How long GetOrLoad returns a loader's error without calling it again.
+	// If this is 0, errors are not cached.
+	ErrorTTL time.Duration
+
 	// A function that hashes a string into one of the caches in the Caches array.
 	// The ringSize is the length of the Cache and Locks arrays.
 	KeyHash func(key string, ringSize int) int
+
+	// Encodes and hashes the keys of PutKey, GetKey, RemoveKey and
+	// GetOrLoadKey. If nil, the DefaultKeyHasher is used.
+	KeyHasher KeyHasher
+
+	// If set, GetOrLoad does not call the loader for keys this filter
+	// says are absent. It is called from many goroutines at once. A
+	// bloom.Filter of every key the loader can find may be used if it is
+	// not changed once set; use a bloom.AtomicFilter to add keys while
+	// the cache is in use.
+	Filter KeyFilter
+
+	// Times loads for GetOrLoad. Change it with SetClock, which also
+	// gives it to the sub-caches. Setting this field alone does not.
+	Clock clock.Clock
+
+	// If set, every key passed to Get and Put is given to the Observer.
+	// It is called without any lock held and must be safe for concurrent use.
+	// If it is a BatchObserver, each batch is given to it in one call.
+	// To see only lookups, as for counting distinct keys, use ObserveLookups.
+	Observer KeyObserver
+
+	// How many keys are buffered for the Observer in each sub-cache before
+	// they are delivered. 1 or less delivers each key as it is used.
+	// See FlushReads.
+	ReadBufferSize int
+
+	// Copies items as they are put or got, as the CloneMode says.
+	// The cached copy then cannot be changed through what callers hold.
+	Cloner    Cloner
+	CloneMode CloneMode
+
+	// For each sub-cache, a hash of every item put while mutation
+	// detection is on. See DetectMutations.
+	sums            []map[string]uint64
+	mutationHandler MutationHandler
+
+	// For each sub-cache, the time before which Get has seen items expire,
+	// or noExpiry. Updated atomically. Applied by the next writer.
+	expireBefore []int64
+
+	// For each sub-cache, keys waiting to be given to the Observer.
+	readBuffers []readBuffer
+}
+
+// The default ReadBufferSize.
+const DefaultReadBufferSize = 64
+
+// Keys used in one sub-cache that have not yet been given to the Observer.
+type readBuffer struct {
+	lock sync.Mutex
+	keys []string
+}
+
+// The value of expireBefore when no expiry is pending.
+const noExpiry = math.MinInt64
+
+// Watches the keys used with a cache.
+type KeyObserver interface {
+	Observe(key string)
+}
+
+// A KeyObserver that can take many keys at once, such as under one lock.
+type BatchObserver interface {
+	KeyObserver
+
+	// Observe each key. The slice is not used by the cache afterwards.
+	ObserveBatch(keys []string)
+}
+
+// Reports whether a key may exist.
+// False must mean the key certainly does not exist.
+// It must be safe to call from many goroutines at once.
+type KeyFilter interface {
+	MayContainString(key string) bool
+}
+
+// Returned by GetOrLoad when the Filter reports that a key does not exist
+// or the key is cached as missing. A loader may return it to have the key
+// cached as missing.
+var ErrKeyAbsent = errors.New("The key does not exist.")
+
+// The type of Missing.
+type missing struct{}
+
+// What Get returns for a key put with PutMissing.
+var Missing = missing{}
+
+// A loader error cached by GetOrLoad.
+type loadError struct {
+	err error
 }
 
 // Create a new concurrent ring cache.
@@ -30,50 +148,80 @@ type ConcurrentRingCache struct {
 // cacheSize is how large each individual cache may be.
 // ageLimit is how old an item may be if it may be returned.
 //          If an item is fetched that is older than the ageLimit,
-//          it will not be returned and the cache it resides in will be
-//          updated to expire all older items.
+//          it will not be returned and the next write to the cache it
+//          resides in will expire all older items.
 //          If this is less than 0, no limit is applied.
-func NewConcurrentRingCache(ringSize int, cacheSize int, ageLimit int64) *ConcurrentRingCache {
+func NewConcurrentRingCache(ringSize int, cacheSize int, ageLimit time.Duration) *ConcurrentRingCache {
 	c := ConcurrentRingCache{}
 
 	c.RingSize = ringSize
 	c.SizeLimit = cacheSize
 	c.AgeLimit = ageLimit
+	c.NegativeTTL = ageLimit
 	c.Caches = make([]*LIFOCache, ringSize)
 	c.Locks = make([]*sync.RWMutex, ringSize)
-	c.KeyHash = func(s string, ringSize int) int {
-		h := int(crc32.ChecksumIEEE([]byte(s)))
-
-		if h < 0 {
-			h = -1
-		}
-
-		h = h % ringSize
-
-		return h
-	}
+	c.expireBefore = make([]int64, ringSize)
+	c.readBuffers = make([]readBuffer, ringSize)
+	c.ReadBufferSize = DefaultReadBufferSize
+	c.KeyHash = crc32KeyHash
 
 	for i := 0; i < ringSize; i++ {
 		c.Caches[i] = NewLIFOCache()
 		c.Locks[i] = &sync.RWMutex{}
+		c.expireBefore[i] = noExpiry
 	}
 
+	c.SetClock(clock.Real{})
+
 	return &c
 }
 
+// The default KeyHash of ConcurrentRingCache and ByteCache.
+func crc32KeyHash(s string, ringSize int) int {
+	h := int(crc32.ChecksumIEEE([]byte(s)))
+
+	if h < 0 {
+		h = -1
+	}
+
+	h = h % ringSize
+
+	return h
+}
+
+// Use the clock to order and expire items in every sub-cache and to time loads.
+// Sub-caches order items by Unix nanoseconds, not the seconds LIFOCache
+// uses alone, so that the AgeLimit may be finer than a second.
+func (c *ConcurrentRingCache) SetClock(clk clock.Clock) {
+	c.Clock = clk
+	c.EachSubCache(func(c *LIFOCache) {
+		c.Clock = clk
+		c.TimeFunction = unixNanos(clk)
+	})
+}
+
 // Set the time function that each cache in the ring of caches will use.
+//
+// The AgeLimit is compared to its values as nanoseconds.
 func (c *ConcurrentRingCache) SetTimeFunction(timeFunction func() int64) {
 	c.EachSubCache(func(c *LIFOCache) {
 		c.TimeFunction = timeFunction
 	})
 }
 
+// Add a listener to every sub-cache. See LIFOCache.AddListener.
+func (c *ConcurrentRingCache) AddListener(l EvictionListener) {
+	c.EachSubCache(func(c *LIFOCache) {
+		c.AddListener(l)
+	})
+}
+
 // Lock each sub-cache and pass it to the handler function.
 //
-// Each cache is locked as writable first.
+// Each cache is locked as writable first and any pending expiry is applied.
 func (c *ConcurrentRingCache) EachSubCache(f func(*LIFOCache)) {
 	for i := 0; i < c.RingSize; i++ {
-		c.Locks[i].Lock()
+		c.lock(i)
 
 		f(c.Caches[i])
 
@@ -82,19 +230,29 @@ func (c *ConcurrentRingCache) EachSubCache(f func(*LIFOCache)) {
 }
 
 // Add an item and enforce the cache size limit.
-func (c *ConcurrentRingCache) Put(key string, item interface{}) {
-	h := c.KeyHash(key, c.RingSize)
+//
+// Tags may be attached to the item for use with InvalidateTag.
+func (c *ConcurrentRingCache) Put(key string, item interface{}, tags ...string) {
+	c.put(c.KeyHash(key, c.RingSize), key, item, func(string, interface{}) {}, tags)
+}
 
-	c.Locks[h].Lock()
-	c.Caches[h].Put(key, item)
-	c.Locks[h].Unlock()
+func (c *ConcurrentRingCache) PutWithHandler(key string, item interface{}, evictionHandler func(string, interface{}), tags ...string) {
+	c.put(c.KeyHash(key, c.RingSize), key, item, evictionHandler, tags)
 }
 
-func (c *ConcurrentRingCache) PutWithHandler(key string, item interface{}, evictionHandler func(string, interface{})) {
-	h := c.KeyHash(key, c.RingSize)
+// Observe, clone and put an item into sub-cache h.
+func (c *ConcurrentRingCache) put(h int, key string, item interface{}, evictionHandler func(string, interface{}), tags []string) {
+	c.observe(h, key)
+	c.putAt(h, key, c.clone(item, CloneOnPut), evictionHandler, tags)
+}
 
-	c.Locks[h].Lock()
-	c.Caches[h].PutWithHandler(key, item, evictionHandler)
+// Put an item into sub-cache h.
+func (c *ConcurrentRingCache) putAt(h int, key string, item interface{}, evictionHandler func(string, interface{}), tags []string) {
+	sum := c.sum(item)
+
+	c.lock(h)
+	c.Caches[h].PutWithHandler(key, item, evictionHandler, tags...)
+	c.recordSum(h, key, sum)
 	c.Locks[h].Unlock()
 }
 
@@ -103,32 +261,80 @@ func (c *ConcurrentRingCache) PutWithHandler(key string, item interface{}, evict
 // If the key is not found in the sub-cache, (nil, false) is returned.
 //
 // If the key is found in the sub-cache but it is expired, (item, false) is
-// returned where the item is the the expired data. The sub-cache
-// is also cleaned so that no item older than the AgeLimit remains.
+// returned where the item is the the expired data. The next write to the
+// sub-cache cleans it so that no item older than the AgeLimit remains.
 //
 // If the key is found in the sub-cache and it is not expired, (item, true)
 // is returned where the item is the user's data.
+//
+// A key put with PutMissing returns (Missing, true) until the NegativeTTL
+// passes. A loader error cached by GetOrLoad is reported as not found.
 func (c *ConcurrentRingCache) Get(key string) (interface{}, bool) {
-	h := c.KeyHash(key, c.RingSize)
+	return c.get(c.KeyHash(key, c.RingSize), key)
+}
+
+// Observe and get an item from sub-cache h. See Get.
+func (c *ConcurrentRingCache) get(h int, key string) (interface{}, bool) {
+	c.observe(h, key)
 
+	item, ok := c.getAt(h, key, true)
+	if _, failed := item.(*loadError); failed {
+		return nil, false
+	}
+
+	return c.clone(item, CloneOnGet), ok
+}
+
+// Get an item as Get does, but without counting a hit or miss, observing
+// the key or checking it for mutations. This suits reading an item only to
+// decide how to replace it.
+func (c *ConcurrentRingCache) Peek(key string) (interface{}, bool) {
+	item, ok := c.getAt(c.KeyHash(key, c.RingSize), key, false)
+	if _, failed := item.(*loadError); failed {
+		return nil, false
+	}
+
+	return c.clone(item, CloneOnGet), ok
+}
+
+// Record that a key does not exist. See NegativeTTL.
+func (c *ConcurrentRingCache) PutMissing(key string) {
+	c.Put(key, Missing)
+}
+
+// Get an item from sub-cache h. See Get. If count is false, see Peek.
+func (c *ConcurrentRingCache) getAt(h int, key string, count bool) (interface{}, bool) {
 	c.Locks[h].RLock()
 	defer c.Locks[h].RUnlock()
-	item, addedAt, ok := c.Caches[h].Get(key)
+
+	var item interface{}
+	var addedAt int64
+	var ok bool
+	if count {
+		item, addedAt, ok = c.Caches[h].Get(key)
+	} else {
+		item, addedAt, ok = c.Caches[h].Peek(key)
+	}
 
 	if !ok {
 		return nil, false
 	}
 
+	if count {
+		c.verifySum(h, key, item)
+	}
+
+	timeNow := c.Caches[h].TimeFunction()
+
 	// If there is an age limit...
 	if c.AgeLimit >= 0 {
 
-		timeNow := c.Caches[h].TimeFunction()
-
 		// If the item is older than the age limit (using the cache's time function to get "now")...
-		if timeNow-addedAt > c.AgeLimit {
+		if timeNow-addedAt > int64(c.AgeLimit) {
 
-			// Clean up only this cache...
-			c.Caches[h].EvictOlderThan(timeNow - c.AgeLimit)
+			// Have the next writer clean up only this cache.
+			// We only hold the read lock and may not change it here.
+			c.deferExpiry(h, timeNow-int64(c.AgeLimit))
 
 			// And return that we couldn't find the item.
 			// NOTE: Even if expired, we do return the found item.
@@ -137,9 +343,120 @@ func (c *ConcurrentRingCache) Get(key string) (interface{}, bool) {
 		}
 	}
 
+	// Negative and error entries have their own, usually shorter, limits.
+	switch item.(type) {
+	case missing:
+		if c.NegativeTTL >= 0 && timeNow-addedAt > int64(c.NegativeTTL) {
+			return item, false
+		}
+
+		if stats := c.Caches[h].Stats; stats != nil && count {
+			stats.NegativeHit()
+		}
+	case *loadError:
+		if timeNow-addedAt > int64(c.ErrorTTL) {
+			return item, false
+		}
+	}
+
 	return item, true
 }
 
+// Record that items added before the given time have expired in sub-cache h.
+func (c *ConcurrentRingCache) deferExpiry(h int, before int64) {
+	for {
+		pending := atomic.LoadInt64(&c.expireBefore[h])
+		if pending >= before || atomic.CompareAndSwapInt64(&c.expireBefore[h], pending, before) {
+			return
+		}
+	}
+}
+
+// Lock sub-cache h for writing and evict any items Get found expired.
+func (c *ConcurrentRingCache) lock(h int) {
+	c.Locks[h].Lock()
+
+	if before := atomic.SwapInt64(&c.expireBefore[h], noExpiry); before != noExpiry {
+		c.Caches[h].EvictOlderThan(before)
+	}
+}
+
+// Evict every item older than the AgeLimit from every sub-cache.
+//
+// Get leaves expired items for the next write, so a cache that is rarely
+// written may call this periodically to release them sooner.
+func (c *ConcurrentRingCache) Expire() {
+	if c.AgeLimit < 0 {
+		return
+	}
+
+	limit := int64(c.AgeLimit)
+
+	c.EachSubCache(func(c *LIFOCache) {
+		c.EvictOlderThan(c.TimeFunction() - limit)
+	})
+}
+
+// Give a key used in sub-cache h to the Observer, once its buffer is full.
+func (c *ConcurrentRingCache) observe(h int, key string) {
+	if c.Observer == nil {
+		return
+	}
+
+	if c.ReadBufferSize <= 1 {
+		c.Observer.Observe(key)
+		return
+	}
+
+	b := &c.readBuffers[h]
+
+	b.lock.Lock()
+	b.keys = append(b.keys, key)
+	if len(b.keys) < c.ReadBufferSize {
+		b.lock.Unlock()
+		return
+	}
+	keys := b.keys
+	b.keys = make([]string, 0, c.ReadBufferSize)
+	b.lock.Unlock()
+
+	c.deliver(keys)
+}
+
+func (c *ConcurrentRingCache) deliver(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	if bo, ok := c.Observer.(BatchObserver); ok {
+		bo.ObserveBatch(keys)
+		return
+	}
+
+	for _, k := range keys {
+		c.Observer.Observe(k)
+	}
+}
+
+// Give every buffered key to the Observer now.
+// Call this before reading the Observer for an up to date view.
+func (c *ConcurrentRingCache) FlushReads() {
+	if c.Observer == nil {
+		return
+	}
+
+	for i := range c.readBuffers {
+		b := &c.readBuffers[i]
+
+		b.lock.Lock()
+		keys := b.keys
+		b.keys = nil
+		b.lock.Unlock()
+
+		c.deliver(keys)
+	}
+}
+
 // Evict items from every sub-cache until they contain the ceiling of 1/N
 // items where N is the size limit for this entire cache.
 func (c *ConcurrentRingCache) EnforceSizeLimit() {
@@ -152,6 +469,45 @@ func (c *ConcurrentRingCache) EnforceSizeLimit() {
 	})
 }
 
+// Evict every item from every sub-cache, calling the eviction handlers.
+func (c *ConcurrentRingCache) Clear() {
+	c.EachSubCache(func(c *LIFOCache) {
+		c.Clear()
+	})
+}
+
+// Evict the oldest item across all sub-caches, returning the key and value.
+//
+// If the cache is empty "", nil and false are returned.
+func (c *ConcurrentRingCache) EvictNext() (string, interface{}, bool) {
+	for {
+		oldest := -1
+		var oldestTime int64
+
+		for i := 0; i < c.RingSize; i++ {
+			c.Locks[i].RLock()
+			if c.Caches[i].Len() > 0 && (oldest < 0 || c.Caches[i].MinTime() < oldestTime) {
+				oldest = i
+				oldestTime = c.Caches[i].MinTime()
+			}
+			c.Locks[i].RUnlock()
+		}
+
+		if oldest < 0 {
+			return "", nil, false
+		}
+
+		c.lock(oldest)
+		// The sub-cache may have been emptied since we looked at it.
+		if c.Caches[oldest].Len() > 0 {
+			k, v := c.Caches[oldest].EvictNext()
+			c.Locks[oldest].Unlock()
+			return k, v, true
+		}
+		c.Locks[oldest].Unlock()
+	}
+}
+
 func (c *ConcurrentRingCache) EvictOrderThan(tm int64) {
 	c.EachSubCache(func(c *LIFOCache) {
 		c.EvictOlderThan(tm)
@@ -172,9 +528,12 @@ func (c *ConcurrentRingCache) Size() int {
 
 // Atomically remove an item from the cache.
 func (c *ConcurrentRingCache) Remove(key string) (interface{}, bool) {
-	h := c.KeyHash(key, c.RingSize)
+	return c.removeAt(c.KeyHash(key, c.RingSize), key)
+}
 
-	c.Locks[h].Lock()
+// Remove an item from sub-cache h.
+func (c *ConcurrentRingCache) removeAt(h int, key string) (interface{}, bool) {
+	c.lock(h)
 
 	item, ok := c.Caches[h].Remove(key)
 
@@ -183,10 +542,55 @@ func (c *ConcurrentRingCache) Remove(key string) (interface{}, bool) {
 	return item, ok
 }
 
+// Remove every item with the given tag from every sub-cache.
+// Eviction handlers are called. The number of items removed is returned.
+func (c *ConcurrentRingCache) InvalidateTag(tag string) int {
+	removed := 0
+
+	c.EachSubCache(func(c *LIFOCache) {
+		removed += c.InvalidateTag(tag)
+	})
+
+	return removed
+}
+
+// Remove every item whose key starts with prefix from every sub-cache.
+// Eviction handlers are called. The number of items removed is returned.
+func (c *ConcurrentRingCache) InvalidatePrefix(prefix string) int {
+	removed := 0
+
+	c.EachSubCache(func(c *LIFOCache) {
+		removed += c.InvalidatePrefix(prefix)
+	})
+
+	return removed
+}
+
 // Set all the cache objects.
+//
+// Any observer set by ObserveLookups is kept.
 func (c *ConcurrentRingCache) EnableStats() {
 	c.EachSubCache(func(c *LIFOCache) {
-		c.Stats = &CacheStats{0, 0, 0}
+		s := &CacheStats{}
+		if c.Stats != nil {
+			s.Lookups = c.Stats.Lookups
+		}
+		c.Stats = s
+	})
+}
+
+// Give every key looked up with Get to the observer through the stats
+// of each sub-cache. Stats are enabled on sub-caches that lack them.
+//
+// Unlike the Observer, which sees the keys of puts and gets for sketches
+// that decide what to keep, this sees only lookups, so it counts what
+// callers asked for. DisableStats removes it.
+func (c *ConcurrentRingCache) ObserveLookups(o KeyObserver) {
+	c.EachSubCache(func(c *LIFOCache) {
+		if c.Stats == nil {
+			c.Stats = &CacheStats{}
+		}
+		c.Stats.Lookups = o
 	})
 }
 
@@ -214,3 +618,169 @@ func (c *ConcurrentRingCache) GetStats() []*CacheStats {
 
 	return stats
 }
+
+// Return the stats of every sub-cache added together.
+// Sub-caches without stats are skipped.
+func (c *ConcurrentRingCache) MergedStats() CacheStatsSnapshot {
+	merged := CacheStatsSnapshot{}
+
+	for _, s := range c.GetStats() {
+		if s != nil {
+			merged.Add(s.Snapshot())
+		}
+	}
+
+	return merged
+}
+
+// Get an item, calling loader to create it if it is not found or expired.
+//
+// The time the loader takes and whether it fails is recorded in the stats
+// of the key's sub-cache. Loader errors are returned and cached for the
+// ErrorTTL, during which they are returned without calling the loader.
+//
+// If the Filter reports the key is absent or the key is cached as missing,
+// ErrKeyAbsent is returned without calling the loader. If the loader
+// returns ErrKeyAbsent, the key is cached as missing. See PutMissing.
+func (c *ConcurrentRingCache) GetOrLoad(key string, loader func(string) (interface{}, error)) (interface{}, error) {
+	return c.getOrLoad(c.KeyHash(key, c.RingSize), key, func() (interface{}, error) {
+		return loader(key)
+	})
+}
+
+// Get an item from sub-cache h or load it. See GetOrLoad.
+func (c *ConcurrentRingCache) getOrLoad(h int, key string, loader func() (interface{}, error)) (interface{}, error) {
+	c.observe(h, key)
+
+	if item, ok := c.getAt(h, key, true); ok {
+		switch v := item.(type) {
+		case missing:
+			return nil, ErrKeyAbsent
+		case *loadError:
+			return nil, v.err
+		default:
+			return c.clone(item, CloneOnGet), nil
+		}
+	}
+
+	if c.Filter != nil && !c.Filter.MayContainString(key) {
+		return nil, ErrKeyAbsent
+	}
+
+	start := c.Clock.Now()
+	item, err := loader()
+	elapsed := c.Clock.Now().Sub(start)
+
+	var stored interface{}
+	var sum uint64
+	if err == nil {
+		stored = c.clone(item, CloneOnPut)
+		sum = c.sum(stored)
+	}
+
+	c.lock(h)
+	defer c.Locks[h].Unlock()
+
+	if stats := c.Caches[h].Stats; stats != nil {
+		if err == nil {
+			stats.LoadSuccess(elapsed)
+		} else {
+			stats.LoadFailure(elapsed)
+		}
+	}
+
+	switch {
+	case errors.Is(err, ErrKeyAbsent):
+		c.Caches[h].Put(key, Missing)
+		return nil, err
+	case err != nil:
+		if c.ErrorTTL > 0 {
+			c.Caches[h].Put(key, &loadError{err: err})
+		}
+		return nil, err
+	}
+
+	c.Caches[h].Put(key, stored)
+	c.recordSum(h, key, sum)
+
+	// Without CloneOnPut, the caller must not get what is stored.
+	if c.CloneMode&CloneOnPut == 0 {
+		return c.clone(item, CloneOnGet), nil
+	}
+
+	return item, nil
+}
+
+// Clone an item if the CloneMode includes mode.
+// Missing and cached errors are never cloned.
+func (c *ConcurrentRingCache) clone(item interface{}, mode CloneMode) interface{} {
+	if c.Cloner == nil || c.CloneMode&mode == 0 || item == nil {
+		return item
+	}
+
+	switch item.(type) {
+	case missing, *loadError:
+		return item
+	}
+
+	return c.Cloner.Clone(item)
+}
+
+// Hash every item that is put and check the hash whenever it is got.
+// If the item has changed, the handler is called with the key and item.
+// If handler is nil, a changed item causes a panic.
+//
+// This is slow and meant for finding bugs. Call it before the cache is used
+// by more than one goroutine.
+func (c *ConcurrentRingCache) DetectMutations(handler MutationHandler) {
+	if handler == nil {
+		handler = func(key string, item interface{}) {
+			panic(fmt.Sprintf("The cached item for %q was changed after it was put.", key))
+		}
+	}
+
+	c.mutationHandler = handler
+
+	if c.sums != nil {
+		return
+	}
+
+	c.sums = make([]map[string]uint64, c.RingSize)
+	for i := range c.sums {
+		sums := make(map[string]uint64)
+		c.sums[i] = sums
+
+		// Listeners run under the sub-cache's write lock.
+		c.Caches[i].AddListener(func(e EvictionEvent) {
+			delete(sums, e.Key)
+		})
+	}
+}
+
+// Hash an item if mutations are being detected.
+func (c *ConcurrentRingCache) sum(item interface{}) uint64 {
+	if c.sums == nil {
+		return 0
+	}
+
+	return valueHash(item)
+}
+
+// Remember the hash of an item. The caller must hold the write lock.
+func (c *ConcurrentRingCache) recordSum(h int, key string, sum uint64) {
+	if c.sums != nil {
+		c.sums[h][key] = sum
+	}
+}
+
+// Call the mutation handler if an item no longer matches its hash.
+// The caller must hold a lock.
+func (c *ConcurrentRingCache) verifySum(h int, key string, item interface{}) {
+	if c.sums == nil {
+		return
+	}
+
+	if sum, ok := c.sums[h][key]; ok && sum != valueHash(item) {
+		c.mutationHandler(key, item)
+	}
+}
@@ -3,8 +3,11 @@ package cache
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
 )
 
 func TestConcurrentRingCache(t *testing.T) {
@@ -46,15 +49,19 @@ func TestConcurrentRingCacheConcurrent(t *testing.T) {
 }
 
 func TestConcurrentRingCacheTimeEvict(t *testing.T) {
-	cache := NewConcurrentRingCache(10, 5, 1)
+	cache := NewConcurrentRingCache(10, 5, time.Second)
 	called := false
-	cache.SetTimeFunction(func() int64 {
-		return time.Now().UnixNano()
-	})
+	clk := clock.NewFake(time.Unix(0, 0))
+	cache.SetClock(clk)
 	cache.PutWithHandler("hi", "hellooooo", func(string, interface{}) { called = true })
 
-	d, _ := time.ParseDuration("10ms")
-	time.Sleep(d)
+	clk.Advance(time.Second)
+
+	if _, ok := cache.Get("hi"); !ok {
+		t.Error("Item should be present at the age limit.")
+	}
+
+	clk.Advance(time.Nanosecond)
 
 	if item, ok := cache.Get("hi"); ok {
 		t.Error("Item should not be present.")
@@ -69,8 +76,329 @@ func TestConcurrentRingCacheTimeEvict(t *testing.T) {
 		}
 	}
 
+	if called {
+		t.Errorf("Get should leave eviction to a writer.")
+	}
+
+	cache.Expire()
+
 	if !called {
 		t.Errorf("Did not call eviction callback.")
 	}
 
 }
+
+func TestConcurrentRingCacheInvalidate(t *testing.T) {
+	cache := NewConcurrentRingCache(10, 100, -1)
+
+	evicted := 0
+	for i := 0; i < 50; i++ {
+		cache.PutWithHandler(fmt.Sprintf("user:%d:%d", i%5, i), i, func(string, interface{}) {
+			evicted++
+		}, fmt.Sprintf("group-%d", i%2))
+	}
+
+	if n := cache.InvalidateTag("group-0"); n != 25 {
+		t.Errorf("Expected 25 invalidated but found %d.", n)
+	}
+
+	if n := cache.InvalidatePrefix("user:1:"); n != 5 {
+		t.Errorf("Expected 5 invalidated but found %d.", n)
+	}
+
+	if evicted != 30 || cache.Size() != 20 {
+		t.Errorf("Expected 30 evicted and 20 remaining but found %d and %d.", evicted, cache.Size())
+	}
+}
+
+func TestConcurrentRingCacheDeferredExpiry(t *testing.T) {
+	cache := NewConcurrentRingCache(1, 100, 5)
+
+	now := int64(0)
+	cache.SetTimeFunction(func() int64 { return atomic.LoadInt64(&now) })
+
+	for i := 0; i < 10; i++ {
+		cache.Put(fmt.Sprintf("key %d", i), i)
+	}
+
+	atomic.StoreInt64(&now, 10)
+
+	// Concurrent readers of expired items must not change the cache.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, ok := cache.Get(fmt.Sprintf("key %d", (i+j)%10)); ok {
+					t.Error("Item should be expired.")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if cache.Size() != 10 {
+		t.Errorf("Expected 10 but found %d.", cache.Size())
+	}
+
+	cache.Put("fresh", 1)
+
+	if cache.Size() != 1 {
+		t.Errorf("Expected 1 but found %d.", cache.Size())
+	}
+}
+
+// Get as it was before expiry was deferred to writers, unchanged. It expires
+// items while holding only the read lock, which is a data race, so it is
+// only benchmarked with a workload in which nothing expires.
+func baselineGet(c *ConcurrentRingCache, key string) (interface{}, bool) {
+	h := c.KeyHash(key, c.RingSize)
+
+	c.Locks[h].RLock()
+	defer c.Locks[h].RUnlock()
+	item, addedAt, ok := c.Caches[h].Get(key)
+
+	if !ok {
+		return nil, false
+	}
+
+	if c.AgeLimit >= 0 {
+		timeNow := c.Caches[h].TimeFunction()
+
+		if timeNow-addedAt > int64(c.AgeLimit) {
+			c.Caches[h].EvictOlderThan(timeNow - int64(c.AgeLimit))
+			return item, false
+		}
+	}
+
+	return item, true
+}
+
+// A KeyObserver that takes a lock for every key, as sketches do.
+type lockingObserver struct {
+	lock  sync.Mutex
+	count int
+}
+
+func (o *lockingObserver) Observe(string) {
+	o.lock.Lock()
+	o.count++
+	o.lock.Unlock()
+}
+
+func (o *lockingObserver) ObserveBatch(keys []string) {
+	o.lock.Lock()
+	o.count += len(keys)
+	o.lock.Unlock()
+}
+
+// Run a read-heavy workload where 1 in 16 operations is a Put and each Put
+// advances the clock. With an ageLimit, older keys keep expiring.
+func benchmarkGet(b *testing.B, ageLimit time.Duration, setup func(*ConcurrentRingCache), get func(*ConcurrentRingCache, string) (interface{}, bool)) {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key %d", i)
+	}
+
+	for _, parallelism := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("goroutines-per-cpu-%d", parallelism), func(b *testing.B) {
+			cache := NewConcurrentRingCache(16, 1000, ageLimit)
+			setup(cache)
+
+			now := int64(0)
+			cache.SetTimeFunction(func() int64 { return atomic.LoadInt64(&now) })
+
+			for _, k := range keys {
+				cache.Put(k, k)
+				atomic.AddInt64(&now, 1)
+			}
+
+			seed := int64(0)
+
+			b.SetParallelism(parallelism)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddInt64(&seed, 7919))
+				for pb.Next() {
+					i++
+					k := keys[(i*31)%len(keys)]
+					if i%16 == 0 {
+						cache.Put(k, k)
+						atomic.AddInt64(&now, 1)
+					} else {
+						get(cache, k)
+					}
+				}
+			})
+		})
+	}
+}
+
+func noSetup(*ConcurrentRingCache) {}
+
+func BenchmarkConcurrentRingCacheGet(b *testing.B) {
+	benchmarkGet(b, -1, noSetup, (*ConcurrentRingCache).Get)
+}
+
+func BenchmarkConcurrentRingCacheBaselineGet(b *testing.B) {
+	benchmarkGet(b, -1, noSetup, baselineGet)
+}
+
+// The baseline cannot be run here without racing.
+func BenchmarkConcurrentRingCacheGetExpiring(b *testing.B) {
+	benchmarkGet(b, 1024, noSetup, (*ConcurrentRingCache).Get)
+}
+
+func BenchmarkConcurrentRingCacheGetObserved(b *testing.B) {
+	benchmarkGet(b, -1, func(c *ConcurrentRingCache) {
+		c.Observer = &lockingObserver{}
+	}, (*ConcurrentRingCache).Get)
+}
+
+func BenchmarkConcurrentRingCacheGetObservedUnbuffered(b *testing.B) {
+	benchmarkGet(b, -1, func(c *ConcurrentRingCache) {
+		c.Observer = &lockingObserver{}
+		c.ReadBufferSize = 1
+	}, (*ConcurrentRingCache).Get)
+}
+
+func TestConcurrentRingCacheReadBuffer(t *testing.T) {
+	cache := NewConcurrentRingCache(1, 100, -1)
+	cache.ReadBufferSize = 4
+	o := &lockingObserver{}
+	cache.Observer = o
+
+	for i := 0; i < 6; i++ {
+		cache.Get("a")
+	}
+
+	// One full batch was delivered.
+	if o.count != 4 {
+		t.Errorf("Expected 4 keys observed but found %d.", o.count)
+	}
+
+	cache.FlushReads()
+	if o.count != 6 {
+		t.Errorf("Expected 6 keys observed but found %d.", o.count)
+	}
+}
+
+func TestConcurrentRingCacheNegativeEntries(t *testing.T) {
+	cache := NewConcurrentRingCache(4, 100, time.Hour)
+	cache.NegativeTTL = time.Minute
+	cache.EnableStats()
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	cache.SetClock(clk)
+
+	loads := 0
+	loader := func(key string) (interface{}, error) {
+		loads++
+		return nil, ErrKeyAbsent
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.GetOrLoad("gone", loader); err != ErrKeyAbsent {
+			t.Errorf("Expected ErrKeyAbsent but found %v.", err)
+		}
+	}
+
+	if loads != 1 {
+		t.Errorf("Expected 1 load but found %d.", loads)
+	}
+
+	if v, ok := cache.Get("gone"); !ok || v != Missing {
+		t.Errorf("Expected Missing but found %v.", v)
+	}
+
+	if _, ok := cache.Get("never"); ok {
+		t.Error("An unknown key should not be found.")
+	}
+
+	if s := cache.MergedStats(); s.NegativeHits != 3 {
+		t.Errorf("Expected 3 negative hits but found %d.", s.NegativeHits)
+	}
+
+	// Past the NegativeTTL the loader is asked again.
+	clk.Advance(time.Minute + time.Second)
+
+	if v, ok := cache.Get("gone"); ok || v != Missing {
+		t.Errorf("Expected an expired Missing but found %v.", v)
+	}
+
+	cache.GetOrLoad("gone", loader)
+	if loads != 2 {
+		t.Errorf("Expected 2 loads but found %d.", loads)
+	}
+
+	cache.PutMissing("other")
+	if _, err := cache.GetOrLoad("other", loader); err != ErrKeyAbsent || loads != 2 {
+		t.Errorf("Expected ErrKeyAbsent without a load but found %v.", err)
+	}
+}
+
+func TestConcurrentRingCacheErrorEntries(t *testing.T) {
+	cache := NewConcurrentRingCache(4, 100, -1)
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	cache.SetClock(clk)
+
+	failure := fmt.Errorf("Backend down.")
+	loads := 0
+	loader := func(key string) (interface{}, error) {
+		loads++
+		if loads <= 3 {
+			return nil, failure
+		}
+		return "ok", nil
+	}
+
+	// Errors are not cached by default.
+	cache.GetOrLoad("k", loader)
+	cache.GetOrLoad("k", loader)
+	if loads != 2 {
+		t.Errorf("Expected 2 loads but found %d.", loads)
+	}
+
+	cache.ErrorTTL = 10 * time.Second
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.GetOrLoad("k", loader); err != failure {
+			t.Errorf("Expected the cached error but found %v.", err)
+		}
+	}
+
+	if loads != 3 {
+		t.Errorf("Expected 3 loads but found %d.", loads)
+	}
+
+	if _, ok := cache.Get("k"); ok {
+		t.Error("A cached error should not be found by Get.")
+	}
+
+	clk.Advance(11 * time.Second)
+
+	if v, err := cache.GetOrLoad("k", loader); err != nil || v != "ok" || loads != 4 {
+		t.Errorf("Expected a new load but found %v and %v.", v, err)
+	}
+}
+
+func TestConcurrentRingCachePeek(t *testing.T) {
+	cache := NewConcurrentRingCache(2, 10, -1)
+	cache.EnableStats()
+
+	cache.Put("a", 1)
+
+	if v, ok := cache.Peek("a"); !ok || v != 1 {
+		t.Errorf("Expected 1 but found %v.", v)
+	}
+
+	if _, ok := cache.Peek("b"); ok {
+		t.Error("b should not be found.")
+	}
+
+	if s := cache.MergedStats(); s.Hits != 0 || s.Misses != 0 {
+		t.Errorf("Expected no hits or misses but found %d and %d.", s.Hits, s.Misses)
+	}
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Describes an item leaving a cache.
+type EvictionEvent struct {
+	Key  string
+	Item interface{}
+
+	Reason EvictionReason
+
+	// The cache TimeFunction value when the item was added or last refreshed.
+	AddedTime int64
+
+	// When the item left the cache.
+	Time time.Time
+}
+
+// Receives EvictionEvents. See LIFOCache.AddListener.
+type EvictionListener func(EvictionEvent)
+
+// Delivers events to a listener on its own goroutine through a bounded queue.
+//
+// When the queue is full, events are either dropped and counted or the
+// cache blocks until there is room, depending on how it was created.
+type AsyncListener struct {
+	dropped  int64
+	queue    chan EvictionEvent
+	block    bool
+	listener EvictionListener
+
+	// Held for reading while enqueuing and for writing while closing.
+	lock   sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// Create an AsyncListener with room for queueSize events.
+//
+// If block is true, a full queue makes the cache wait, which happens while
+// the cache lock is held. Otherwise events that do not fit are dropped.
+func NewAsyncListener(listener EvictionListener, queueSize int, block bool) *AsyncListener {
+	a := &AsyncListener{
+		queue:    make(chan EvictionEvent, queueSize),
+		block:    block,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		for e := range a.queue {
+			a.listener(e)
+		}
+		close(a.done)
+	}()
+
+	return a
+}
+
+// The EvictionListener to give to AddListener.
+func (a *AsyncListener) Listen(e EvictionEvent) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if a.closed {
+		atomic.AddInt64(&a.dropped, 1)
+		return
+	}
+
+	if a.block {
+		a.queue <- e
+		return
+	}
+
+	select {
+	case a.queue <- e:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+}
+
+// The number of events that were dropped because the queue was full or closed.
+func (a *AsyncListener) Dropped() int64 {
+	return atomic.LoadInt64(&a.dropped)
+}
+
+// Stop accepting events and wait for the queued ones to be delivered.
+func (a *AsyncListener) Close() {
+	a.lock.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.lock.Unlock()
+
+	<-a.done
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestLIFOCacheListeners(t *testing.T) {
+	cache := NewLIFOCache()
+	clock := int64(0)
+	cache.TimeFunction = func() int64 {
+		clock++
+		return clock
+	}
+
+	events := []EvictionEvent{}
+	cache.AddListener(func(e EvictionEvent) {
+		events = append(events, e)
+	})
+
+	cache.Put("a", 1)
+	cache.Put("b", 2, "t")
+	cache.Put("c", 3)
+	cache.Put("d", 4)
+	cache.Put("e", 5)
+
+	cache.EvictNext()
+	cache.InvalidateTag("t")
+	cache.Remove("c")
+	cache.EvictOlderThan(5)
+	cache.Clear()
+
+	expected := []struct {
+		key    string
+		reason EvictionReason
+	}{
+		{"a", EvictionSize},
+		{"b", EvictionInvalidated},
+		{"c", EvictionRemoved},
+		{"d", EvictionExpired},
+		{"e", EvictionCleared},
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events but found %d.", len(expected), len(events))
+	}
+
+	for i, e := range expected {
+		if events[i].Key != e.key || events[i].Reason != e.reason {
+			t.Errorf("Event %d was %s %s, not %s %s.", i, events[i].Key, events[i].Reason, e.key, e.reason)
+		}
+
+		if events[i].AddedTime != int64(i+1) || events[i].Time.IsZero() {
+			t.Errorf("Event %d has bad times %d %s.", i, events[i].AddedTime, events[i].Time)
+		}
+	}
+}
+
+func TestAsyncListener(t *testing.T) {
+	cache := NewConcurrentRingCache(4, 1, -1)
+
+	lock := sync.Mutex{}
+	received := 0
+	async := NewAsyncListener(func(e EvictionEvent) {
+		lock.Lock()
+		received++
+		lock.Unlock()
+	}, 10, true)
+	cache.AddListener(async.Listen)
+
+	for i := 0; i < 100; i++ {
+		cache.Put(fmt.Sprintf("key %d", i), i)
+		cache.EnforceSizeLimit()
+	}
+	cache.Clear()
+
+	async.Close()
+
+	if received != 100 || async.Dropped() != 0 {
+		t.Errorf("Expected 100 events but received %d and dropped %d.", received, async.Dropped())
+	}
+
+	// Non-blocking listeners drop events once full.
+	blocked := make(chan struct{})
+	dropping := NewAsyncListener(func(e EvictionEvent) {
+		<-blocked
+	}, 1, false)
+
+	for i := 0; i < 5; i++ {
+		dropping.Listen(EvictionEvent{})
+	}
+	close(blocked)
+	dropping.Close()
+
+	// One event is being handled, one is queued and the rest are dropped.
+	if d := dropping.Dropped(); d < 3 {
+		t.Errorf("Expected at least 3 dropped events but found %d.", d)
+	}
+}
@@ -0,0 +1,338 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What an Invalidation removes.
+type InvalidationType int
+
+const (
+	// Remove a single key.
+	KeyInvalidation InvalidationType = iota
+
+	// Remove every key with a tag.
+	TagInvalidation
+
+	// Remove every key with a prefix.
+	PrefixInvalidation
+)
+
+// A message telling peers to drop cached data.
+type Invalidation struct {
+	// The node that sent this message.
+	Origin string
+
+	// Identifies one run of the origin. A restarted node has a larger epoch
+	// and starts its sequence numbers again.
+	Epoch uint64
+
+	// Increases by one with each message an origin sends in an epoch.
+	Seq uint64
+
+	Type InvalidationType
+
+	// The key, tag or prefix to invalidate.
+	Value string
+}
+
+// Carries invalidations between nodes.
+//
+// Implementations need not deliver messages in order or only once.
+// Receivers use the Origin, Epoch and Seq to discard duplicate messages.
+type InvalidationBus interface {
+	// Send a message to every other node.
+	Publish(msg Invalidation) error
+
+	// Register a function to be called with every message received.
+	Subscribe(handler func(Invalidation))
+
+	// Stop sending and receiving.
+	Close() error
+}
+
+// A ConcurrentRingCache whose removals are broadcast to, and received from,
+// other nodes over an InvalidationBus.
+//
+// Only the cache's reads and puts and the removals that are broadcast are
+// offered here, so a removal cannot skip the bus by accident. Anything done
+// to the wrapped cache directly stays on this node.
+type InvalidatingCache struct {
+	// The last sequence number this node sent. First for 64-bit alignment.
+	seq uint64
+
+	publishErrors int64
+
+	cache *ConcurrentRingCache
+
+	// The name of this node. It must be unique among nodes on the bus.
+	NodeId string
+
+	// Set from the time the cache is created. See Invalidation.Epoch.
+	Epoch uint64
+
+	Bus InvalidationBus
+
+	// If set, called with each message the bus failed to publish.
+	// Failures are counted by PublishErrors either way.
+	PublishErrorHandler func(Invalidation, error)
+
+	// The messages recently received from each origin.
+	lock     sync.Mutex
+	lastSeen map[string]*seenWindow
+}
+
+// The number of sequence numbers below the highest one seen that are
+// remembered for each origin.
+const seenWindowSize = 64
+
+// Remembers which recent sequence numbers were received from one origin.
+type seenWindow struct {
+	epoch uint64
+	high  uint64
+
+	// Bit i is set if high-i was received.
+	bits uint64
+}
+
+// Record a sequence number. Returns false if it was already seen.
+//
+// Numbers too far below the highest to be remembered are treated as new.
+// Applying an invalidation twice only costs a cache miss, while dropping
+// one would serve stale data.
+func (w *seenWindow) see(seq uint64) bool {
+	switch {
+	case seq > w.high:
+		if shift := seq - w.high; shift < seenWindowSize {
+			w.bits = w.bits<<shift | 1
+		} else {
+			w.bits = 1
+		}
+		w.high = seq
+		return true
+	case w.high-seq >= seenWindowSize:
+		return true
+	default:
+		bit := uint64(1) << (w.high - seq)
+		if w.bits&bit != 0 {
+			return false
+		}
+		w.bits |= bit
+		return true
+	}
+}
+
+// Wrap a cache so that its invalidations are shared over the bus.
+func NewInvalidatingCache(c *ConcurrentRingCache, nodeId string, bus InvalidationBus) *InvalidatingCache {
+	ic := &InvalidatingCache{
+		cache:    c,
+		NodeId:   nodeId,
+		Epoch:    uint64(time.Now().UnixNano()),
+		Bus:      bus,
+		lastSeen: make(map[string]*seenWindow),
+	}
+
+	bus.Subscribe(func(msg Invalidation) {
+		ic.Receive(msg)
+	})
+
+	return ic
+}
+
+// Remove a key here and on every other node.
+func (c *InvalidatingCache) Remove(key string) (interface{}, bool) {
+	item, ok := c.cache.Remove(key)
+	c.publish(KeyInvalidation, key)
+	return item, ok
+}
+
+// See ConcurrentRingCache.Get.
+func (c *InvalidatingCache) Get(key string) (interface{}, bool) {
+	return c.cache.Get(key)
+}
+
+// See ConcurrentRingCache.Put.
+func (c *InvalidatingCache) Put(key string, item interface{}, tags ...string) {
+	c.cache.Put(key, item, tags...)
+}
+
+// See ConcurrentRingCache.PutWithHandler.
+func (c *InvalidatingCache) PutWithHandler(key string, item interface{}, evictionHandler func(string, interface{}), tags ...string) {
+	c.cache.PutWithHandler(key, item, evictionHandler, tags...)
+}
+
+// See ConcurrentRingCache.GetOrLoad.
+func (c *InvalidatingCache) GetOrLoad(key string, loader func(string) (interface{}, error)) (interface{}, error) {
+	return c.cache.GetOrLoad(key, loader)
+}
+
+// See ConcurrentRingCache.Size.
+func (c *InvalidatingCache) Size() int {
+	return c.cache.Size()
+}
+
+// Remove every key with the tag here and on every other node.
+// The number of local items removed is returned.
+func (c *InvalidatingCache) InvalidateTag(tag string) int {
+	n := c.cache.InvalidateTag(tag)
+	c.publish(TagInvalidation, tag)
+	return n
+}
+
+// Remove every key with the prefix here and on every other node.
+// The number of local items removed is returned.
+func (c *InvalidatingCache) InvalidatePrefix(prefix string) int {
+	n := c.cache.InvalidatePrefix(prefix)
+	c.publish(PrefixInvalidation, prefix)
+	return n
+}
+
+// Apply an invalidation from another node.
+//
+// Messages from this node and duplicates of recent messages are ignored.
+// Messages that arrive out of order are applied. A message with a newer
+// epoch than its origin's last one means the origin restarted, and one with
+// an older epoch is applied without being remembered.
+// Returns true if the message was applied.
+func (c *InvalidatingCache) Receive(msg Invalidation) bool {
+	if msg.Origin == c.NodeId {
+		return false
+	}
+
+	c.lock.Lock()
+	w, ok := c.lastSeen[msg.Origin]
+	if !ok || msg.Epoch > w.epoch {
+		w = &seenWindow{epoch: msg.Epoch}
+		c.lastSeen[msg.Origin] = w
+	}
+	if msg.Epoch == w.epoch && !w.see(msg.Seq) {
+		c.lock.Unlock()
+		return false
+	}
+	c.lock.Unlock()
+
+	switch msg.Type {
+	case KeyInvalidation:
+		c.cache.Remove(msg.Value)
+	case TagInvalidation:
+		c.cache.InvalidateTag(msg.Value)
+	case PrefixInvalidation:
+		c.cache.InvalidatePrefix(msg.Value)
+	default:
+		return false
+	}
+
+	return true
+}
+
+func (c *InvalidatingCache) publish(t InvalidationType, value string) error {
+	msg := Invalidation{
+		Origin: c.NodeId,
+		Epoch:  c.Epoch,
+		Seq:    atomic.AddUint64(&c.seq, 1),
+		Type:   t,
+		Value:  value,
+	}
+
+	err := c.Bus.Publish(msg)
+	if err != nil {
+		atomic.AddInt64(&c.publishErrors, 1)
+		if c.PublishErrorHandler != nil {
+			c.PublishErrorHandler(msg, err)
+		}
+	}
+
+	return err
+}
+
+// The number of messages the bus failed to publish.
+func (c *InvalidatingCache) PublishErrors() int64 {
+	return atomic.LoadInt64(&c.publishErrors)
+}
+
+// An in-process bus, mostly for tests.
+//
+// Each call to Connect returns a new endpoint. Messages published on one
+// endpoint are delivered synchronously to the subscribers of every other endpoint.
+type MemoryBus struct {
+	lock      sync.RWMutex
+	endpoints []*memoryBusEndpoint
+}
+
+type memoryBusEndpoint struct {
+	subscribers
+	bus *MemoryBus
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{}
+}
+
+// Create a new endpoint on this bus.
+func (b *MemoryBus) Connect() InvalidationBus {
+	e := &memoryBusEndpoint{bus: b}
+
+	b.lock.Lock()
+	b.endpoints = append(b.endpoints, e)
+	b.lock.Unlock()
+
+	return e
+}
+
+func (e *memoryBusEndpoint) Publish(msg Invalidation) error {
+	e.bus.lock.RLock()
+	endpoints := e.bus.endpoints
+	e.bus.lock.RUnlock()
+
+	for _, other := range endpoints {
+		if other != e {
+			other.deliver(msg)
+		}
+	}
+
+	return nil
+}
+
+func (e *memoryBusEndpoint) Close() error {
+	e.close()
+	return nil
+}
+
+// The handlers registered with a bus. Embedded by bus implementations.
+type subscribers struct {
+	lock     sync.RWMutex
+	handlers []func(Invalidation)
+	closed   bool
+}
+
+func (s *subscribers) Subscribe(handler func(Invalidation)) {
+	s.lock.Lock()
+	s.handlers = append(s.handlers, handler)
+	s.lock.Unlock()
+}
+
+// Stop delivering messages. Returns false if already closed.
+func (s *subscribers) close() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	wasClosed := s.closed
+	s.closed = true
+
+	return !wasClosed
+}
+
+func (s *subscribers) deliver(msg Invalidation) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return
+	}
+
+	for _, h := range s.handlers {
+		h(msg)
+	}
+}
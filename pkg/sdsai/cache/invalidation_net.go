@@ -0,0 +1,392 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a TCPBus waits to connect to or write to a peer.
+const TCPBusTimeout = 2 * time.Second
+
+// How many messages a TCPBus queues for each peer.
+const TCPBusQueueSize = 1024
+
+// The longest message a TCPBus sends or receives, newline included.
+// A peer sending a longer one is disconnected.
+const TCPBusMaxMessage = 64 * 1024
+
+// Returned by TCPBus.Publish when a peer's queue is full.
+var ErrBusQueueFull = errors.New("A peer's message queue is full.")
+
+// Returned by TCPBus.Publish for a message longer than TCPBusMaxMessage.
+var ErrBusMessageTooLarge = errors.New("The message is too large to send.")
+
+// An InvalidationBus that sends each message to every peer over TCP.
+//
+// Messages are newline-delimited JSON. Publish queues each message for every
+// peer and returns without waiting. Each peer has its own goroutine and
+// connection, so a slow or dead peer does not delay the others. Connections
+// are made when first needed and re-made after an error.
+type TCPBus struct {
+	// Messages dropped because a peer's queue was full. First for 64-bit alignment.
+	dropped int64
+
+	subscribers
+
+	// If set, called from a peer's goroutine when a message could not be
+	// sent to it. Set it before publishing.
+	ErrorHandler func(peer string, err error)
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	// Guards peers, incoming and closed. Not held while sending.
+	connLock sync.Mutex
+	peers    map[string]*tcpPeer
+	incoming map[net.Conn]struct{}
+
+	// Set by Close, after which no connections are added.
+	closed bool
+}
+
+// The queue, goroutine and connection for one peer.
+type tcpPeer struct {
+	addr  string
+	queue chan []byte
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Guards conn, which is written only by the peer's goroutine.
+	lock sync.Mutex
+	conn net.Conn
+}
+
+// Listen on listenAddr and send messages to the given peer addresses.
+//
+// Use ":0" to listen on any free port and Addr to find which one was chosen.
+func NewTCPBus(listenAddr string, peers ...string) (*TCPBus, error) {
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &TCPBus{
+		listener: l,
+		peers:    make(map[string]*tcpPeer),
+		incoming: make(map[net.Conn]struct{}),
+	}
+
+	b.SetPeers(peers...)
+
+	b.wg.Add(1)
+	go b.accept()
+
+	return b, nil
+}
+
+// The address this bus is listening on.
+func (b *TCPBus) Addr() net.Addr {
+	return b.listener.Addr()
+}
+
+// Replace the addresses messages are sent to.
+// Messages queued for a removed peer are dropped.
+func (b *TCPBus) SetPeers(peers ...string) {
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	keep := make(map[string]bool)
+	for _, addr := range peers {
+		keep[addr] = true
+
+		if _, ok := b.peers[addr]; !ok {
+			p := &tcpPeer{addr: addr, queue: make(chan []byte, TCPBusQueueSize)}
+			p.ctx, p.cancel = context.WithCancel(context.Background())
+			b.peers[addr] = p
+
+			b.wg.Add(1)
+			go b.run(p)
+		}
+	}
+
+	for addr, p := range b.peers {
+		if !keep[addr] {
+			p.stop()
+			delete(b.peers, addr)
+		}
+	}
+}
+
+// Queue the message for every peer. ErrBusQueueFull is returned if any
+// peer's queue was full. Errors sending queued messages go to ErrorHandler.
+func (b *TCPBus) Publish(msg Invalidation) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if len(data) > TCPBusMaxMessage {
+		return ErrBusMessageTooLarge
+	}
+
+	b.connLock.Lock()
+	defer b.connLock.Unlock()
+
+	for _, p := range b.peers {
+		select {
+		case p.queue <- data:
+		default:
+			atomic.AddInt64(&b.dropped, 1)
+			err = ErrBusQueueFull
+		}
+	}
+
+	return err
+}
+
+// The number of messages dropped because a peer's queue was full.
+func (b *TCPBus) Dropped() int64 {
+	return atomic.LoadInt64(&b.dropped)
+}
+
+// Send queued messages to a peer until it is stopped.
+func (b *TCPBus) run(p *tcpPeer) {
+	defer b.wg.Done()
+	defer p.setConn(nil)
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case data := <-p.queue:
+			if err := p.send(data); err != nil && p.ctx.Err() == nil && b.ErrorHandler != nil {
+				b.ErrorHandler(p.addr, err)
+			}
+		}
+	}
+}
+
+// Send data, reconnecting once if the existing connection fails.
+func (p *tcpPeer) send(data []byte) error {
+	var err error
+
+	for attempt := 0; attempt < 2; attempt++ {
+		p.lock.Lock()
+		conn := p.conn
+		p.lock.Unlock()
+
+		if conn == nil {
+			d := net.Dialer{Timeout: TCPBusTimeout}
+			if conn, err = d.DialContext(p.ctx, "tcp", p.addr); err != nil {
+				return err
+			}
+			p.setConn(conn)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(TCPBusTimeout))
+		if _, err = conn.Write(data); err == nil {
+			return nil
+		}
+
+		p.setConn(nil)
+	}
+
+	return err
+}
+
+// Replace the connection, closing the old one.
+func (p *tcpPeer) setConn(conn net.Conn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn = conn
+}
+
+// Stop the peer's goroutine, interrupting any dial or write in progress.
+func (p *tcpPeer) stop() {
+	p.cancel()
+	p.setConn(nil)
+}
+
+// Stop listening and close all connections.
+func (b *TCPBus) Close() error {
+	if !b.close() {
+		return nil
+	}
+
+	err := b.listener.Close()
+
+	b.connLock.Lock()
+	b.closed = true
+	for addr, p := range b.peers {
+		p.stop()
+		delete(b.peers, addr)
+	}
+	for conn := range b.incoming {
+		conn.Close()
+	}
+	b.connLock.Unlock()
+
+	b.wg.Wait()
+
+	return err
+}
+
+func (b *TCPBus) accept() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		// Close may have run since Accept returned, and would not see this
+		// connection to close it.
+		b.connLock.Lock()
+		if b.closed {
+			b.connLock.Unlock()
+			conn.Close()
+			return
+		}
+		b.incoming[conn] = struct{}{}
+		b.wg.Add(1)
+		b.connLock.Unlock()
+
+		go b.read(conn)
+	}
+}
+
+func (b *TCPBus) read(conn net.Conn) {
+	defer b.wg.Done()
+	defer func() {
+		conn.Close()
+		b.connLock.Lock()
+		delete(b.incoming, conn)
+		b.connLock.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := readMessage(r)
+		if err != nil {
+			return
+		}
+
+		var msg Invalidation
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return
+		}
+
+		b.deliver(msg)
+	}
+}
+
+// Read one newline terminated message of at most TCPBusMaxMessage bytes.
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > TCPBusMaxMessage {
+			return nil, ErrBusMessageTooLarge
+		}
+		line = append(line, chunk...)
+
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// An InvalidationBus that sends each message as a UDP multicast datagram.
+//
+// Every node joins the same group. Nodes also receive their own messages,
+// which InvalidatingCache ignores. Delivery is not guaranteed.
+type MulticastBus struct {
+	subscribers
+
+	recv *net.UDPConn
+	send *net.UDPConn
+	wg   sync.WaitGroup
+}
+
+// Join the multicast group, such as "239.0.0.1:9999", on the given
+// interface. If ifi is nil the system chooses an interface.
+func NewMulticastBus(group string, ifi *net.Interface) (*MulticastBus, error) {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+
+	recv, err := net.ListenMulticastUDP("udp", ifi, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	send, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		recv.Close()
+		return nil, err
+	}
+
+	b := &MulticastBus{recv: recv, send: send}
+
+	b.wg.Add(1)
+	go b.read()
+
+	return b, nil
+}
+
+func (b *MulticastBus) Publish(msg Invalidation) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.send.Write(data)
+	return err
+}
+
+func (b *MulticastBus) Close() error {
+	if !b.close() {
+		return nil
+	}
+
+	b.send.Close()
+	err := b.recv.Close()
+	b.wg.Wait()
+
+	return err
+}
+
+func (b *MulticastBus) read() {
+	defer b.wg.Done()
+
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := b.recv.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		var msg Invalidation
+		if err := json.Unmarshal(buf[:n], &msg); err == nil {
+			b.deliver(msg)
+		}
+	}
+}
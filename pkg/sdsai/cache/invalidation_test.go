@@ -0,0 +1,247 @@
+package cache
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidatingCacheMemoryBus(t *testing.T) {
+	bus := NewMemoryBus()
+
+	a := NewInvalidatingCache(NewConcurrentRingCache(4, 10, -1), "a", bus.Connect())
+	b := NewInvalidatingCache(NewConcurrentRingCache(4, 10, -1), "b", bus.Connect())
+
+	for _, c := range []*InvalidatingCache{a, b} {
+		c.Put("k1", 1)
+		c.Put("k2", 2, "t")
+		c.Put("p:1", 3)
+	}
+
+	a.Remove("k1")
+	a.InvalidateTag("t")
+	b.InvalidatePrefix("p:")
+
+	for _, c := range []*InvalidatingCache{a, b} {
+		if c.Size() != 0 {
+			t.Errorf("Node %s has %d items left.", c.NodeId, c.Size())
+		}
+	}
+
+	// Duplicates are ignored.
+	b.Put("k1", 1)
+	if b.Receive(Invalidation{Origin: "a", Epoch: a.Epoch, Seq: 1, Type: KeyInvalidation, Value: "k1"}) {
+		t.Error("Duplicate message should be ignored.")
+	}
+	if b.Receive(Invalidation{Origin: "b", Epoch: b.Epoch, Seq: 100, Type: KeyInvalidation, Value: "k1"}) {
+		t.Error("Own message should be ignored.")
+	}
+	if _, ok := b.Get("k1"); !ok {
+		t.Error("k1 should not have been removed.")
+	}
+
+	// Out of order messages for other keys are applied, once.
+	if !b.Receive(Invalidation{Origin: "a", Epoch: a.Epoch, Seq: 5, Type: KeyInvalidation, Value: "x"}) {
+		t.Error("New message should be applied.")
+	}
+	if !b.Receive(Invalidation{Origin: "a", Epoch: a.Epoch, Seq: 4, Type: KeyInvalidation, Value: "k1"}) {
+		t.Error("Reordered message should be applied.")
+	}
+	if _, ok := b.Get("k1"); ok {
+		t.Error("k1 should have been removed.")
+	}
+	if b.Receive(Invalidation{Origin: "a", Epoch: a.Epoch, Seq: 4, Type: KeyInvalidation, Value: "k1"}) {
+		t.Error("Duplicate of a reordered message should be ignored.")
+	}
+
+	// Messages too old to remember are applied rather than risk a stale value.
+	b.Receive(Invalidation{Origin: "a", Epoch: a.Epoch, Seq: 1000, Type: KeyInvalidation, Value: "x"})
+	if !b.Receive(Invalidation{Origin: "a", Epoch: a.Epoch, Seq: 6, Type: KeyInvalidation, Value: "x"}) {
+		t.Error("Old message should be applied.")
+	}
+
+	// A restarted node starts its sequence again in a new epoch.
+	b.Put("k1", 1)
+	if !b.Receive(Invalidation{Origin: "a", Epoch: a.Epoch + 1, Seq: 1, Type: KeyInvalidation, Value: "k1"}) {
+		t.Error("Message from a restarted node should be applied.")
+	}
+	if _, ok := b.Get("k1"); ok {
+		t.Error("k1 should have been removed.")
+	}
+
+	// A late message from before the restart is still applied.
+	if !b.Receive(Invalidation{Origin: "a", Epoch: a.Epoch, Seq: 1001, Type: KeyInvalidation, Value: "x"}) {
+		t.Error("Message from an old epoch should be applied.")
+	}
+}
+
+func TestInvalidatingCacheTCPBus(t *testing.T) {
+	busA, err := NewTCPBus("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busA.Close()
+
+	busB, err := NewTCPBus("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busB.Close()
+
+	busA.SetPeers(busB.Addr().String())
+	busB.SetPeers(busA.Addr().String())
+
+	a := NewInvalidatingCache(NewConcurrentRingCache(4, 10, -1), "a", busA)
+	b := NewInvalidatingCache(NewConcurrentRingCache(4, 10, -1), "b", busB)
+
+	b.Put("k1", 1, "t")
+	b.Put("k2", 2, "t")
+
+	a.Remove("k1")
+	a.InvalidateTag("t")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Size() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if b.Size() != 0 {
+		t.Errorf("Node b has %d items left.", b.Size())
+	}
+}
+
+func TestTCPBusMessageSize(t *testing.T) {
+	bus, err := NewTCPBus("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+
+	if err := bus.Publish(Invalidation{Value: strings.Repeat("k", TCPBusMaxMessage)}); err != ErrBusMessageTooLarge {
+		t.Errorf("Expected ErrBusMessageTooLarge but found %v.", err)
+	}
+
+	conn, err := net.Dial("tcp", bus.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A peer that never ends its message is cut off.
+	go conn.Write(make([]byte, 2*TCPBusMaxMessage))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Errorf("Expected the connection to be closed but found %v.", err)
+	}
+}
+
+func TestTCPBusDeadPeer(t *testing.T) {
+	// Find a port nothing listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	busA, err := NewTCPBus("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busA.Close()
+
+	busB, err := NewTCPBus("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busB.Close()
+
+	errs := make(chan string, 10)
+	busA.ErrorHandler = func(peer string, err error) {
+		errs <- peer
+	}
+	busA.SetPeers(dead, busB.Addr().String())
+
+	a := NewInvalidatingCache(NewConcurrentRingCache(4, 10, -1), "a", busA)
+	b := NewInvalidatingCache(NewConcurrentRingCache(4, 10, -1), "b", busB)
+
+	b.Put("k1", 1)
+	a.Remove("k1")
+
+	if peer := <-errs; peer != dead {
+		t.Errorf("Expected an error for %s but found one for %s.", dead, peer)
+	}
+
+	// The live peer is not held up by the dead one.
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Size() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if b.Size() != 0 {
+		t.Errorf("Node b has %d items left.", b.Size())
+	}
+}
+
+func TestInvalidatingCachePublishErrors(t *testing.T) {
+	c := NewInvalidatingCache(NewConcurrentRingCache(4, 10, -1), "a", &failingBus{})
+
+	var failed Invalidation
+	c.PublishErrorHandler = func(msg Invalidation, err error) {
+		failed = msg
+	}
+
+	c.Remove("k1")
+
+	if c.PublishErrors() != 1 || failed.Value != "k1" {
+		t.Errorf("Expected 1 failure for k1 but found %d for %q.", c.PublishErrors(), failed.Value)
+	}
+}
+
+// A bus that fails to publish anything.
+type failingBus struct {
+	subscribers
+}
+
+func (*failingBus) Publish(Invalidation) error {
+	return ErrBusQueueFull
+}
+
+func (*failingBus) Close() error {
+	return nil
+}
+
+func TestInvalidatingCacheMulticastBus(t *testing.T) {
+	busA, err := NewMulticastBus("239.255.77.77:17777", nil)
+	if err != nil {
+		t.Skip("Multicast is not available: ", err)
+	}
+	defer busA.Close()
+
+	busB, err := NewMulticastBus("239.255.77.77:17777", nil)
+	if err != nil {
+		t.Skip("Multicast is not available: ", err)
+	}
+	defer busB.Close()
+
+	a := NewInvalidatingCache(NewConcurrentRingCache(4, 10, -1), "a", busA)
+	b := NewInvalidatingCache(NewConcurrentRingCache(4, 10, -1), "b", busB)
+
+	b.Put("k1", 1)
+
+	// Datagrams may be lost, so keep sending until one arrives.
+	deadline := time.Now().Add(2 * time.Second)
+	for b.Size() != 0 && time.Now().Before(deadline) {
+		if err := a.publish(KeyInvalidation, "k1"); err != nil {
+			t.Skip("Multicast is not available: ", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if b.Size() != 0 {
+		t.Skip("No multicast route on this host.")
+	}
+}
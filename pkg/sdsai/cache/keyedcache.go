@@ -0,0 +1,365 @@
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Turns keys of any supported type into bytes for a KeyedCache.
+type KeyHasher interface {
+	// Append an encoding of key to buf and return it.
+	//
+	// Two keys must have the same encoding exactly when they are equal,
+	// as they would be as keys of a Go map.
+	AppendKey(buf []byte, key interface{}) []byte
+
+	// Hash an encoding made by AppendKey. This picks the key's sub-cache.
+	Hash(encoded []byte) uint64
+}
+
+// Implemented by key types that encode themselves for DefaultKeyHasher.
+type KeyEncoder interface {
+	// Append an encoding of this key to buf and return it.
+	// Equal keys must have equal encodings and unequal keys unequal ones.
+	AppendKey(buf []byte) []byte
+}
+
+// Encodes byte slices, KeyEncoders and any type that may be a Go map key.
+// Other types, such as maps and functions, cause a panic.
+//
+// Pointers and channels are encoded by identity, as a map compares them.
+// Unlike a map, the cache does not keep them alive, so once nothing else
+// refers to the value a new one at the same address may find its entry.
+//
+// NaN is never equal to itself, so it cannot be found again as a map key
+// could not be. Floats and complex numbers holding NaN also cause a panic.
+//
+// The encoding records each value's type, so int(1) and int64(1) are
+// different keys, as are "a" and []byte("a").
+type DefaultKeyHasher struct{}
+
+// Tags that start the encoding of values whose kind does not say enough.
+const (
+	keyTagBytes   = 0x80
+	keyTagEncoder = 0x81
+	keyTagNil     = 0x82
+	keyTagTyped   = 0x83
+)
+
+func (DefaultKeyHasher) AppendKey(buf []byte, key interface{}) []byte {
+	// Avoid reflection for the common key types.
+	switch k := key.(type) {
+	case string:
+		return appendKeyBytes(append(buf, byte(reflect.String)), k)
+	case []byte:
+		return appendKeyBytes(append(buf, keyTagBytes), string(k))
+	case int:
+		return appendKeyUint(append(buf, byte(reflect.Int)), uint64(k))
+	case int64:
+		return appendKeyUint(append(buf, byte(reflect.Int64)), uint64(k))
+	case uint64:
+		return appendKeyUint(append(buf, byte(reflect.Uint64)), k)
+	case KeyEncoder:
+		return appendKeyEncoder(buf, k)
+	case nil:
+		return append(buf, keyTagNil)
+	}
+
+	return appendKeyTyped(buf, reflect.ValueOf(key))
+}
+
+// The 64 bit FNV-1a hash of the encoding.
+func (DefaultKeyHasher) Hash(encoded []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, b := range encoded {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	return h
+}
+
+var keyEncoderType = reflect.TypeOf((*KeyEncoder)(nil)).Elem()
+
+func appendKeyValue(buf []byte, v reflect.Value) []byte {
+	if v.Type().Implements(keyEncoderType) && v.CanInterface() {
+		return appendKeyEncoder(buf, v.Interface().(KeyEncoder))
+	}
+
+	kind := v.Kind()
+
+	switch kind {
+	case reflect.String:
+		return appendKeyBytes(append(buf, byte(kind)), v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, byte(kind), 1)
+		}
+		return append(buf, byte(kind), 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendKeyUint(append(buf, byte(kind)), uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendKeyUint(append(buf, byte(kind)), v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return appendKeyFloat(append(buf, byte(kind)), v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		return appendKeyFloat(appendKeyFloat(append(buf, byte(kind)), real(c)), imag(c))
+	case reflect.Ptr, reflect.Chan, reflect.UnsafePointer:
+		return appendKeyUint(append(buf, byte(kind)), uint64(v.Pointer()))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendKeyBytes(append(buf, keyTagBytes), string(v.Bytes()))
+		}
+	case reflect.Array:
+		buf = append(buf, byte(kind))
+		for i := 0; i < v.Len(); i++ {
+			buf = appendKeyValue(buf, v.Index(i))
+		}
+		return buf
+	case reflect.Struct:
+		buf = append(buf, byte(kind))
+		for i := 0; i < v.NumField(); i++ {
+			buf = appendKeyValue(buf, v.Field(i))
+		}
+		return buf
+	case reflect.Interface:
+		if v.IsNil() {
+			return append(buf, keyTagNil)
+		}
+		return appendKeyTyped(buf, v.Elem())
+	}
+
+	panic(fmt.Sprintf("Keys of type %s are not supported.", v.Type()))
+}
+
+// Append the bits of a float, which must not be NaN.
+func appendKeyFloat(buf []byte, f float64) []byte {
+	if math.IsNaN(f) {
+		panic("NaN keys are not supported.")
+	}
+	if f == 0 {
+		// -0 == +0.
+		f = 0
+	}
+	return appendKeyUint(buf, math.Float64bits(f))
+}
+
+// Append the type of a value and then the value. Values of different
+// types, such as a named integer type and int, are never equal.
+func appendKeyTyped(buf []byte, v reflect.Value) []byte {
+	return appendKeyValue(appendKeyType(append(buf, keyTagTyped), v.Type()), v)
+}
+
+// Numbers given to key types in the order they are first seen.
+// Encodings are never stored outside the process, so numbers may differ
+// between runs.
+var keyTypes = struct {
+	lock sync.Mutex
+	ids  sync.Map
+	next uint64
+}{}
+
+// Append a number that is unique to the type.
+func appendKeyType(buf []byte, t reflect.Type) []byte {
+	id, ok := keyTypes.ids.Load(t)
+	if !ok {
+		keyTypes.lock.Lock()
+		if id, ok = keyTypes.ids.Load(t); !ok {
+			id = keyTypes.next
+			keyTypes.next++
+			keyTypes.ids.Store(t, id)
+		}
+		keyTypes.lock.Unlock()
+	}
+
+	var n [binary.MaxVarintLen64]byte
+	return append(buf, n[:binary.PutUvarint(n[:], id.(uint64))]...)
+}
+
+// Append a length prefixed string.
+func appendKeyBytes(buf []byte, s string) []byte {
+	var n [binary.MaxVarintLen64]byte
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(s)))]...)
+	return append(buf, s...)
+}
+
+func appendKeyUint(buf []byte, u uint64) []byte {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], u)
+	return append(buf, n[:]...)
+}
+
+// Append the type and length prefixed encoding of a KeyEncoder.
+func appendKeyEncoder(buf []byte, e KeyEncoder) []byte {
+	buf = appendKeyType(append(buf, keyTagEncoder), reflect.TypeOf(e))
+	return appendKeyBytes(buf, string(e.AppendKey(nil)))
+}
+
+// Buffers for encoding keys, so the encoded string is the only allocation.
+var keyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 64)
+		return &b
+	},
+}
+
+// Return the hash and encoding of a key.
+//
+// The encoding is copied into a new string, which is the one allocation
+// each keyed operation makes.
+func encodeKey(hasher KeyHasher, key interface{}) (uint64, string) {
+	if hasher == nil {
+		hasher = DefaultKeyHasher{}
+	}
+
+	b := keyBuffers.Get().(*[]byte)
+	encoded := hasher.AppendKey((*b)[:0], key)
+	hash, s := hasher.Hash(encoded), string(encoded)
+
+	*b = encoded[:0]
+	keyBuffers.Put(b)
+
+	return hash, s
+}
+
+// Return the sub-cache index and encoding of a key.
+func (c *ConcurrentRingCache) locate(hasher KeyHasher, key interface{}) (int, string) {
+	hash, encoded := encodeKey(hasher, key)
+
+	return int(hash % uint64(c.RingSize)), encoded
+}
+
+// Add an item under a key of any type the KeyHasher can encode.
+//
+// The item is stored under the key's encoding, so equality is exact, in
+// the sub-cache chosen by the encoding's hash. It must be read back with
+// GetKey, RemoveKey or GetOrLoadKey. The Observer, Filter and listeners
+// see the encoded key.
+func (c *ConcurrentRingCache) PutKey(key interface{}, item interface{}, tags ...string) {
+	c.PutKeyWithHandler(key, item, func(interface{}, interface{}) {}, tags...)
+}
+
+// Like PutKey, but the eviction handler is given the original key and item.
+func (c *ConcurrentRingCache) PutKeyWithHandler(key interface{}, item interface{}, evictionHandler func(interface{}, interface{}), tags ...string) {
+	h, encoded := c.locate(c.KeyHasher, key)
+
+	c.put(h, encoded, item, func(_ string, v interface{}) {
+		evictionHandler(key, v)
+	}, tags)
+}
+
+// Get an item put with PutKey. See Get.
+func (c *ConcurrentRingCache) GetKey(key interface{}) (interface{}, bool) {
+	return c.get(c.locate(c.KeyHasher, key))
+}
+
+// Remove an item put with PutKey, calling its eviction handler.
+func (c *ConcurrentRingCache) RemoveKey(key interface{}) (interface{}, bool) {
+	return c.removeAt(c.locate(c.KeyHasher, key))
+}
+
+// Get an item put with PutKey, calling loader to create it. See GetOrLoad.
+func (c *ConcurrentRingCache) GetOrLoadKey(key interface{}, loader func(interface{}) (interface{}, error)) (interface{}, error) {
+	h, encoded := c.locate(c.KeyHasher, key)
+
+	return c.getOrLoad(h, encoded, func() (interface{}, error) {
+		return loader(key)
+	})
+}
+
+// Add an item under a key of any type the KeyHasher can encode. It must be
+// read back with GetKey or RemoveKey. Listeners see the encoded key.
+func (c *LIFOCache) PutKey(key interface{}, item interface{}, tags ...string) (interface{}, bool) {
+	return c.PutKeyWithHandler(key, item, func(interface{}, interface{}) {}, tags...)
+}
+
+// Like PutKey, but the eviction handler is given the original key and item.
+func (c *LIFOCache) PutKeyWithHandler(key interface{}, item interface{}, evictionHandler func(interface{}, interface{}), tags ...string) (interface{}, bool) {
+	_, encoded := encodeKey(c.KeyHasher, key)
+
+	return c.PutWithHandler(encoded, item, func(_ string, v interface{}) {
+		evictionHandler(key, v)
+	}, tags...)
+}
+
+// Get an item put with PutKey. See Get.
+func (c *LIFOCache) GetKey(key interface{}) (interface{}, int64, bool) {
+	_, encoded := encodeKey(c.KeyHasher, key)
+
+	return c.Get(encoded)
+}
+
+// Remove an item put with PutKey, calling its eviction handler.
+func (c *LIFOCache) RemoveKey(key interface{}) (interface{}, bool) {
+	_, encoded := encodeKey(c.KeyHasher, key)
+
+	return c.Remove(encoded)
+}
+
+// A ConcurrentRingCache used through its keyed methods, so callers need not
+// format keys as strings. See ConcurrentRingCache.PutKey.
+//
+// The Observer, Cloner, Filter, negative caching and listeners of the
+// Cache all apply. The Cache may also be used directly for operations on
+// every sub-cache such as Clear, EvictNext and EnforceSizeLimit.
+type KeyedCache struct {
+	// The underlying cache.
+	Cache *ConcurrentRingCache
+
+	// Encodes and hashes keys. This is the KeyHasher of the Cache.
+	Hasher KeyHasher
+}
+
+// Create a KeyedCache using the DefaultKeyHasher.
+// The arguments are given to NewConcurrentRingCache.
+func NewKeyedCache(ringSize int, cacheSize int, ageLimit time.Duration) *KeyedCache {
+	c := &KeyedCache{
+		Cache:  NewConcurrentRingCache(ringSize, cacheSize, ageLimit),
+		Hasher: DefaultKeyHasher{},
+	}
+	c.Cache.KeyHasher = c.Hasher
+
+	return c
+}
+
+// Add an item. See ConcurrentRingCache.PutKey.
+func (c *KeyedCache) Put(key interface{}, item interface{}, tags ...string) {
+	c.PutWithHandler(key, item, func(interface{}, interface{}) {}, tags...)
+}
+
+// Add an item whose eviction handler is given the original key and item.
+func (c *KeyedCache) PutWithHandler(key interface{}, item interface{}, evictionHandler func(interface{}, interface{}), tags ...string) {
+	h, encoded := c.Cache.locate(c.Hasher, key)
+
+	c.Cache.put(h, encoded, item, func(_ string, v interface{}) {
+		evictionHandler(key, v)
+	}, tags)
+}
+
+// Get an item. See ConcurrentRingCache.Get.
+func (c *KeyedCache) Get(key interface{}) (interface{}, bool) {
+	return c.Cache.get(c.Cache.locate(c.Hasher, key))
+}
+
+// Remove an item, calling its eviction handler.
+func (c *KeyedCache) Remove(key interface{}) (interface{}, bool) {
+	return c.Cache.removeAt(c.Cache.locate(c.Hasher, key))
+}
+
+// Get an item, calling loader to create it. See ConcurrentRingCache.GetOrLoad.
+func (c *KeyedCache) GetOrLoad(key interface{}, loader func(interface{}) (interface{}, error)) (interface{}, error) {
+	h, encoded := c.Cache.locate(c.Hasher, key)
+
+	return c.Cache.getOrLoad(h, encoded, func() (interface{}, error) {
+		return loader(key)
+	})
+}
+
+// The number of items in the cache.
+func (c *KeyedCache) Len() int {
+	return c.Cache.Size()
+}
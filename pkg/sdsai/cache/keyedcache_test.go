@@ -0,0 +1,247 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+type userKey struct {
+	Tenant string
+	Id     int64
+	Raw    [2]byte
+}
+
+type userId int
+
+// A key that only compares its lower case name.
+type nameKey string
+
+func (k nameKey) AppendKey(buf []byte) []byte {
+	for _, r := range string(k) {
+		if r >= 'A' && r <= 'Z' {
+			r += 'a' - 'A'
+		}
+		buf = append(buf, string(r)...)
+	}
+	return buf
+}
+
+func TestKeyedCache(t *testing.T) {
+	cache := NewKeyedCache(8, 100, -1)
+
+	cache.Put(userKey{"a", 1, [2]byte{1, 2}}, "a1")
+	cache.Put(userKey{"a", 2, [2]byte{1, 2}}, "a2")
+	cache.Put(1, "int")
+	cache.Put(int64(1), "int64")
+	cache.Put(userId(1), "userId")
+	cache.Put("x", "string")
+	cache.Put([]byte("x"), "bytes")
+	cache.Put(0.0, "zero")
+	cache.Put(nameKey("Bob"), "bob")
+
+	if cache.Len() != 9 {
+		t.Errorf("Expected 9 but found %d.", cache.Len())
+	}
+
+	cases := []struct {
+		key      interface{}
+		expected string
+	}{
+		{userKey{"a", 1, [2]byte{1, 2}}, "a1"},
+		{userKey{"a", 2, [2]byte{1, 2}}, "a2"},
+		{1, "int"},
+		{int64(1), "int64"},
+		{userId(1), "userId"},
+		{"x", "string"},
+		{[]byte("x"), "bytes"},
+		{math.Copysign(0, -1), "zero"},
+		{nameKey("BOB"), "bob"},
+	}
+
+	for _, c := range cases {
+		if v, ok := cache.Get(c.key); !ok || v != c.expected {
+			t.Errorf("Expected %s for %#v but found %v.", c.expected, c.key, v)
+		}
+	}
+
+	if _, ok := cache.Get(userKey{"a", 3, [2]byte{1, 2}}); ok {
+		t.Error("Key should not be found.")
+	}
+}
+
+func TestKeyedCacheHandlerAndShard(t *testing.T) {
+	cache := NewKeyedCache(8, 100, -1)
+
+	var evictedKey, evictedItem interface{}
+	key := userKey{"b", 7, [2]byte{}}
+	cache.PutWithHandler(key, 7, func(k interface{}, v interface{}) {
+		evictedKey, evictedItem = k, v
+	})
+
+	encoded := cache.Hasher.AppendKey(nil, key)
+	h := int(cache.Hasher.Hash(encoded) % 8)
+	if cache.Cache.Caches[h].Len() != 1 {
+		t.Errorf("Key is not in sub-cache %d.", h)
+	}
+
+	if v, ok := cache.Remove(key); !ok || v != 7 {
+		t.Errorf("Expected 7 but found %v.", v)
+	}
+
+	if evictedKey != key || evictedItem != 7 {
+		t.Errorf("Handler got %v and %v.", evictedKey, evictedItem)
+	}
+}
+
+// A key made of comparable types with no obvious byte encoding.
+type handleKey struct {
+	p *int
+	c complex64
+	i interface{}
+}
+
+func TestKeyedCacheIdentityKeys(t *testing.T) {
+	cache := NewKeyedCache(4, 100, -1)
+
+	a, b := new(int), new(int)
+	ch := make(chan int)
+
+	cache.Put(handleKey{a, 1 + 2i, ch}, "a")
+	cache.Put(handleKey{b, 1 + 2i, ch}, "b")
+	cache.Put(handleKey{a, complex64(complex(0, math.Copysign(0, -1))), nil}, "zero")
+
+	if v, ok := cache.Get(handleKey{a, 1 + 2i, ch}); !ok || v != "a" {
+		t.Errorf("Expected a but found %v.", v)
+	}
+
+	if v, ok := cache.Get(handleKey{b, 1 + 2i, ch}); !ok || v != "b" {
+		t.Errorf("Expected b but found %v.", v)
+	}
+
+	if v, ok := cache.Get(handleKey{a, 0, nil}); !ok || v != "zero" {
+		t.Errorf("Expected zero but found %v.", v)
+	}
+
+	if _, ok := cache.Get(handleKey{a, 1 + 2i, make(chan int)}); ok {
+		t.Error("A different channel should not be found.")
+	}
+}
+
+func TestKeyedCacheUnsupportedKey(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Map keys should panic.")
+		}
+	}()
+
+	NewKeyedCache(1, 10, -1).Put(map[string]int{}, 1)
+}
+
+// Counts the keys it is given.
+type countingObserver struct {
+	keys int
+}
+
+func (o *countingObserver) Observe(string) {
+	o.keys++
+}
+
+func TestConcurrentRingCacheKeys(t *testing.T) {
+	c := NewConcurrentRingCache(4, 100, -1)
+	observer := &countingObserver{}
+	c.Observer = observer
+	c.ReadBufferSize = 1
+	c.Cloner = ClonerFunc(func(item interface{}) interface{} {
+		return append([]int{}, item.([]int)...)
+	})
+	c.CloneMode = CloneOnPut | CloneOnGet
+
+	key := userKey{"a", 1, [2]byte{}}
+	item := []int{1}
+	c.PutKey(key, item)
+	item[0] = 2
+
+	v, ok := c.GetKey(key)
+	if !ok || v.([]int)[0] != 1 {
+		t.Errorf("Expected a clone of the put item but found %v.", v)
+	}
+
+	loads := 0
+	loader := func(k interface{}) (interface{}, error) {
+		loads++
+		return nil, ErrKeyAbsent
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetOrLoadKey(userKey{"a", 2, [2]byte{}}, loader); err != ErrKeyAbsent {
+			t.Errorf("Expected ErrKeyAbsent but found %v.", err)
+		}
+	}
+
+	if loads != 1 || observer.keys != 4 {
+		t.Errorf("Expected 1 load and 4 observed keys but found %d and %d.", loads, observer.keys)
+	}
+
+	if v, ok := c.RemoveKey(key); !ok || v.([]int)[0] != 1 {
+		t.Errorf("Expected to remove the item but found %v.", v)
+	}
+
+	if n := testing.AllocsPerRun(100, func() { c.GetKey("k") }); n > 1 {
+		t.Errorf("Expected at most 1 allocation but found %v.", n)
+	}
+}
+
+func TestLIFOCacheKeys(t *testing.T) {
+	c := NewLIFOCache()
+
+	var evicted interface{}
+	c.PutKeyWithHandler(userId(3), "three", func(k interface{}, v interface{}) {
+		evicted = k
+	})
+
+	if v, _, ok := c.GetKey(userId(3)); !ok || v != "three" {
+		t.Errorf("Expected three but found %v.", v)
+	}
+
+	if _, _, ok := c.GetKey(3); ok {
+		t.Error("An int should not find a userId.")
+	}
+
+	if _, ok := c.RemoveKey(userId(3)); !ok || evicted != userId(3) {
+		t.Errorf("Expected userId 3 to be evicted but found %v.", evicted)
+	}
+}
+
+func TestKeyedCacheNaN(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NaN keys should panic.")
+		}
+	}()
+
+	NewKeyedCache(1, 10, -1).Put(math.NaN(), 1)
+}
+
+func BenchmarkKeyedCacheGet(b *testing.B) {
+	cache := NewKeyedCache(16, 1000, -1)
+	for i := 0; i < 1000; i++ {
+		cache.Put(userKey{"tenant", int64(i), [2]byte{}}, i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Get(userKey{"tenant", int64(i % 1000), [2]byte{}})
+	}
+}
+
+func BenchmarkSprintfKeyGet(b *testing.B) {
+	cache := NewConcurrentRingCache(16, 1000, -1)
+	for i := 0; i < 1000; i++ {
+		cache.Put(fmt.Sprintf("%s:%d:%v", "tenant", i, [2]byte{}), i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Get(fmt.Sprintf("%s:%d:%v", "tenant", i%1000, [2]byte{}))
+	}
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"testing"
+)
+
+// A cache operation and the calls to the eviction handler it should cause.
+type lifecycleCase struct {
+	name string
+
+	// Operate on a cache holding "a" with value 1 and tag "t", added at time 1.
+	lifo func(c *LIFOCache)
+	ring func(c *ConcurrentRingCache)
+
+	// The value passed to the handler of "a", or nil if it is not called.
+	handled interface{}
+	reason  EvictionReason
+
+	// What "a" holds afterwards, or nil if it is gone.
+	remaining interface{}
+}
+
+func TestEvictionHandlerLifecycle(t *testing.T) {
+	cases := []lifecycleCase{
+		{
+			name:      "put new key",
+			lifo:      func(c *LIFOCache) { c.Put("b", 2) },
+			ring:      func(c *ConcurrentRingCache) { c.Put("b", 2) },
+			remaining: 1,
+		},
+		{
+			name:      "replace",
+			lifo:      func(c *LIFOCache) { c.Put("a", 2) },
+			ring:      func(c *ConcurrentRingCache) { c.Put("a", 2) },
+			handled:   1,
+			reason:    EvictionReplaced,
+			remaining: 2,
+		},
+		{
+			name:    "remove",
+			lifo:    func(c *LIFOCache) { c.Remove("a") },
+			ring:    func(c *ConcurrentRingCache) { c.Remove("a") },
+			handled: 1,
+			reason:  EvictionRemoved,
+		},
+		{
+			name:      "remove missing key",
+			lifo:      func(c *LIFOCache) { c.Remove("b") },
+			ring:      func(c *ConcurrentRingCache) { c.Remove("b") },
+			remaining: 1,
+		},
+		{
+			name:    "clear",
+			lifo:    func(c *LIFOCache) { c.Clear() },
+			ring:    func(c *ConcurrentRingCache) { c.Clear() },
+			handled: 1,
+			reason:  EvictionCleared,
+		},
+		{
+			name:    "evict",
+			lifo:    func(c *LIFOCache) { c.EvictNext() },
+			ring:    func(c *ConcurrentRingCache) { c.EvictNext() },
+			handled: 1,
+			reason:  EvictionSize,
+		},
+		{
+			name:    "expire",
+			lifo:    func(c *LIFOCache) { c.EvictOlderThan(2) },
+			ring:    func(c *ConcurrentRingCache) { c.EvictOrderThan(2) },
+			handled: 1,
+			reason:  EvictionExpired,
+		},
+		{
+			name:    "invalidate tag",
+			lifo:    func(c *LIFOCache) { c.InvalidateTag("t") },
+			ring:    func(c *ConcurrentRingCache) { c.InvalidateTag("t") },
+			handled: 1,
+			reason:  EvictionInvalidated,
+		},
+	}
+
+	for _, tc := range cases {
+		var handled interface{}
+		var reason EvictionReason
+		handler := func(k string, v interface{}) {
+			if k == "a" {
+				handled = v
+			}
+		}
+		listener := func(e EvictionEvent) {
+			if e.Key == "a" {
+				reason = e.Reason
+			}
+		}
+
+		check := func(kind string, remaining interface{}) {
+			if handled != tc.handled {
+				t.Errorf("%s %s: handler got %v, expected %v.", kind, tc.name, handled, tc.handled)
+			}
+			if tc.handled != nil && reason != tc.reason {
+				t.Errorf("%s %s: reason was %s, expected %s.", kind, tc.name, reason, tc.reason)
+			}
+			if remaining != tc.remaining {
+				t.Errorf("%s %s: %v remains, expected %v.", kind, tc.name, remaining, tc.remaining)
+			}
+		}
+
+		lifo := NewLIFOCache()
+		lifo.TimeFunction = func() int64 { return 1 }
+		lifo.AddListener(listener)
+		lifo.PutWithHandler("a", 1, handler, "t")
+		tc.lifo(lifo)
+		remaining, _, _ := lifo.Get("a")
+		check("LIFOCache", remaining)
+
+		handled, reason = nil, 0
+		ring := NewConcurrentRingCache(3, 10, -1)
+		ring.SetTimeFunction(func() int64 { return 1 })
+		ring.AddListener(listener)
+		ring.PutWithHandler("a", 1, handler, "t")
+		tc.ring(ring)
+		remaining, _ = ring.Get("a")
+		check("ConcurrentRingCache", remaining)
+	}
+}
+
+func TestReplaceUsesNewHandler(t *testing.T) {
+	cache := NewLIFOCache()
+
+	calls := []string{}
+	cache.PutWithHandler("a", 1, func(string, interface{}) { calls = append(calls, "first") })
+	cache.PutWithHandler("a", 2, func(string, interface{}) { calls = append(calls, "second") })
+	cache.Remove("a")
+
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+		t.Errorf("Unexpected handler calls %v.", calls)
+	}
+}
@@ -2,7 +2,8 @@ package cache
 
 import (
 	"container/heap"
-	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
 )
 
 // A heap that expires the first added string first.
@@ -26,12 +27,11 @@ type LIFOCache struct {
 	// The map of strings to their indexes in the arrays.
 	Indexes map[string]int
 
-	// When a string is removed, the eviction handler is called and given the
-	// evicted string and associated data.
+	// When a string is evicted, removed, cleared or its data is replaced by
+	// a new Put, the eviction handler is called and given the string and the
+	// data that left the cache.
 	//
 	// This allows users of this class to have it drive eviction of other resources.
-	//
-	// The eviction handler is not called when a string is refreshed / re-added.
 	EvictionHandlers []func(s string, data interface{})
 
 	// A function that returns the "time" an element is added.
@@ -40,12 +40,35 @@ type LIFOCache struct {
 	// smallest int64 value is considered first.
 	//
 	// These integers need not be time, but it is convenient to think of them
-	// that way.
+	// that way. By default they are Unix seconds. ConcurrentRingCache sets
+	// its sub-caches to Unix nanoseconds, which its AgeLimit is compared to.
+	// See SetClock.
 	TimeFunction func() int64
 
+	// Gives the time of eviction events. See SetClock.
+	Clock clock.Clock
+
 	// If set to non-nil, cache stats will be collected.
 	// Stats are not collected by default.
 	Stats *CacheStats
+
+	// The tags attached to each key by Put.
+	KeyTags map[string][]string
+
+	// The set of keys that carry each tag.
+	TagIndex map[string]map[string]struct{}
+
+	// An index of every key, used to find keys by prefix. It is nil until
+	// the first InvalidatePrefix builds it, and kept up to date afterwards.
+	Prefixes *PrefixIndex
+
+	// Called, in order, whenever an item leaves the cache for any reason.
+	// See AddListener.
+	Listeners []EvictionListener
+
+	// Encodes the keys of PutKey, GetKey and RemoveKey. If nil, the
+	// DefaultKeyHasher is used.
+	KeyHasher KeyHasher
 }
 
 // Construct a new LIFOCache that uses the system clock in seconds
@@ -57,15 +80,35 @@ func NewLIFOCache() *LIFOCache {
 		Indexes:          make(map[string]int),
 		AddedTime:        []int64{},
 		EvictionHandlers: []func(string, interface{}){},
-		TimeFunction: func() int64 {
-			return time.Now().Unix()
-		},
-		Stats: nil,
+		TimeFunction:     unixSeconds(clock.Real{}),
+		Clock:            clock.Real{},
+		Stats:            nil,
+		KeyTags:          make(map[string][]string),
+		TagIndex:         make(map[string]map[string]struct{}),
 	}
 
 	return &h
 }
 
+// Order items by the Unix seconds of the given clock and use it
+// to time eviction events.
+func (c *LIFOCache) SetClock(clk clock.Clock) {
+	c.Clock = clk
+	c.TimeFunction = unixSeconds(clk)
+}
+
+func unixSeconds(clk clock.Clock) func() int64 {
+	return func() int64 {
+		return clk.Now().Unix()
+	}
+}
+
+func unixNanos(clk clock.Clock) func() int64 {
+	return func() int64 {
+		return clk.Now().UnixNano()
+	}
+}
+
 func (c *LIFOCache) Len() int {
 	return len(c.Items)
 }
@@ -107,6 +150,9 @@ func (c *LIFOCache) Push(x interface{}) {
 			c.Indexes[s] = len(c.Keys)
 			c.AddedTime = append(c.AddedTime, c.TimeFunction())
 			c.Keys = append(c.Keys, s)
+			if c.Prefixes != nil {
+				c.Prefixes.Add(s)
+			}
 
 			if len(c.AddedTime) != len(c.EvictionHandlers) {
 				panic("Use the Put function to add elements to this cache.")
@@ -139,6 +185,7 @@ func (c *LIFOCache) Pop() interface{} {
 
 	// Remove the key mapping.
 	delete(c.Indexes, k)
+	c.unindex(k)
 
 	e(k, i)
 
@@ -148,19 +195,40 @@ func (c *LIFOCache) Pop() interface{} {
 
 // Add a key to this cache with a given eviction function.
 //
-// If the key already exists, the object is updated, the AddedTime is updated
-// and a 2-tuple with the previous object and true is returned.
+// If the key already exists, the object and eviction handler are replaced,
+// the AddedTime is updated, the previous eviction handler is called with
+// the previous object and a 2-tuple with the previous object and true is returned.
 //
 // If the key does not already exist, the object is added under that key
 // and (nil, false) is returned.
-func (c *LIFOCache) PutWithHandler(key string, item interface{}, evictionhandler func(string, interface{})) (interface{}, bool) {
+//
+// Any tags given replace the tags previously attached to the key and
+// may later be used with InvalidateTag.
+func (c *LIFOCache) PutWithHandler(key string, item interface{}, evictionhandler func(string, interface{}), tags ...string) (interface{}, bool) {
+
+	if c.Stats != nil {
+		c.Stats.Put()
+	}
 
 	if _, ok := c.Indexes[key]; ok {
-		// Update the time and re-heap.
+		// Swap in the new data, update the time and re-heap.
 		i := c.Indexes[key]
 		o := c.Items[i]
+		oldHandler := c.EvictionHandlers[i]
+		oldTime := c.AddedTime[i]
+
+		c.Items[i] = item
+		c.EvictionHandlers[i] = evictionhandler
 		c.AddedTime[i] = c.TimeFunction()
 		heap.Fix(c, i)
+		c.setTags(key, tags)
+
+		if c.Stats != nil {
+			c.Stats.EvictFor(EvictionReplaced)
+		}
+
+		c.notify(key, o, oldTime, EvictionReplaced)
+		oldHandler(key, o)
 
 		return o, true
 	} else {
@@ -168,13 +236,14 @@ func (c *LIFOCache) PutWithHandler(key string, item interface{}, evictionhandler
 		c.EvictionHandlers = append(c.EvictionHandlers, evictionhandler)
 		c.Items = append(c.Items, item)
 		heap.Push(c, key)
+		c.setTags(key, tags)
 
 		return nil, false
 	}
 }
 
-func (c *LIFOCache) Put(key string, item interface{}) (interface{}, bool) {
-	return c.PutWithHandler(key, item, func(string, interface{}) {})
+func (c *LIFOCache) Put(key string, item interface{}, tags ...string) (interface{}, bool) {
+	return c.PutWithHandler(key, item, func(string, interface{}) {}, tags...)
 }
 
 // Get the user data and the time it was added.
@@ -185,6 +254,10 @@ func (c *LIFOCache) Put(key string, item interface{}) (interface{}, bool) {
 //         ...
 //     }
 func (c *LIFOCache) Get(key string) (interface{}, int64, bool) {
+	if c.Stats != nil {
+		c.Stats.Lookup(key)
+	}
+
 	if i, ok := c.Indexes[key]; ok {
 		if c.Stats != nil {
 			c.Stats.Hit()
@@ -200,17 +273,32 @@ func (c *LIFOCache) Get(key string) (interface{}, int64, bool) {
 	}
 }
 
+// Like Get, but the stats are not updated.
+func (c *LIFOCache) Peek(key string) (interface{}, int64, bool) {
+	if i, ok := c.Indexes[key]; ok {
+		return c.Items[i], c.AddedTime[i], true
+	}
+
+	return nil, 0, false
+}
+
 // Evict the next item, returning the key and value.
 //
 // If the cache is empty "" and nil are returned.
 func (c *LIFOCache) EvictNext() (string, interface{}) {
+	return c.evictNext(EvictionSize)
+}
+
+// Evict the next item, recording the reason in the stats.
+func (c *LIFOCache) evictNext(reason EvictionReason) (string, interface{}) {
 	if len(c.Keys) > 0 {
 
 		if c.Stats != nil {
-			c.Stats.Evict()
+			c.Stats.EvictFor(reason)
 		}
 
 		k := c.Keys[0]
+		c.notify(k, c.Items[0], c.AddedTime[0], reason)
 		i := heap.Pop(c)
 		return k, i
 	} else {
@@ -218,11 +306,18 @@ func (c *LIFOCache) EvictNext() (string, interface{}) {
 	}
 }
 
+// Evict every item, calling the eviction handlers.
+func (c *LIFOCache) Clear() {
+	for len(c.Keys) > 0 {
+		c.evictNext(EvictionCleared)
+	}
+}
+
 // Evict items that are older than the given tm.
 // That is the object's added time is less-than tm.
 func (c *LIFOCache) EvictOlderThan(tm int64) {
 	for len(c.AddedTime) > 0 && c.AddedTime[0] < tm {
-		c.EvictNext()
+		c.evictNext(EvictionExpired)
 	}
 }
 
@@ -234,10 +329,24 @@ func (c *LIFOCache) SetAddedTime(key string, tm int64) {
 	}
 }
 
-// Remove the given key from the cache.
+// Remove the given key from the cache, calling its eviction handler.
 func (c *LIFOCache) Remove(key string) (interface{}, bool) {
+	obj, handler, ok := c.remove(key, EvictionRemoved)
+
+	if ok {
+		handler(key, obj)
+	}
+
+	return obj, ok
+}
+
+// Remove a key and return its item and eviction handler.
+// The removal is recorded in the stats and sent to the listeners.
+func (c *LIFOCache) remove(key string, reason EvictionReason) (interface{}, func(string, interface{}), bool) {
 	if i, ok := c.Indexes[key]; ok {
 		obj := c.Items[i]
+		handler := c.EvictionHandlers[i]
+		added := c.AddedTime[i]
 
 		lasti := len(c.Items) - 1
 
@@ -251,14 +360,134 @@ func (c *LIFOCache) Remove(key string) (interface{}, bool) {
 		c.AddedTime = c.AddedTime[0:lasti]
 
 		delete(c.Indexes, key)
+		c.unindex(key)
 
-		// Fix i.
-		heap.Fix(c, i)
+		// Fix i, unless i was the last element.
+		if i < lasti {
+			heap.Fix(c, i)
+		}
+
+		if c.Stats != nil {
+			c.Stats.EvictFor(reason)
+		}
+
+		c.notify(key, obj, added, reason)
 
 		// Return it.
-		return obj, true
+		return obj, handler, true
 	} else {
-		return nil, false
+		return nil, nil, false
+	}
+}
+
+// Remove every key carrying the given tag, calling the eviction handlers.
+// The number of keys removed is returned.
+func (c *LIFOCache) InvalidateTag(tag string) int {
+	keys := make([]string, 0, len(c.TagIndex[tag]))
+	for k := range c.TagIndex[tag] {
+		keys = append(keys, k)
+	}
+
+	return c.invalidate(keys)
+}
+
+// Remove every key starting with prefix, calling the eviction handlers.
+// The number of keys removed is returned.
+//
+// The first call builds an index of every key, which Put then maintains.
+func (c *LIFOCache) InvalidatePrefix(prefix string) int {
+	if c.Prefixes == nil {
+		c.Prefixes = NewPrefixIndex()
+		for _, k := range c.Keys {
+			c.Prefixes.Add(k)
+		}
+	}
+
+	return c.invalidate(c.Prefixes.WithPrefix(prefix))
+}
+
+func (c *LIFOCache) invalidate(keys []string) int {
+	removed := 0
+	for _, k := range keys {
+		if item, handler, ok := c.remove(k, EvictionInvalidated); ok {
+			handler(k, item)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Add a listener that is told of every item leaving this cache.
+//
+// Listeners are called synchronously while the cache is being modified and
+// must not call back into it. Wrap a listener with NewAsyncListener to
+// handle events on another goroutine.
+func (c *LIFOCache) AddListener(l EvictionListener) {
+	c.Listeners = append(c.Listeners, l)
+}
+
+func (c *LIFOCache) notify(key string, item interface{}, added int64, reason EvictionReason) {
+	if len(c.Listeners) == 0 {
+		return
+	}
+
+	e := EvictionEvent{
+		Key:       key,
+		Item:      item,
+		Reason:    reason,
+		AddedTime: added,
+		Time:      c.Clock.Now(),
+	}
+
+	for _, l := range c.Listeners {
+		l(e)
+	}
+}
+
+// Return the tags attached to a key.
+func (c *LIFOCache) Tags(key string) []string {
+	return c.KeyTags[key]
+}
+
+// Replace the tags on a key.
+func (c *LIFOCache) setTags(key string, tags []string) {
+	c.untag(key)
+
+	if len(tags) == 0 {
+		return
+	}
+
+	c.KeyTags[key] = append([]string(nil), tags...)
+	for _, t := range tags {
+		keys, ok := c.TagIndex[t]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.TagIndex[t] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+// Remove the tags attached to a key.
+func (c *LIFOCache) untag(key string) {
+	for _, t := range c.KeyTags[key] {
+		if keys, ok := c.TagIndex[t]; ok {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(c.TagIndex, t)
+			}
+		}
+	}
+
+	delete(c.KeyTags, key)
+}
+
+// Remove a key from the tag and prefix indexes.
+func (c *LIFOCache) unindex(key string) {
+	c.untag(key)
+	if c.Prefixes != nil {
+		c.Prefixes.Remove(key)
 	}
 }
 
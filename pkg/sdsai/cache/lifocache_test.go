@@ -83,3 +83,78 @@ func TestLIFOCache(t *testing.T) {
 	})
 
 }
+
+func TestLIFOCacheInvalidate(t *testing.T) {
+	cache := NewLIFOCache()
+
+	evicted := map[string]bool{}
+	handler := func(k string, _ interface{}) {
+		evicted[k] = true
+	}
+
+	cache.PutWithHandler("user:1:name", "a", handler, "user:1")
+	cache.PutWithHandler("user:1:email", "b", handler, "user:1", "email")
+	cache.PutWithHandler("user:2:email", "c", handler, "user:2", "email")
+	cache.PutWithHandler("other", "d", handler)
+
+	if n := cache.InvalidateTag("user:1"); n != 2 {
+		t.Errorf("Expected 2 invalidated but found %d.", n)
+	}
+
+	if !evicted["user:1:name"] || !evicted["user:1:email"] || len(evicted) != 2 {
+		t.Errorf("Wrong eviction handlers called: %v", evicted)
+	}
+
+	if _, ok := cache.TagIndex["email"]["user:1:email"]; ok {
+		t.Error("Removed key is still indexed by tag.")
+	}
+
+	if n := cache.InvalidatePrefix("user:"); n != 1 {
+		t.Errorf("Expected 1 invalidated but found %d.", n)
+	}
+
+	if cache.Len() != 1 || cache.MinKey() != "other" {
+		t.Errorf("Only \"other\" should remain.")
+	}
+
+	if len(cache.TagIndex) != 0 || len(cache.KeyTags) != 0 {
+		t.Errorf("Tag indexes not cleaned up: %v %v", cache.TagIndex, cache.KeyTags)
+	}
+
+	// Re-putting a key replaces its tags.
+	cache.Put("other", "d", "x")
+	cache.Put("other", "d", "y")
+	if n := cache.InvalidateTag("x"); n != 0 {
+		t.Errorf("Expected 0 invalidated but found %d.", n)
+	}
+	if n := cache.InvalidateTag("y"); n != 1 {
+		t.Errorf("Expected 1 invalidated but found %d.", n)
+	}
+
+	// The caller's tags are copied.
+	tags := []string{"z"}
+	cache.Put("other", "d", tags...)
+	tags[0] = "changed"
+	if n := cache.InvalidateTag("z"); n != 1 || len(cache.TagIndex) != 0 {
+		t.Errorf("Expected 1 invalidated and no tags left but found %d and %v.", n, cache.TagIndex)
+	}
+}
+
+func TestLIFOCachePrefixIndex(t *testing.T) {
+	cache := NewLIFOCache()
+	cache.Put("a:1", 1)
+
+	if cache.Prefixes != nil {
+		t.Error("The prefix index should not be built before it is used.")
+	}
+
+	// Keys put before the first InvalidatePrefix are found, and so are
+	// those put after.
+	cache.InvalidatePrefix("none:")
+	cache.Put("a:2", 2)
+	cache.Put("b:1", 3)
+
+	if n := cache.InvalidatePrefix("a:"); n != 2 || cache.Prefixes.Len() != 1 {
+		t.Errorf("Expected 2 invalidated and 1 indexed but found %d and %d.", n, cache.Prefixes.Len())
+	}
+}
@@ -0,0 +1,131 @@
+package cache
+
+// A trie of strings that allows all strings sharing a prefix to be
+// found without scanning every string.
+//
+// This is used by the caches to support invalidation by key prefix.
+type PrefixIndex struct {
+	root *prefixNode
+	size int
+}
+
+type prefixNode struct {
+	children map[byte]*prefixNode
+
+	// True if a string ends at this node.
+	terminal bool
+
+	// How many strings end at or below this node.
+	count int
+}
+
+func NewPrefixIndex() *PrefixIndex {
+	return &PrefixIndex{root: &prefixNode{}}
+}
+
+// The number of strings in the index.
+func (p *PrefixIndex) Len() int {
+	return p.size
+}
+
+// Add a string to the index. Adding a string that is already present
+// does nothing.
+func (p *PrefixIndex) Add(s string) {
+	if p.Contains(s) {
+		return
+	}
+
+	n := p.root
+	n.count++
+	for i := 0; i < len(s); i++ {
+		if n.children == nil {
+			n.children = make(map[byte]*prefixNode)
+		}
+
+		child, ok := n.children[s[i]]
+		if !ok {
+			child = &prefixNode{}
+			n.children[s[i]] = child
+		}
+
+		child.count++
+		n = child
+	}
+
+	n.terminal = true
+	p.size++
+}
+
+// Return true if the exact string s is in the index.
+func (p *PrefixIndex) Contains(s string) bool {
+	n := p.find(s)
+	return n != nil && n.terminal
+}
+
+// Remove a string from the index. Returns false if it was not present.
+func (p *PrefixIndex) Remove(s string) bool {
+	if !p.Contains(s) {
+		return false
+	}
+
+	n := p.root
+	n.count--
+	for i := 0; i < len(s); i++ {
+		child := n.children[s[i]]
+		child.count--
+
+		// Prune the branch once nothing is left under it.
+		if child.count == 0 {
+			delete(n.children, s[i])
+			p.size--
+			return true
+		}
+
+		n = child
+	}
+
+	n.terminal = false
+	p.size--
+	return true
+}
+
+// Return every string in the index that starts with prefix.
+func (p *PrefixIndex) WithPrefix(prefix string) []string {
+	n := p.find(prefix)
+	if n == nil {
+		return []string{}
+	}
+
+	found := make([]string, 0, n.count)
+	buf := []byte(prefix)
+
+	var walk func(n *prefixNode)
+	walk = func(n *prefixNode) {
+		if n.terminal {
+			found = append(found, string(buf))
+		}
+
+		for b, child := range n.children {
+			buf = append(buf, b)
+			walk(child)
+			buf = buf[:len(buf)-1]
+		}
+	}
+
+	walk(n)
+
+	return found
+}
+
+func (p *PrefixIndex) find(s string) *prefixNode {
+	n := p.root
+	for i := 0; i < len(s); i++ {
+		child, ok := n.children[s[i]]
+		if !ok {
+			return nil
+		}
+		n = child
+	}
+
+	return n
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestPrefixIndex(t *testing.T) {
+	p := NewPrefixIndex()
+
+	for _, s := range []string{"user:1:name", "user:1:email", "user:12:name", "user:2:name", ""} {
+		p.Add(s)
+	}
+	p.Add("user:1:name")
+
+	if p.Len() != 5 {
+		t.Errorf("Expected 5 strings but found %d.", p.Len())
+	}
+
+	found := p.WithPrefix("user:1")
+	sort.Strings(found)
+	if len(found) != 3 || found[0] != "user:12:name" || found[2] != "user:1:name" {
+		t.Errorf("Unexpected prefix match: %v", found)
+	}
+
+	if !p.Remove("user:1:email") {
+		t.Error("Remove should succeed.")
+	}
+	if p.Remove("user:1:email") {
+		t.Error("Second remove should fail.")
+	}
+	if p.Remove("user:") {
+		t.Error("A prefix that was never added should not be removed.")
+	}
+
+	if found = p.WithPrefix("user:1:"); len(found) != 1 || found[0] != "user:1:name" {
+		t.Errorf("Unexpected prefix match: %v", found)
+	}
+
+	if found = p.WithPrefix("nope"); len(found) != 0 {
+		t.Errorf("Unexpected prefix match: %v", found)
+	}
+
+	if !p.Contains("") || len(p.WithPrefix("")) != 4 {
+		t.Errorf("Empty string handling is wrong: %v", p.WithPrefix(""))
+	}
+}
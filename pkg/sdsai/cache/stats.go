@@ -1,32 +1,305 @@
 package cache
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+	"time"
+)
 
+// Why an item left a cache.
+type EvictionReason int
+
+const (
+	// Evicted to keep the cache within its size limit, or by EvictNext.
+	EvictionSize EvictionReason = iota
+
+	// The item was older than the age limit.
+	EvictionExpired
+
+	// The item was removed by a call to Remove.
+	EvictionRemoved
+
+	// The item was replaced by a Put of the same key.
+	EvictionReplaced
+
+	// The whole cache was cleared.
+	EvictionCleared
+
+	// The item was removed by InvalidateTag or InvalidatePrefix.
+	EvictionInvalidated
+
+	// The number of eviction reasons.
+	NumEvictionReasons
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionSize:
+		return "size"
+	case EvictionExpired:
+		return "expired"
+	case EvictionRemoved:
+		return "removed"
+	case EvictionReplaced:
+		return "replaced"
+	case EvictionCleared:
+		return "cleared"
+	case EvictionInvalidated:
+		return "invalidated"
+	default:
+		return "unknown"
+	}
+}
+
+// The number of buckets in a LatencyHistogram.
+const LatencyBuckets = 28
+
+// A histogram of durations with exponentially growing buckets.
+//
+// Bucket i counts durations up to 2^i microseconds. The last bucket counts
+// everything larger. All counters are updated atomically.
+type LatencyHistogram struct {
+	counts [LatencyBuckets]int64
+	sum    int64
+}
+
+// Record a duration.
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	i := 0
+	for i < LatencyBuckets-1 && d > LatencyBucketBound(i) {
+		i++
+	}
+
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *LatencyHistogram) Reset() {
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+	}
+	atomic.StoreInt64(&h.sum, 0)
+}
+
+func (h *LatencyHistogram) Snapshot() LatencySnapshot {
+	s := LatencySnapshot{}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadInt64(&h.counts[i])
+		s.Count += s.Counts[i]
+	}
+	s.Sum = time.Duration(atomic.LoadInt64(&h.sum))
+
+	return s
+}
+
+// The largest duration counted in bucket i.
+func LatencyBucketBound(i int) time.Duration {
+	return time.Microsecond << uint(i)
+}
+
+// A point-in-time copy of a LatencyHistogram.
+type LatencySnapshot struct {
+	Counts [LatencyBuckets]int64
+	Count  int64
+	Sum    time.Duration
+}
+
+// The mean duration, or 0 if nothing was recorded.
+func (s LatencySnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+
+	return s.Sum / time.Duration(s.Count)
+}
+
+// An upper bound on the q-th quantile, where q is in [0, 1].
+func (s LatencySnapshot) Quantile(q float64) time.Duration {
+	target := int64(q * float64(s.Count))
+
+	var seen int64
+	for i, c := range s.Counts {
+		seen += c
+		if c > 0 && seen >= target {
+			return LatencyBucketBound(i)
+		}
+	}
+
+	return 0
+}
+
+func (s *LatencySnapshot) Add(o LatencySnapshot) {
+	for i := range s.Counts {
+		s.Counts[i] += o.Counts[i]
+	}
+	s.Count += o.Count
+	s.Sum += o.Sum
+}
+
+// Counters describing how a cache is used. All counters are updated atomically.
 type CacheStats struct {
-	hit   int32
-	miss  int32
-	evict int32
+	hit         int64
+	negativeHit int64
+	miss        int64
+	put         int64
+	loadSuccess int64
+	loadFailure int64
+	evict       [NumEvictionReasons]int64
+
+	// How long loads take, successful or not.
+	LoadLatency LatencyHistogram
+
+	// If set, every key looked up with Get is given to this observer, such
+	// as a sketch.HyperLogLog counting distinct keys. Reset leaves it alone.
+	Lookups KeyObserver
 }
 
 func (c *CacheStats) Hit() {
-	atomic.AddInt32(&c.hit, 1)
+	atomic.AddInt64(&c.hit, 1)
+}
+
+// Record a hit on a key cached as missing. It should also be counted by Hit.
+func (c *CacheStats) NegativeHit() {
+	atomic.AddInt64(&c.negativeHit, 1)
 }
 
 func (c *CacheStats) Miss() {
-	atomic.AddInt32(&c.miss, 1)
+	atomic.AddInt64(&c.miss, 1)
+}
+
+// Give a looked up key to the Lookups observer, if there is one.
+func (c *CacheStats) Lookup(key string) {
+	if c.Lookups != nil {
+		c.Lookups.Observe(key)
+	}
 }
 
+func (c *CacheStats) Put() {
+	atomic.AddInt64(&c.put, 1)
+}
+
+// Record an eviction to enforce the size limit.
 func (c *CacheStats) Evict() {
-	atomic.AddInt32(&c.evict, 1)
+	c.EvictFor(EvictionSize)
+}
+
+// Record an item leaving the cache for the given reason.
+func (c *CacheStats) EvictFor(reason EvictionReason) {
+	atomic.AddInt64(&c.evict[reason], 1)
+}
+
+// Record a successful load and how long it took.
+func (c *CacheStats) LoadSuccess(d time.Duration) {
+	atomic.AddInt64(&c.loadSuccess, 1)
+	c.LoadLatency.Observe(d)
+}
+
+// Record a failed load and how long it took.
+func (c *CacheStats) LoadFailure(d time.Duration) {
+	atomic.AddInt64(&c.loadFailure, 1)
+	c.LoadLatency.Observe(d)
 }
 
 func (c *CacheStats) Reset() {
-	atomic.StoreInt32(&c.hit, 0)
-	atomic.StoreInt32(&c.miss, 0)
-	atomic.StoreInt32(&c.evict, 0)
+	atomic.StoreInt64(&c.hit, 0)
+	atomic.StoreInt64(&c.negativeHit, 0)
+	atomic.StoreInt64(&c.miss, 0)
+	atomic.StoreInt64(&c.put, 0)
+	atomic.StoreInt64(&c.loadSuccess, 0)
+	atomic.StoreInt64(&c.loadFailure, 0)
+	for i := range c.evict {
+		atomic.StoreInt64(&c.evict[i], 0)
+	}
+	c.LoadLatency.Reset()
 }
 
 // Return (hit, miss, evict) counts.
-func (c *CacheStats) GetStats() (int32, int32, int32) {
-	return c.hit, c.miss, c.evict
+//
+// The counts were int32 before eviction reasons were kept; they are now
+// int64 so long running caches do not overflow. As before, the evict count
+// is only of items evicted to enforce the size limit. Snapshot has the
+// counts for every reason and CacheStatsSnapshot.Evicted their total.
+func (c *CacheStats) GetStats() (int64, int64, int64) {
+	s := c.Snapshot()
+	return s.Hits, s.Misses, s.Evictions[EvictionSize]
+}
+
+// Return a copy of every counter.
+func (c *CacheStats) Snapshot() CacheStatsSnapshot {
+	s := CacheStatsSnapshot{
+		Hits:          atomic.LoadInt64(&c.hit),
+		NegativeHits:  atomic.LoadInt64(&c.negativeHit),
+		Misses:        atomic.LoadInt64(&c.miss),
+		Puts:          atomic.LoadInt64(&c.put),
+		LoadSuccesses: atomic.LoadInt64(&c.loadSuccess),
+		LoadFailures:  atomic.LoadInt64(&c.loadFailure),
+		LoadLatency:   c.LoadLatency.Snapshot(),
+	}
+
+	for i := range c.evict {
+		s.Evictions[i] = atomic.LoadInt64(&c.evict[i])
+	}
+
+	return s
+}
+
+// A point-in-time copy of a CacheStats. Snapshots may be added together.
+type CacheStatsSnapshot struct {
+	Hits int64
+
+	// Hits on keys cached as missing. These are included in Hits.
+	NegativeHits int64
+
+	Misses        int64
+	Puts          int64
+	LoadSuccesses int64
+	LoadFailures  int64
+
+	// Counts indexed by EvictionReason.
+	Evictions [NumEvictionReasons]int64
+
+	LoadLatency LatencySnapshot
+}
+
+// Add the counts in o to s.
+func (s *CacheStatsSnapshot) Add(o CacheStatsSnapshot) {
+	s.Hits += o.Hits
+	s.NegativeHits += o.NegativeHits
+	s.Misses += o.Misses
+	s.Puts += o.Puts
+	s.LoadSuccesses += o.LoadSuccesses
+	s.LoadFailures += o.LoadFailures
+	for i := range s.Evictions {
+		s.Evictions[i] += o.Evictions[i]
+	}
+	s.LoadLatency.Add(o.LoadLatency)
+}
+
+// The fraction of lookups that were hits, or 0 if there were no lookups.
+func (s CacheStatsSnapshot) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Items removed by calls to Remove.
+func (s CacheStatsSnapshot) Removals() int64 {
+	return s.Evictions[EvictionRemoved]
+}
+
+// Items that were dropped for being too old.
+func (s CacheStatsSnapshot) Expirations() int64 {
+	return s.Evictions[EvictionExpired]
+}
+
+// Items that left the cache for any reason, the sum of Evictions.
+// Use Evictions to tell size limits from removals, replacements and the rest.
+func (s CacheStatsSnapshot) Evicted() int64 {
+	n := int64(0)
+	for _, e := range s.Evictions {
+		n += e
+	}
+
+	return n
 }
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := LatencyHistogram{}
+
+	h.Observe(500 * time.Nanosecond)
+	h.Observe(3 * time.Microsecond)
+	h.Observe(3 * time.Microsecond)
+	h.Observe(time.Hour)
+
+	s := h.Snapshot()
+	if s.Count != 4 || s.Counts[0] != 1 || s.Counts[2] != 2 || s.Counts[LatencyBuckets-1] != 1 {
+		t.Errorf("Unexpected counts %v.", s.Counts)
+	}
+
+	if q := s.Quantile(0.5); q != 4*time.Microsecond {
+		t.Errorf("Expected median bound of 4us but found %s.", q)
+	}
+
+	h.Reset()
+	if h.Snapshot().Count != 0 || h.Snapshot().Mean() != 0 {
+		t.Error("Reset did not clear the histogram.")
+	}
+}
+
+func TestConcurrentRingCacheStats(t *testing.T) {
+	cache := NewConcurrentRingCache(4, 100, -1)
+	cache.EnableStats()
+
+	for i := 0; i < 10; i++ {
+		cache.Put(fmt.Sprintf("key %d", i), i, "tag")
+	}
+
+	cache.Get("key 1")
+	cache.Get("key 2")
+	cache.Get("nope")
+	cache.Remove("key 3")
+	cache.InvalidatePrefix("key 4")
+
+	loaded, err := cache.GetOrLoad("new", func(string) (interface{}, error) {
+		return "new", nil
+	})
+	if err != nil || loaded != "new" {
+		t.Errorf("Unexpected load %v %v.", loaded, err)
+	}
+
+	if _, err := cache.GetOrLoad("fail", func(string) (interface{}, error) {
+		return nil, errors.New("fail")
+	}); err == nil {
+		t.Error("Load error should be returned.")
+	}
+
+	cache.Clear()
+
+	s := cache.MergedStats()
+
+	if s.Hits != 2 || s.Misses != 3 || s.Puts != 11 {
+		t.Errorf("Unexpected hits, misses and puts: %d %d %d.", s.Hits, s.Misses, s.Puts)
+	}
+
+	if s.Removals() != 1 || s.Evictions[EvictionInvalidated] != 1 || s.Evictions[EvictionCleared] != 9 {
+		t.Errorf("Unexpected evictions: %v.", s.Evictions)
+	}
+
+	// Every reason is counted, as it is in the exported metrics.
+	if s.Evicted() != 11 {
+		t.Errorf("Expected 11 evicted but found %d.", s.Evicted())
+	}
+
+	// GetStats counts only evictions for size.
+	if _, _, evict := cache.GetStats()[0].GetStats(); evict != 0 {
+		t.Errorf("Expected 0 size evictions but found %d.", evict)
+	}
+
+	if s.LoadSuccesses != 1 || s.LoadFailures != 1 || s.LoadLatency.Count != 2 {
+		t.Errorf("Unexpected load stats %d %d %d.", s.LoadSuccesses, s.LoadFailures, s.LoadLatency.Count)
+	}
+
+	if r := s.HitRatio(); r != 0.4 {
+		t.Errorf("Expected hit ratio 0.4 but found %f.", r)
+	}
+
+	cache.ResetStats()
+	if hit, miss, evict := cache.GetStats()[0].GetStats(); hit != 0 || miss != 0 || evict != 0 {
+		t.Error("Stats were not reset.")
+	}
+}
@@ -0,0 +1,262 @@
+package cachesim
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+)
+
+// Trace formats understood by ReadTrace.
+const (
+	// One key per line. Only the first whitespace separated field is used.
+	// Blank lines and lines starting with # are skipped.
+	SimpleFormat = "simple"
+
+	// ARC traces. Each line is "start count ignored request" and stands for
+	// count accesses to the blocks start, start+1, ... start+count-1.
+	ARCFormat = "arc"
+
+	// LIRS traces. One block number per line. Lines that are not numbers,
+	// such as the "*" separators some traces use, are skipped.
+	LIRSFormat = "lirs"
+)
+
+// How a cache treats an access.
+type Policy struct {
+	Name string
+
+	// If true a hit refreshes the item's added time, giving LRU eviction.
+	// Otherwise items are evicted in the order they were added, FIFO.
+	RefreshOnHit bool
+}
+
+var (
+	FIFO = Policy{Name: "fifo", RefreshOnHit: false}
+	LRU  = Policy{Name: "lru", RefreshOnHit: true}
+)
+
+// Every policy the cache package can express.
+var Policies = []Policy{FIFO, LRU}
+
+// The outcome of replaying a trace against one cache configuration.
+type Result struct {
+	Policy   string
+	Capacity int
+	Shards   int
+	Accesses int64
+	Hits     int64
+}
+
+func (r Result) HitRatio() float64 {
+	if r.Accesses == 0 {
+		return 0
+	}
+
+	return float64(r.Hits) / float64(r.Accesses)
+}
+
+// Read a trace, giving each key to f in order. Keys are given as they are
+// read, so a trace need not fit in memory.
+func ReadTrace(r io.Reader, format string, f func(key string)) error {
+	if format != SimpleFormat && format != LIRSFormat && format != ARCFormat {
+		return errors.New("Unknown trace format " + format)
+	}
+
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch format {
+		case SimpleFormat:
+			f(fields[0])
+		case LIRSFormat:
+			if _, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+				f(fields[0])
+			}
+		case ARCFormat:
+			if len(fields) < 2 {
+				return fmt.Errorf("Line %d: ARC lines need a start and count.", line)
+			}
+
+			start, err1 := strconv.ParseInt(fields[0], 10, 64)
+			count, err2 := strconv.ParseInt(fields[1], 10, 64)
+			if err1 != nil || err2 != nil || count < 0 {
+				return fmt.Errorf("Line %d: bad ARC start or count.", line)
+			}
+
+			for i := int64(0); i < count; i++ {
+				f(strconv.FormatInt(start+i, 10))
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Replays accesses, one at a time, against a ConcurrentRingCache.
+//
+// The capacity is split between the shards as evenly as possible, so the
+// shard sizes add up to it. Every miss adds the key. A single shard is a
+// plain LIFOCache.
+type Simulator struct {
+	policy Policy
+	cache  *cache.ConcurrentRingCache
+
+	// The number of items each shard may hold.
+	limits []int
+
+	clock  int64
+	result Result
+}
+
+// Create a simulator of a cache holding capacity items in the given
+// number of shards.
+func NewSimulator(policy Policy, capacity int, shards int) *Simulator {
+	s := &Simulator{
+		policy: policy,
+		cache:  cache.NewConcurrentRingCache(shards, capacity, -1),
+		limits: make([]int, shards),
+		result: Result{
+			Policy:   policy.Name,
+			Capacity: capacity,
+			Shards:   shards,
+		},
+	}
+
+	for i := range s.limits {
+		s.limits[i] = capacity / shards
+		if i < capacity%shards {
+			s.limits[i]++
+		}
+	}
+
+	s.cache.SetTimeFunction(func() int64 {
+		return s.clock
+	})
+
+	return s
+}
+
+// Look up a key, adding it if it is missing.
+func (s *Simulator) Access(key string) {
+	s.clock++
+	s.result.Accesses++
+
+	// The simulation is single threaded so shards are used without locking.
+	i := s.cache.KeyHash(key, s.result.Shards)
+	shard := s.cache.Caches[i]
+
+	if _, _, ok := shard.Get(key); ok {
+		s.result.Hits++
+		if s.policy.RefreshOnHit {
+			shard.SetAddedTime(key, s.clock)
+		}
+		return
+	}
+
+	shard.Put(key, nil)
+	for shard.Len() > s.limits[i] {
+		shard.EvictNext()
+	}
+}
+
+// The outcome of the accesses so far.
+func (s *Simulator) Result() Result {
+	return s.result
+}
+
+// Replay a trace against one cache configuration. See Simulator.
+func Simulate(trace []string, policy Policy, capacity int, shards int) Result {
+	s := NewSimulator(policy, capacity, shards)
+
+	for _, key := range trace {
+		s.Access(key)
+	}
+
+	return s.Result()
+}
+
+// Simulate every combination of policy, capacity and shard count.
+func SimulateAll(trace []string, policies []Policy, capacities []int, shards []int) []Result {
+	sims := newSimulators(policies, capacities, shards)
+
+	for _, key := range trace {
+		for _, s := range sims {
+			s.Access(key)
+		}
+	}
+
+	return resultsOf(sims)
+}
+
+// Like SimulateAll, but read the trace from r as it is replayed, so it is
+// read once and never held in memory.
+func SimulateTrace(r io.Reader, format string, policies []Policy, capacities []int, shards []int) ([]Result, error) {
+	sims := newSimulators(policies, capacities, shards)
+
+	err := ReadTrace(r, format, func(key string) {
+		for _, s := range sims {
+			s.Access(key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resultsOf(sims), nil
+}
+
+// A simulator for every combination, in the order SimulateAll reports them.
+func newSimulators(policies []Policy, capacities []int, shards []int) []*Simulator {
+	sims := []*Simulator{}
+
+	for _, p := range policies {
+		for _, s := range shards {
+			for _, c := range capacities {
+				sims = append(sims, NewSimulator(p, c, s))
+			}
+		}
+	}
+
+	return sims
+}
+
+// The result of each simulator.
+func resultsOf(sims []*Simulator) []Result {
+	results := make([]Result, len(sims))
+	for i, s := range sims {
+		results[i] = s.Result()
+	}
+
+	return results
+}
+
+// Write results as CSV with a header row.
+func WriteCSV(w io.Writer, results []Result) error {
+	cw := csv.NewWriter(w)
+
+	cw.Write([]string{"policy", "shards", "capacity", "accesses", "hits", "hit_ratio"})
+	for _, r := range results {
+		cw.Write([]string{
+			r.Policy,
+			strconv.Itoa(r.Shards),
+			strconv.Itoa(r.Capacity),
+			strconv.FormatInt(r.Accesses, 10),
+			strconv.FormatInt(r.Hits, 10),
+			strconv.FormatFloat(r.HitRatio(), 'f', 6, 64),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,111 @@
+package cachesim
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Read every key of a trace.
+func readAll(r io.Reader, format string) ([]string, error) {
+	trace := []string{}
+	err := ReadTrace(r, format, func(key string) {
+		trace = append(trace, key)
+	})
+
+	return trace, err
+}
+
+func TestReadTrace(t *testing.T) {
+	trace, err := readAll(strings.NewReader("# comment\na\n\nb extra\na\n"), SimpleFormat)
+	if err != nil || strings.Join(trace, ",") != "a,b,a" {
+		t.Errorf("Unexpected simple trace %v %v.", trace, err)
+	}
+
+	trace, err = readAll(strings.NewReader("10 3 0 1\n5 1 0 2\n"), ARCFormat)
+	if err != nil || strings.Join(trace, ",") != "10,11,12,5" {
+		t.Errorf("Unexpected ARC trace %v %v.", trace, err)
+	}
+
+	trace, err = readAll(strings.NewReader("1\n*\n2\n"), LIRSFormat)
+	if err != nil || strings.Join(trace, ",") != "1,2" {
+		t.Errorf("Unexpected LIRS trace %v %v.", trace, err)
+	}
+
+	if _, err := readAll(strings.NewReader("x\n"), "nope"); err == nil {
+		t.Error("Unknown formats should fail.")
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	// "a" is hot. LRU keeps it, FIFO evicts it every 3 new keys.
+	trace := strings.Split("a b a c a d a e a f a g", " ")
+
+	fifo := Simulate(trace, FIFO, 2, 1)
+	lru := Simulate(trace, LRU, 2, 1)
+
+	if fifo.Accesses != 12 || lru.Accesses != 12 {
+		t.Errorf("Expected 12 accesses.")
+	}
+
+	if lru.Hits != 5 {
+		t.Errorf("Expected 5 LRU hits but found %d.", lru.Hits)
+	}
+
+	if fifo.Hits >= lru.Hits {
+		t.Errorf("FIFO should do worse than LRU: %d >= %d.", fifo.Hits, lru.Hits)
+	}
+
+	results := SimulateAll(trace, Policies, []int{1, 4}, []int{1, 2})
+	if len(results) != 8 {
+		t.Errorf("Expected 8 results but found %d.", len(results))
+	}
+
+	buf := bytes.Buffer{}
+	if err := WriteCSV(&buf, results[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "policy,shards,capacity,accesses,hits,hit_ratio\nfifo,1,1,12,0,0.000000\n" {
+		t.Errorf("Unexpected CSV %q.", buf.String())
+	}
+}
+
+func TestSimulateTrace(t *testing.T) {
+	text := "a\nb\na\nc\na\nd\na\ne\n"
+	trace, _ := readAll(strings.NewReader(text), SimpleFormat)
+
+	streamed, err := SimulateTrace(strings.NewReader(text), SimpleFormat, Policies, []int{1, 2, 4}, []int{1, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if all := SimulateAll(trace, Policies, []int{1, 2, 4}, []int{1, 3}); !reflect.DeepEqual(streamed, all) {
+		t.Errorf("Expected %v but found %v.", all, streamed)
+	}
+
+	if _, err := SimulateTrace(strings.NewReader(text), "nope", Policies, []int{1}, []int{1}); err == nil {
+		t.Error("Unknown formats should fail.")
+	}
+}
+
+func TestSimulatorShardSizes(t *testing.T) {
+	s := NewSimulator(LRU, 10, 4)
+
+	if !reflect.DeepEqual(s.limits, []int{3, 3, 2, 2}) {
+		t.Errorf("Expected shard sizes [3 3 2 2] but found %v.", s.limits)
+	}
+
+	// Fewer items than shards leaves some shards empty.
+	s = NewSimulator(LRU, 2, 4)
+	for i := 0; i < 100; i++ {
+		s.Access(strconv.Itoa(i))
+	}
+
+	if n := s.cache.Size(); n > 2 {
+		t.Errorf("Expected at most 2 items but found %d.", n)
+	}
+}
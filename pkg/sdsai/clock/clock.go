@@ -0,0 +1,180 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A source of the current time and of timers.
+//
+// Caches, pools and semaphores take a Clock so that tests may replace the
+// system clock with a Fake that only moves when told to.
+type Clock interface {
+	// The current time.
+	Now() time.Time
+
+	// A channel that receives the current time once d has passed.
+	// The timer behind it cannot be stopped; prefer AfterFunc for timeouts
+	// that are usually cancelled.
+	After(d time.Duration) <-chan time.Time
+
+	// Call f in its own goroutine once d has passed, unless the returned
+	// Timer is stopped first.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A pending call from AfterFunc.
+type Timer interface {
+	// Prevent the call. Return false if it has already been made or the
+	// timer was already stopped.
+	Stop() bool
+}
+
+// The system clock.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (Real) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// A clock that only moves when Advance or Set is called.
+type Fake struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// A pending call to After or AfterFunc.
+type fakeTimer struct {
+	fake *Fake
+	at   time.Time
+
+	// One of these is set.
+	c chan time.Time
+	f func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.fake.lock.Lock()
+	defer t.fake.lock.Unlock()
+
+	for i, timer := range t.fake.timers {
+		if timer == t {
+			t.fake.timers = append(t.fake.timers[:i], t.fake.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Create a fake clock that reads the given time until it is moved.
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.now
+}
+
+// Return a channel that receives the time once the clock is moved d forward.
+// If d is not positive, the channel receives the current time immediately.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	c := make(chan time.Time, 1)
+
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+
+	f.timers = append(f.timers, &fakeTimer{fake: f, at: f.now.Add(d), c: c})
+
+	return c
+}
+
+// Call f in its own goroutine once the clock is moved d forward. If d is
+// not positive, f is called immediately.
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	t := &fakeTimer{fake: f, at: f.now.Add(d), f: fn}
+
+	if d <= 0 {
+		go fn()
+		return t
+	}
+
+	f.timers = append(f.timers, t)
+
+	return t
+}
+
+// Move the clock forward by d, firing any timers that come due.
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.set(f.now.Add(d))
+}
+
+// Move the clock to t, firing any timers that come due.
+// Moving the clock backwards fires nothing.
+func (f *Fake) Set(t time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.set(t)
+}
+
+// The number of timers from After and AfterFunc that have neither fired
+// nor been stopped.
+//
+// Tests may poll this to know that a goroutine is waiting on the clock
+// before advancing it.
+func (f *Fake) Timers() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.timers)
+}
+
+// The caller must hold f.lock.
+func (f *Fake) set(t time.Time) {
+	f.now = t
+
+	// Fire timers in the order they come due.
+	sort.SliceStable(f.timers, func(i, j int) bool {
+		return f.timers[i].at.Before(f.timers[j].at)
+	})
+
+	fired := 0
+	for _, timer := range f.timers {
+		if timer.at.After(t) {
+			break
+		}
+		if timer.f != nil {
+			go timer.f()
+		} else {
+			timer.c <- t
+		}
+		fired++
+	}
+
+	f.timers = f.timers[fired:]
+}
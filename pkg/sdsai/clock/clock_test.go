@@ -0,0 +1,101 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := NewFake(start)
+
+	if !f.Now().Equal(start) {
+		t.Errorf("Expected %s but found %s.", start, f.Now())
+	}
+
+	a := f.After(time.Second)
+	b := f.After(3 * time.Second)
+
+	if f.Timers() != 2 {
+		t.Errorf("Expected 2 but found %d.", f.Timers())
+	}
+
+	f.Advance(2 * time.Second)
+
+	select {
+	case now := <-a:
+		if !now.Equal(start.Add(2 * time.Second)) {
+			t.Errorf("Timer fired with %s.", now)
+		}
+	default:
+		t.Error("Timer should have fired.")
+	}
+
+	select {
+	case <-b:
+		t.Error("Timer should not have fired.")
+	default:
+	}
+
+	f.Set(start.Add(time.Minute))
+
+	select {
+	case <-b:
+	default:
+		t.Error("Timer should have fired.")
+	}
+
+	if f.Timers() != 0 {
+		t.Errorf("Expected 0 but found %d.", f.Timers())
+	}
+
+	select {
+	case <-f.After(0):
+	default:
+		t.Error("A zero duration should fire immediately.")
+	}
+}
+
+func TestFakeAfterFunc(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+
+	called := make(chan int, 2)
+	a := f.AfterFunc(time.Second, func() { called <- 1 })
+	f.AfterFunc(2*time.Second, func() { called <- 2 })
+
+	if !a.Stop() || a.Stop() {
+		t.Error("Expected only the first Stop to succeed.")
+	}
+
+	if f.Timers() != 1 {
+		t.Errorf("Expected 1 but found %d.", f.Timers())
+	}
+
+	f.Advance(2 * time.Second)
+
+	if n := <-called; n != 2 {
+		t.Errorf("Expected 2 but found %d.", n)
+	}
+
+	if f.Timers() != 0 {
+		t.Errorf("Expected 0 but found %d.", f.Timers())
+	}
+}
+
+func TestReal(t *testing.T) {
+	var c Clock = Real{}
+
+	if d := time.Since(c.Now()); d < 0 || d > time.Second {
+		t.Errorf("Real clock is off by %s.", d)
+	}
+
+	<-c.After(time.Millisecond)
+
+	called := make(chan struct{})
+	c.AfterFunc(time.Millisecond, func() { close(called) })
+	<-called
+
+	if c.AfterFunc(time.Hour, func() {}).Stop() != true {
+		t.Error("Expected the timer to stop.")
+	}
+}
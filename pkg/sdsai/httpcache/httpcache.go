@@ -0,0 +1,548 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
+)
+
+// The response header that says how a request was answered.
+const StatusHeader = "X-Cache"
+
+// Values of the StatusHeader.
+const (
+	// Answered from a fresh cached response.
+	Hit = "HIT"
+
+	// Answered from a stale cached response while it is refreshed in the background.
+	Stale = "STALE"
+
+	// Answered from a cached response after the next handler confirmed it is unchanged.
+	Revalidated = "REVALIDATED"
+
+	// Answered by the next handler.
+	Miss = "MISS"
+)
+
+// An http.Handler that caches the GET responses of another handler.
+//
+// Responses are cached when they have a 200 status and a Cache-Control
+// max-age or s-maxage, and are not marked no-store, no-cache or private.
+// A Vary header stores one response for each combination of the named
+// request headers. Vary: * is never cached.
+//
+// As a shared cache, it never stores a response that sets a cookie, nor a
+// response to a request with an Authorization header unless the response is
+// marked public, s-maxage or must-revalidate. Responses are cached per host.
+//
+// Fresh responses are served from the cache. A request whose If-None-Match
+// matches the cached ETag gets a 304. Once a response is stale it is
+// served for up to its stale-while-revalidate time while it is fetched
+// again in the background. After that it is fetched before answering, with
+// an If-None-Match so the next handler may reply 304 Not Modified.
+//
+// Responses of the next handler are buffered, not streamed.
+type Middleware struct {
+	// The handler whose responses are cached.
+	Next http.Handler
+
+	// Where responses are kept. Its AgeLimit should be -1; freshness is
+	// decided by the responses' Cache-Control headers.
+	Cache *cache.ConcurrentRingCache
+
+	// Used to decide if responses are fresh.
+	Clock clock.Clock
+
+	// Names the route of a request for RouteStats. If nil, no route stats
+	// are kept. It should return one of a small set of names, such as a
+	// URL pattern, and not the path itself.
+	Route func(*http.Request) string
+
+	// The most routes RouteStats tracks. Requests on further routes are
+	// counted under OtherRoute.
+	MaxRoutes int
+
+	lock   sync.Mutex
+	routes map[string]*cache.CacheStats
+
+	// Keys being refreshed in the background.
+	refreshing map[string]bool
+	refreshes  sync.WaitGroup
+
+	// The context of background refreshes, cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed bool
+}
+
+// The default MaxRoutes.
+const DefaultMaxRoutes = 100
+
+// The route requests are counted under once MaxRoutes routes are tracked.
+const OtherRoute = "other"
+
+// A cached response.
+type entry struct {
+	status int
+	header http.Header
+	body   []byte
+
+	// When the response was fetched or last revalidated.
+	date time.Time
+
+	maxAge               time.Duration
+	staleWhileRevalidate time.Duration
+}
+
+// Stored under the URL of a response with a Vary header.
+// It names the request headers that select the variant.
+type variants struct {
+	headers []string
+}
+
+// Create a middleware that caches the responses of next in c.
+func New(next http.Handler, c *cache.ConcurrentRingCache) *Middleware {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Middleware{
+		Next:       next,
+		Cache:      c,
+		Clock:      clock.Real{},
+		MaxRoutes:  DefaultMaxRoutes,
+		routes:     make(map[string]*cache.CacheStats),
+		refreshing: make(map[string]bool),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Wait for background refreshes in progress to finish.
+func (m *Middleware) Wait() {
+	m.refreshes.Wait()
+}
+
+// Stop starting background refreshes, cancel the context of those in
+// progress and wait for them. Stale responses are still served, and
+// fetched again once past their stale-while-revalidate time.
+func (m *Middleware) Close() {
+	m.lock.Lock()
+	m.closed = true
+	m.lock.Unlock()
+
+	m.cancel()
+	m.refreshes.Wait()
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || hasDirective(r.Header, "no-store") {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+
+	stats := m.stats(r)
+	key := m.key(r)
+
+	var e *entry
+	if v, ok := m.Cache.Get(key); ok {
+		e, _ = v.(*entry)
+	}
+
+	if e == nil {
+		stats.Miss()
+		m.fetch(w, r, key, nil)
+		return
+	}
+
+	age := m.Clock.Now().Sub(e.date)
+
+	switch {
+	case age <= e.maxAge:
+		stats.Hit()
+		m.serve(w, r, e, Hit)
+	case age <= e.maxAge+e.staleWhileRevalidate:
+		stats.Hit()
+		m.refresh(r, key, e)
+		m.serve(w, r, e, Stale)
+	default:
+		stats.Miss()
+		m.fetch(w, r, key, e)
+	}
+}
+
+// Return the hits and misses of every route.
+func (m *Middleware) RouteStats() map[string]cache.CacheStatsSnapshot {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	snapshots := make(map[string]cache.CacheStatsSnapshot, len(m.routes))
+	for route, s := range m.routes {
+		snapshots[route] = s.Snapshot()
+	}
+
+	return snapshots
+}
+
+// The stats of the request's route. Without a Route function, the stats
+// are not kept.
+func (m *Middleware) stats(r *http.Request) *cache.CacheStats {
+	if m.Route == nil {
+		return &cache.CacheStats{}
+	}
+
+	route := m.Route(r)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, ok := m.routes[route]
+	if !ok {
+		if len(m.routes) >= m.MaxRoutes {
+			route = OtherRoute
+		}
+
+		if s, ok = m.routes[route]; !ok {
+			s = &cache.CacheStats{}
+			m.routes[route] = s
+		}
+	}
+
+	return s
+}
+
+// The key of a request's URL, which includes the host.
+func baseKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// The cache key of a request, including the headers its URL varies on.
+func (m *Middleware) key(r *http.Request) string {
+	base := baseKey(r)
+
+	v, _ := m.Cache.Get(base)
+	if vary, ok := v.(*variants); ok {
+		return variantKey(base, vary.headers, r)
+	}
+
+	return base
+}
+
+func variantKey(base string, headers []string, r *http.Request) string {
+	b := strings.Builder{}
+	b.WriteString(base)
+
+	for _, h := range headers {
+		b.WriteString("\n")
+		b.WriteString(h)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(r.Header.Values(h), ", "))
+	}
+
+	return b.String()
+}
+
+// Call the next handler, cache its response if allowed and write it to w.
+//
+// If stale is not nil, the next handler is asked to revalidate it.
+func (m *Middleware) fetch(w http.ResponseWriter, r *http.Request, key string, stale *entry) {
+	e, revalidated := m.load(r, key, stale)
+
+	if revalidated {
+		m.serve(w, r, e, Revalidated)
+		return
+	}
+
+	m.store(r, key, e)
+	m.serve(w, r, e, Miss)
+}
+
+// Call the next handler and return its response.
+//
+// If stale has an ETag, it is sent in If-None-Match. When the next handler
+// replies 304, stale is refreshed under key and returned with true.
+func (m *Middleware) load(r *http.Request, key string, stale *entry) (*entry, bool) {
+	req := r
+	etag := ""
+	if stale != nil {
+		etag = stale.header.Get("ETag")
+	}
+
+	if etag != "" {
+		req = r.Clone(r.Context())
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	rec := &recorder{header: make(http.Header)}
+	m.Next.ServeHTTP(rec, req)
+
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	now := m.Clock.Now()
+
+	if etag != "" && rec.status == http.StatusNotModified {
+		e := *stale
+		e.date = now
+		e.header = stale.header.Clone()
+		for k, v := range rec.header {
+			e.header[k] = v
+		}
+		e.maxAge, e.staleWhileRevalidate, _ = freshness(e.header)
+
+		m.Cache.Put(key, &e)
+
+		return &e, true
+	}
+
+	e := &entry{
+		status: rec.status,
+		header: rec.header,
+		body:   rec.body.Bytes(),
+		date:   now,
+	}
+
+	return e, false
+}
+
+// Cache a response if its headers allow it, or forget the key if not.
+func (m *Middleware) store(r *http.Request, key string, e *entry) {
+	maxAge, swr, ok := freshness(e.header)
+
+	vary := varyHeaders(e.header)
+	if e.status != http.StatusOK || !ok || (len(vary) == 1 && vary[0] == "*") {
+		m.Cache.Remove(key)
+		return
+	}
+
+	// Leave what is cached alone; these responses belong to one user.
+	if !shareable(r, e.header) {
+		return
+	}
+
+	e.maxAge = maxAge
+	e.staleWhileRevalidate = swr
+
+	if len(vary) > 0 {
+		base := baseKey(r)
+		m.Cache.Put(base, &variants{headers: vary})
+		key = variantKey(base, vary, r)
+	}
+
+	m.Cache.Put(key, e)
+
+	if m.Cache.SizeLimit > 0 {
+		m.Cache.EnforceSizeLimit()
+	}
+}
+
+// Revalidate a stale entry in the background unless that is already happening.
+func (m *Middleware) refresh(r *http.Request, key string, stale *entry) {
+	m.lock.Lock()
+	if m.refreshing[key] || m.closed {
+		m.lock.Unlock()
+		return
+	}
+	m.refreshing[key] = true
+	m.refreshes.Add(1)
+	m.lock.Unlock()
+
+	// The request's context ends when the client is answered.
+	req := r.Clone(m.ctx)
+
+	go func() {
+		defer m.refreshes.Done()
+
+		if e, revalidated := m.load(req, key, stale); !revalidated {
+			m.store(req, key, e)
+		}
+
+		m.lock.Lock()
+		delete(m.refreshing, key)
+		m.lock.Unlock()
+	}()
+}
+
+// Write a response, or 304 Not Modified if the request's If-None-Match
+// matches its ETag.
+func (m *Middleware) serve(w http.ResponseWriter, r *http.Request, e *entry, status string) {
+	// Copy the values so that the cached header is never changed.
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set(StatusHeader, status)
+
+	if status != Miss {
+		h.Set("Age", strconv.Itoa(int(m.Clock.Now().Sub(e.date)/time.Second)))
+	}
+
+	if etag := e.header.Get("ETag"); etag != "" && e.status == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// Collects a response from the next handler.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+// Parse the Cache-Control header of a response.
+//
+// Returns the max-age, the stale-while-revalidate time and whether the
+// response may be cached at all. s-maxage takes precedence over max-age.
+func freshness(h http.Header) (time.Duration, time.Duration, bool) {
+	d := directives(h)
+
+	if _, ok := d["no-store"]; ok {
+		return 0, 0, false
+	}
+	if _, ok := d["no-cache"]; ok {
+		return 0, 0, false
+	}
+	if _, ok := d["private"]; ok {
+		return 0, 0, false
+	}
+
+	maxAge, ok := seconds(d, "s-maxage")
+	if !ok {
+		maxAge, ok = seconds(d, "max-age")
+	}
+	if !ok || maxAge <= 0 {
+		return 0, 0, false
+	}
+
+	swr, _ := seconds(d, "stale-while-revalidate")
+
+	return maxAge, swr, true
+}
+
+// Report whether a shared cache may store a response to the request.
+func shareable(r *http.Request, h http.Header) bool {
+	if len(h.Values("Set-Cookie")) > 0 {
+		return false
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		d := directives(h)
+		for _, name := range []string{"public", "s-maxage", "must-revalidate"} {
+			if _, ok := d[name]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// Map Cache-Control directives to their values.
+func directives(h http.Header) map[string]string {
+	d := make(map[string]string)
+
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			name, value := part, ""
+			if i := strings.IndexByte(part, '='); i >= 0 {
+				name, value = part[:i], strings.Trim(part[i+1:], `"`)
+			}
+
+			d[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+
+	return d
+}
+
+func hasDirective(h http.Header, name string) bool {
+	_, ok := directives(h)[name]
+	return ok
+}
+
+func seconds(d map[string]string, name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// The canonical, sorted request header names in a response's Vary header.
+func varyHeaders(h http.Header) []string {
+	names := []string{}
+
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return []string{"*"}
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Report whether an If-None-Match header matches an ETag, using the weak
+// comparison If-None-Match calls for.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,266 @@
+package httpcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
+)
+
+// An origin that counts its calls and returns a body naming the call.
+type origin struct {
+	calls    int32
+	version  int32
+	header   http.Header
+	notModOk bool
+}
+
+func (o *origin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&o.calls, 1)
+
+	for k, v := range o.header {
+		w.Header()[k] = v
+	}
+
+	etag := fmt.Sprintf(`"v%d"`, atomic.LoadInt32(&o.version))
+	w.Header().Set("ETag", etag)
+
+	if o.notModOk && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	fmt.Fprintf(w, "call %d lang %s", n, r.Header.Get("Accept-Language"))
+}
+
+func newTest(cacheControl string) (*Middleware, *origin, *clock.Fake) {
+	o := &origin{header: http.Header{"Cache-Control": {cacheControl}}}
+	m := New(o, cache.NewConcurrentRingCache(4, 100, -1))
+	clk := clock.NewFake(time.Unix(0, 0))
+	m.Clock = clk
+
+	return m, o, clk
+}
+
+func get(m http.Handler, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+
+	return w
+}
+
+func expect(t *testing.T, w *httptest.ResponseRecorder, status string, body string) {
+	t.Helper()
+
+	if s := w.Header().Get(StatusHeader); s != status {
+		t.Errorf("Expected %s but found %s.", status, s)
+	}
+
+	if w.Body.String() != body {
+		t.Errorf("Expected body %q but found %q.", body, w.Body.String())
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	m, o, clk := newTest("max-age=60")
+	m.Route = func(r *http.Request) string {
+		return r.URL.Path
+	}
+
+	expect(t, get(m, "/a"), Miss, "call 1 lang ")
+	expect(t, get(m, "/a"), Hit, "call 1 lang ")
+	expect(t, get(m, "/b"), Miss, "call 2 lang ")
+
+	clk.Advance(61 * time.Second)
+	expect(t, get(m, "/a"), Miss, "call 3 lang ")
+
+	if o.calls != 3 {
+		t.Errorf("Expected 3 but found %d.", o.calls)
+	}
+
+	stats := m.RouteStats()
+	if s := stats["/a"]; s.Hits != 1 || s.Misses != 2 {
+		t.Errorf("Expected 1 hit and 2 misses but found %d and %d.", s.Hits, s.Misses)
+	}
+	if s := stats["/b"]; s.Hits != 0 || s.Misses != 1 {
+		t.Errorf("Expected 0 hits and 1 miss but found %d and %d.", s.Hits, s.Misses)
+	}
+}
+
+func TestNotCached(t *testing.T) {
+	for _, cc := range []string{"no-store, max-age=60", "private, max-age=60", "no-cache", "max-age=0", ""} {
+		m, o, _ := newTest(cc)
+
+		get(m, "/a")
+		expect(t, get(m, "/a"), Miss, "call 2 lang ")
+
+		if o.calls != 2 {
+			t.Errorf("%q: expected 2 calls but found %d.", cc, o.calls)
+		}
+	}
+
+	// A request may refuse the cache.
+	m, _, _ := newTest("max-age=60")
+	get(m, "/a")
+	if w := get(m, "/a", "Cache-Control", "no-store"); w.Header().Get(StatusHeader) != "" {
+		t.Errorf("Expected the cache to be bypassed but found %s.", w.Header().Get(StatusHeader))
+	}
+}
+
+func TestVary(t *testing.T) {
+	m, o, _ := newTest("max-age=60")
+	o.header.Set("Vary", "Accept-Language")
+
+	expect(t, get(m, "/a", "Accept-Language", "en"), Miss, "call 1 lang en")
+	expect(t, get(m, "/a", "Accept-Language", "fr"), Miss, "call 2 lang fr")
+	expect(t, get(m, "/a", "Accept-Language", "en"), Hit, "call 1 lang en")
+	expect(t, get(m, "/a", "Accept-Language", "fr"), Hit, "call 2 lang fr")
+
+	o.header.Set("Vary", "*")
+	expect(t, get(m, "/b"), Miss, "call 3 lang ")
+	expect(t, get(m, "/b"), Miss, "call 4 lang ")
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	m, _, _ := newTest("max-age=60")
+
+	get(m, "/a")
+
+	w := get(m, "/a", "If-None-Match", `"v0"`)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected 304 but found %d with %q.", w.Code, w.Body.String())
+	}
+
+	if w := get(m, "/a", "If-None-Match", `"other", W/"v0"`); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 but found %d.", w.Code)
+	}
+
+	if w := get(m, "/a", "If-None-Match", `"v1"`); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 but found %d.", w.Code)
+	}
+}
+
+func TestRevalidate(t *testing.T) {
+	m, o, clk := newTest("max-age=60")
+	o.notModOk = true
+
+	get(m, "/a")
+	clk.Advance(2 * time.Minute)
+
+	// The origin says the stale copy is unchanged.
+	expect(t, get(m, "/a"), Revalidated, "call 1 lang ")
+	expect(t, get(m, "/a"), Hit, "call 1 lang ")
+
+	// The origin has a new version.
+	atomic.StoreInt32(&o.version, 1)
+	clk.Advance(2 * time.Minute)
+	expect(t, get(m, "/a"), Miss, "call 3 lang ")
+	expect(t, get(m, "/a"), Hit, "call 3 lang ")
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	m, o, clk := newTest("max-age=60, stale-while-revalidate=30")
+
+	get(m, "/a")
+	clk.Advance(70 * time.Second)
+
+	w := get(m, "/a")
+	expect(t, w, Stale, "call 1 lang ")
+	if w.Header().Get("Age") != "70" {
+		t.Errorf("Expected age 70 but found %s.", w.Header().Get("Age"))
+	}
+
+	m.Wait()
+
+	if o.calls != 2 {
+		t.Errorf("Expected 2 but found %d.", o.calls)
+	}
+
+	expect(t, get(m, "/a"), Hit, "call 2 lang ")
+
+	// Past the stale-while-revalidate window the client waits for a fetch.
+	clk.Advance(91 * time.Second)
+	expect(t, get(m, "/a"), Miss, "call 3 lang ")
+}
+
+func TestRouteStats(t *testing.T) {
+	m, _, _ := newTest("max-age=60")
+
+	// Without a Route, no stats are kept.
+	get(m, "/a")
+	if len(m.RouteStats()) != 0 {
+		t.Errorf("Expected no routes but found %d.", len(m.RouteStats()))
+	}
+
+	m.Route = func(r *http.Request) string {
+		return r.URL.Path
+	}
+	m.MaxRoutes = 2
+
+	get(m, "/a")
+	get(m, "/b")
+	get(m, "/c")
+	get(m, "/d")
+
+	stats := m.RouteStats()
+	if len(stats) != 3 {
+		t.Errorf("Expected 3 routes but found %d.", len(stats))
+	}
+	if s := stats[OtherRoute]; s.Misses != 2 {
+		t.Errorf("Expected 2 misses but found %d.", s.Misses)
+	}
+}
+
+func TestShared(t *testing.T) {
+	// A response to an authorized request belongs to that user.
+	m, o, _ := newTest("max-age=60")
+	get(m, "/a", "Authorization", "secret")
+	expect(t, get(m, "/a", "Authorization", "secret"), Miss, "call 2 lang ")
+	expect(t, get(m, "/a"), Miss, "call 3 lang ")
+
+	// Unless the origin says it may be shared.
+	m, o, _ = newTest("public, max-age=60")
+	get(m, "/a", "Authorization", "secret")
+	expect(t, get(m, "/a"), Hit, "call 1 lang ")
+
+	// Nor are cookies shared.
+	m, o, _ = newTest("max-age=60")
+	o.header.Set("Set-Cookie", "id=1")
+	get(m, "/a")
+	expect(t, get(m, "/a"), Miss, "call 2 lang ")
+
+	// Each host has its own entries.
+	m, o, _ = newTest("max-age=60")
+	r := httptest.NewRequest(http.MethodGet, "http://one.example/a", nil)
+	m.ServeHTTP(httptest.NewRecorder(), r)
+	r = httptest.NewRequest(http.MethodGet, "http://two.example/a", nil)
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+	expect(t, w, Miss, "call 2 lang ")
+}
+
+func TestClose(t *testing.T) {
+	m, o, clk := newTest("max-age=60, stale-while-revalidate=30")
+
+	get(m, "/a")
+	clk.Advance(70 * time.Second)
+	m.Close()
+
+	// Stale responses are still served, but not refreshed.
+	expect(t, get(m, "/a"), Stale, "call 1 lang ")
+	m.Wait()
+
+	if o.calls != 1 {
+		t.Errorf("Expected 1 but found %d.", o.calls)
+	}
+}
@@ -0,0 +1,503 @@
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
+)
+
+// Expiration times larger than this many seconds are absolute Unix times.
+const MaxRelativeExptime = 60 * 60 * 24 * 30
+
+// The largest value a client may store.
+const MaxValueLength = 1024 * 1024
+
+// The longest key, as in memcached.
+const MaxKeyLength = 250
+
+// The longest command line a client may send if MaxLineLength is not set.
+const DefaultMaxLineLength = 64 * 1024
+
+// Serves the memcached ASCII protocol from a ConcurrentRingCache.
+//
+// Supported commands are get, gets, set, add, replace, cas, delete, incr,
+// decr, touch, flush_all, stats, version and quit.
+type Server struct {
+	// The last CAS token handed out. First for 64-bit alignment.
+	cas uint64
+
+	cmdGet    uint64
+	cmdSet    uint64
+	cmdTouch  uint64
+	getHits   uint64
+	getMisses uint64
+
+	Cache *cache.ConcurrentRingCache
+
+	// Used for key expiration.
+	Clock clock.Clock
+
+	// The longest command line a client may send. Zero means the default.
+	MaxLineLength int
+
+	// One lock per sub-cache. Held while a command reads and then
+	// updates a key so that check-and-set operations are atomic.
+	locks []sync.Mutex
+
+	started time.Time
+}
+
+// What is stored in the cache for each key.
+type entry struct {
+	value []byte
+	flags uint32
+	cas   uint64
+
+	// When the key expires. The zero time means never.
+	expiresAt time.Time
+}
+
+// Create a server for the cache. Stats are enabled on the cache so the
+// stats command can report them.
+func NewServer(c *cache.ConcurrentRingCache) *Server {
+	c.EnableStats()
+
+	return &Server{
+		Cache:   c,
+		Clock:   clock.Real{},
+		locks:   make([]sync.Mutex, c.RingSize),
+		started: time.Now(),
+	}
+}
+
+// Accept connections until the listener is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			s.ServeConn(conn)
+		}()
+	}
+}
+
+// Read commands from the connection and write replies until the client
+// quits or an error occurs.
+func (s *Server) ServeConn(conn io.ReadWriter) error {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	maxLine := s.MaxLineLength
+	if maxLine <= 0 {
+		maxLine = DefaultMaxLineLength
+	}
+
+	for {
+		line, err := readLine(r, maxLine)
+		if err == errLineTooLong {
+			// The rest of the line can't be told from the next command.
+			w.WriteString("CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return err
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+			w.Flush()
+			continue
+		}
+
+		quit, err := s.execute(r, w, fields)
+		if err != nil {
+			return err
+		}
+
+		// Only flush once all pipelined commands have been answered.
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+
+		if quit {
+			return nil
+		}
+	}
+}
+
+// Run one command. Returns true if the connection should be closed.
+// Errors are only returned if the connection can no longer be used.
+func (s *Server) execute(r *bufio.Reader, w *bufio.Writer, fields []string) (bool, error) {
+	switch fields[0] {
+	case "get", "gets":
+		if len(fields) < 2 {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		if !validKeys(fields[1:]) {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			break
+		}
+		for _, k := range fields[1:] {
+			atomic.AddUint64(&s.cmdGet, 1)
+			e := s.get(k)
+			if e == nil {
+				atomic.AddUint64(&s.getMisses, 1)
+			} else {
+				atomic.AddUint64(&s.getHits, 1)
+				if fields[0] == "gets" {
+					fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", k, e.flags, len(e.value), e.cas)
+				} else {
+					fmt.Fprintf(w, "VALUE %s %d %d\r\n", k, e.flags, len(e.value))
+				}
+				w.Write(e.value)
+				w.WriteString("\r\n")
+			}
+		}
+		w.WriteString("END\r\n")
+	case "set", "add", "replace", "cas":
+		return false, s.store(r, w, fields)
+	case "delete":
+		if len(fields) < 2 || len(fields) > 3 {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		if !validKeys(fields[1:2]) {
+			reply(w, fields, 2, "CLIENT_ERROR bad command line format")
+			break
+		}
+		reply(w, fields, 2, s.delete(fields[1]))
+	case "incr", "decr":
+		if len(fields) < 3 || len(fields) > 4 {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		delta, err := strconv.ParseUint(fields[2], 10, 64)
+		if !validKeys(fields[1:2]) {
+			reply(w, fields, 3, "CLIENT_ERROR bad command line format")
+			break
+		}
+		if err != nil {
+			reply(w, fields, 3, "CLIENT_ERROR invalid numeric delta argument")
+			break
+		}
+		reply(w, fields, 3, s.incr(fields[1], delta, fields[0] == "incr"))
+	case "touch":
+		if len(fields) < 3 || len(fields) > 4 {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		exptime, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || !validKeys(fields[1:2]) {
+			reply(w, fields, 3, "CLIENT_ERROR bad command line format")
+			break
+		}
+		atomic.AddUint64(&s.cmdTouch, 1)
+		reply(w, fields, 3, s.touch(fields[1], exptime))
+	case "flush_all":
+		s.Cache.Clear()
+		reply(w, fields, len(fields)-1, "OK")
+	case "stats":
+		s.stats(w)
+	case "version":
+		w.WriteString("VERSION sdsai-go\r\n")
+	case "quit":
+		return true, nil
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+
+	return false, nil
+}
+
+// Write a reply unless the field at noreplyIndex is "noreply".
+func reply(w *bufio.Writer, fields []string, noreplyIndex int, msg string) {
+	if noreplyIndex > 0 && noreplyIndex < len(fields) && fields[noreplyIndex] == "noreply" {
+		return
+	}
+
+	w.WriteString(msg + "\r\n")
+}
+
+// <command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+func (s *Server) store(r *bufio.Reader, w *bufio.Writer, fields []string) error {
+	cmd := fields[0]
+
+	argc := 5
+	if cmd == "cas" {
+		argc = 6
+	}
+
+	if len(fields) != argc && len(fields) != argc+1 {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+
+	flags, err1 := strconv.ParseUint(fields[2], 10, 32)
+	exptime, err2 := strconv.ParseInt(fields[3], 10, 64)
+	length, err3 := strconv.Atoi(fields[4])
+	var casUnique uint64
+	var err4 error
+	if cmd == "cas" {
+		casUnique, err4 = strconv.ParseUint(fields[5], 10, 64)
+	}
+
+	if err3 != nil || length < 0 || length > MaxValueLength {
+		// We can't know how much data to skip, so give up on the connection.
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		w.Flush()
+		return fmt.Errorf("Bad data length %q.", fields[4])
+	}
+
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	if data[length] != '\r' || data[length+1] != '\n' {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return nil
+	}
+
+	if err1 != nil || err2 != nil || err4 != nil || !validKeys(fields[1:2]) {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+
+	atomic.AddUint64(&s.cmdSet, 1)
+
+	key := fields[1]
+	e := &entry{
+		value:     data[:length],
+		flags:     uint32(flags),
+		expiresAt: s.expiresAt(exptime),
+	}
+
+	lock := s.lock(key)
+	defer lock.Unlock()
+
+	old := s.lookup(key)
+
+	var msg string
+	switch {
+	case cmd == "add" && old != nil:
+		msg = "NOT_STORED"
+	case cmd == "replace" && old == nil:
+		msg = "NOT_STORED"
+	case cmd == "cas" && old == nil:
+		msg = "NOT_FOUND"
+	case cmd == "cas" && old.cas != casUnique:
+		msg = "EXISTS"
+	default:
+		s.put(key, e)
+		msg = "STORED"
+	}
+
+	reply(w, fields, argc, msg)
+
+	return nil
+}
+
+func (s *Server) delete(key string) string {
+	lock := s.lock(key)
+	defer lock.Unlock()
+
+	// Expired entries are removed too, but reported as not found.
+	v, ok := s.Cache.Remove(key)
+	if !ok || s.expired(v.(*entry)) {
+		return "NOT_FOUND"
+	}
+
+	return "DELETED"
+}
+
+func (s *Server) incr(key string, delta uint64, up bool) string {
+	lock := s.lock(key)
+	defer lock.Unlock()
+
+	old := s.lookup(key)
+	if old == nil {
+		return "NOT_FOUND"
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(string(old.value)), 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR cannot increment or decrement non-numeric value"
+	}
+
+	if up {
+		// Wraps at 64 bits, as memcached does.
+		n += delta
+	} else if delta > n {
+		n = 0
+	} else {
+		n -= delta
+	}
+
+	value := strconv.FormatUint(n, 10)
+	s.put(key, &entry{value: []byte(value), flags: old.flags, expiresAt: old.expiresAt})
+
+	return value
+}
+
+func (s *Server) touch(key string, exptime int64) string {
+	lock := s.lock(key)
+	defer lock.Unlock()
+
+	old := s.lookup(key)
+	if old == nil {
+		return "NOT_FOUND"
+	}
+
+	e := *old
+	e.expiresAt = s.expiresAt(exptime)
+
+	s.Cache.Put(key, &e)
+
+	return "TOUCHED"
+}
+
+func (s *Server) stats(w *bufio.Writer) {
+	st := s.Cache.MergedStats()
+	now := s.Clock.Now()
+
+	stat := func(name string, value interface{}) {
+		fmt.Fprintf(w, "STAT %s %v\r\n", name, value)
+	}
+
+	stat("pid", os.Getpid())
+	stat("uptime", int64(now.Sub(s.started)/time.Second))
+	stat("time", now.Unix())
+	stat("version", "sdsai-go")
+	stat("curr_items", s.Cache.Size())
+	stat("cmd_get", atomic.LoadUint64(&s.cmdGet))
+	stat("cmd_set", atomic.LoadUint64(&s.cmdSet))
+	stat("cmd_touch", atomic.LoadUint64(&s.cmdTouch))
+	stat("get_hits", atomic.LoadUint64(&s.getHits))
+	stat("get_misses", atomic.LoadUint64(&s.getMisses))
+	// As in memcached, only items dropped to make room count.
+	stat("evictions", st.Evictions[cache.EvictionSize])
+	w.WriteString("END\r\n")
+}
+
+// Store an entry with a new CAS token, replacing any existing entry.
+func (s *Server) put(key string, e *entry) {
+	e.cas = atomic.AddUint64(&s.cas, 1)
+
+	s.Cache.Put(key, e)
+	s.Cache.EnforceSizeLimit()
+}
+
+// Return the entry for a key or nil if it is missing or expired.
+// The cache's stats are not updated, so stores do not count as gets.
+//
+// Expired entries are left in place, as callers need not hold the key's
+// lock. They are replaced by the next store or evicted by the cache.
+func (s *Server) lookup(key string) *entry {
+	return s.live(s.Cache.Peek(key))
+}
+
+// Like lookup, but counted by the cache's stats as a get.
+func (s *Server) get(key string) *entry {
+	return s.live(s.Cache.Get(key))
+}
+
+// Return the entry found in the cache, or nil if it was not found or has
+// expired.
+func (s *Server) live(v interface{}, ok bool) *entry {
+	if !ok {
+		return nil
+	}
+
+	e := v.(*entry)
+	if s.expired(e) {
+		return nil
+	}
+
+	return e
+}
+
+func (s *Server) expired(e *entry) bool {
+	return !e.expiresAt.IsZero() && !s.Clock.Now().Before(e.expiresAt)
+}
+
+// Convert a memcached exptime to a time.
+//
+// 0 is never, negative is already expired, values up to 30 days are
+// relative to now and larger values are absolute Unix times.
+func (s *Server) expiresAt(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return s.Clock.Now()
+	case exptime <= MaxRelativeExptime:
+		return s.Clock.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+// Report whether every key is short enough.
+func validKeys(keys []string) bool {
+	for _, k := range keys {
+		if len(k) > MaxKeyLength {
+			return false
+		}
+	}
+
+	return true
+}
+
+var errLineTooLong = errors.New("The command line is too long.")
+
+// Read a line of at most max bytes, not counting the \r\n.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > max+2 {
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		return string(line), nil
+	}
+}
+
+// Lock the key's sub-cache lock and return it.
+func (s *Server) lock(key string) *sync.Mutex {
+	l := &s.locks[s.Cache.KeyHash(key, s.Cache.RingSize)]
+	l.Lock()
+	return l
+}
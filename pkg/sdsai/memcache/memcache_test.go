@@ -0,0 +1,154 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
+)
+
+func TestServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	clk := clock.NewFake(time.Unix(1000000, 0))
+	server := NewServer(cache.NewConcurrentRingCache(4, 100, -1))
+	server.Clock = clk
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	// Send a command and read lines until the reply is as long as expected.
+	do := func(cmd string, expected string) {
+		t.Helper()
+
+		conn.Write([]byte(cmd))
+
+		reply := ""
+		for len(reply) < len(expected) {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply += line
+		}
+
+		if reply != expected {
+			t.Errorf("%q: expected %q but got %q", cmd, expected, reply)
+		}
+	}
+
+	do("get a\r\n", "END\r\n")
+	do("set a 5 0 3\r\nabc\r\n", "STORED\r\n")
+	do("get a b\r\n", "VALUE a 5 3\r\nabc\r\nEND\r\n")
+	do("gets a\r\n", "VALUE a 5 3 1\r\nabc\r\nEND\r\n")
+	do("add a 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	do("replace b 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	do("add b 0 0 1\r\nx\r\n", "STORED\r\n")
+	do("replace b 0 0 2\r\nyy\r\n", "STORED\r\n")
+	do("cas a 0 0 1 99\r\nz\r\n", "EXISTS\r\n")
+	do("cas a 7 0 1 1\r\nz\r\n", "STORED\r\n")
+	do("cas a 7 0 1 1\r\nq\r\n", "EXISTS\r\n")
+	do("cas nope 0 0 1 1\r\nq\r\n", "NOT_FOUND\r\n")
+	do("gets a\r\n", "VALUE a 7 1 4\r\nz\r\nEND\r\n")
+	do("set n 0 0 2 noreply\r\n10\r\nincr n 5\r\n", "15\r\n")
+	do("decr n 20\r\n", "0\r\n")
+	do("incr a 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	do("incr nope 1\r\n", "NOT_FOUND\r\n")
+	do("set t 0 10 1\r\nt\r\n", "STORED\r\n")
+	do("touch t 100\r\n", "TOUCHED\r\n")
+	clk.Advance(50 * time.Second)
+	do("get t\r\n", "VALUE t 0 1\r\nt\r\nEND\r\n")
+	do("touch t 10\r\n", "TOUCHED\r\n")
+	clk.Advance(50 * time.Second)
+	do("get t\r\n", "END\r\n")
+	do("delete t\r\n", "NOT_FOUND\r\n")
+	do("delete b\r\n", "DELETED\r\n")
+	do("set x 0 -1 1\r\nx\r\n", "STORED\r\n")
+	do("get x\r\n", "END\r\n")
+	do("bogus\r\n", "ERROR\r\n")
+	long := strings.Repeat("k", MaxKeyLength+1)
+	do("get a "+long+"\r\n", "CLIENT_ERROR bad command line format\r\n")
+	do("set "+long+" 0 0 1\r\nx\r\n", "CLIENT_ERROR bad command line format\r\n")
+	do("flush_all\r\n", "OK\r\n")
+	do("get a n\r\n", "END\r\n")
+
+	conn.Write([]byte("stats\r\n"))
+	stats := ""
+	for !strings.HasSuffix(stats, "END\r\n") {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats += line
+	}
+	// Neither flush_all nor expiry counts as an eviction.
+	if !strings.Contains(stats, "STAT curr_items 0\r\n") || !strings.Contains(stats, "STAT evictions 0\r\n") ||
+		strings.Contains(stats, "expired_unfetched") {
+		t.Errorf("Unexpected stats %q.", stats)
+	}
+
+	// Only gets are counted, and expired keys are misses.
+	if !strings.Contains(stats, "STAT get_hits 4\r\n") || !strings.Contains(stats, "STAT get_misses 6\r\n") {
+		t.Errorf("Unexpected get stats %q.", stats)
+	}
+
+	do("quit\r\n", "")
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("Connection should be closed after quit.")
+	}
+}
+
+func TestLookupLeavesExpiredEntries(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000000, 0))
+	server := NewServer(cache.NewConcurrentRingCache(4, 100, -1))
+	server.Clock = clk
+
+	server.put("a", &entry{value: []byte("old"), expiresAt: clk.Now()})
+
+	// A get takes no lock, so it must not remove what a store may have
+	// just replaced.
+	if e := server.lookup("a"); e != nil {
+		t.Errorf("Expected a miss but found %q.", e.value)
+	}
+	if server.Cache.Size() != 1 {
+		t.Errorf("Expected 1 item but found %d.", server.Cache.Size())
+	}
+}
+
+// A connection that reads from in and writes to out.
+type fakeConn struct {
+	io.Reader
+	io.Writer
+}
+
+func TestLineTooLong(t *testing.T) {
+	server := NewServer(cache.NewConcurrentRingCache(1, 10, -1))
+	server.MaxLineLength = 16
+
+	out := bytes.Buffer{}
+	in := strings.NewReader("get a\r\nget " + strings.Repeat("a", 100))
+
+	if err := server.ServeConn(fakeConn{in, &out}); err == nil {
+		t.Error("Expected an error.")
+	}
+
+	if out.String() != "END\r\nCLIENT_ERROR line too long\r\n" {
+		t.Errorf("Unexpected reply %q.", out.String())
+	}
+}
@@ -0,0 +1,329 @@
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/resourcepool"
+	"github.com/basking2/sdsai-go/pkg/sdsai/semaphore"
+)
+
+// The content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// A label name and value.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// One value of a metric.
+type Sample struct {
+	// The metric name. Histograms use the family name plus _bucket, _sum or _count.
+	Name   string
+	Labels []Label
+	Value  float64
+}
+
+// Samples that share a name, help text and type.
+type Family struct {
+	Name string
+	Help string
+
+	// One of "counter", "gauge" or "histogram".
+	Type    string
+	Samples []Sample
+}
+
+// Collects metrics from registered caches, pools and semaphores.
+//
+// A Registry is an http.Handler that serves the Prometheus text format.
+// It may also be published through expvar.
+type Registry struct {
+	lock       sync.Mutex
+	collectors []func() []Family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register a function that returns metrics. It is called on every Gather.
+func (r *Registry) Register(collector func() []Family) {
+	r.lock.Lock()
+	r.collectors = append(r.collectors, collector)
+	r.lock.Unlock()
+}
+
+// Report the merged stats and size of a ConcurrentRingCache under the given name.
+// Stats must be enabled on the cache for the counters to move.
+func (r *Registry) RegisterCache(name string, c *cache.ConcurrentRingCache) {
+	r.Register(func() []Family {
+		families := statsFamilies(name, c.MergedStats())
+		return append(families, gauge("sdsai_cache_items", "Items in the cache.", "cache", name, float64(c.Size())))
+	})
+}
+
+// Report a single CacheStats, such as that of a LIFOCache, under the given name.
+func (r *Registry) RegisterCacheStats(name string, s *cache.CacheStats) {
+	r.Register(func() []Family {
+		return statsFamilies(name, s.Snapshot())
+	})
+}
+
+// Report the capacity and occupancy of a ResourcePool under the given name.
+func (r *Registry) RegisterResourcePool(name string, p *resourcepool.ResourcePool) {
+	r.Register(func() []Family {
+		return []Family{
+			gauge("sdsai_resourcepool_capacity", "The most resources the pool will create.", "pool", name, float64(p.Capacity())),
+			gauge("sdsai_resourcepool_idle", "Created resources waiting in the pool.", "pool", name, float64(p.Idle())),
+			gauge("sdsai_resourcepool_in_use", "Resources fetched and not returned.", "pool", name, float64(p.InUse())),
+		}
+	})
+}
+
+// Report the capacity, level and waiters of a Semaphore under the given name.
+func (r *Registry) RegisterSemaphore(name string, s *semaphore.Semaphore) {
+	r.Register(func() []Family {
+		return []Family{
+			gauge("sdsai_semaphore_capacity", "The total number of permits.", "semaphore", name, float64(s.GetCapacity())),
+			gauge("sdsai_semaphore_in_use", "Permits taken and not returned.", "semaphore", name, float64(s.InUse())),
+			gauge("sdsai_semaphore_level", "Permits available.", "semaphore", name, float64(s.GetLevel())),
+			gauge("sdsai_semaphore_waiters", "Callers blocked waiting for permits.", "semaphore", name, float64(s.Waiters())),
+		}
+	})
+}
+
+// Report a PrioritySemaphore under the given name, as RegisterSemaphore
+// does, with the number of waiters at each priority.
+func (r *Registry) RegisterPrioritySemaphore(name string, s *semaphore.PrioritySemaphore) {
+	r.Register(func() []Family {
+		waiting := Family{Name: "sdsai_semaphore_waiting", Help: "Callers blocked waiting for permits, by priority.", Type: "gauge"}
+
+		byPriority := s.WaitingByPriority()
+		priorities := make([]int, 0, len(byPriority))
+		for p := range byPriority {
+			priorities = append(priorities, p)
+		}
+		sort.Ints(priorities)
+
+		for _, p := range priorities {
+			waiting.Samples = append(waiting.Samples, Sample{
+				Name:   waiting.Name,
+				Labels: []Label{{"semaphore", name}, {"priority", strconv.Itoa(p)}},
+				Value:  float64(byPriority[p]),
+			})
+		}
+
+		return []Family{
+			gauge("sdsai_semaphore_capacity", "The total number of permits.", "semaphore", name, float64(s.GetCapacity())),
+			gauge("sdsai_semaphore_in_use", "Permits taken and not returned.", "semaphore", name, float64(s.InUse())),
+			gauge("sdsai_semaphore_level", "Permits available.", "semaphore", name, float64(s.GetLevel())),
+			gauge("sdsai_semaphore_waiters", "Callers blocked waiting for permits.", "semaphore", name, float64(s.Waiters())),
+			waiting,
+		}
+	})
+}
+
+// Collect all metrics. Families with the same name are merged and
+// families are sorted by name.
+func (r *Registry) Gather() []Family {
+	r.lock.Lock()
+	collectors := r.collectors
+	r.lock.Unlock()
+
+	byName := make(map[string]*Family)
+	names := []string{}
+
+	for _, collect := range collectors {
+		for _, f := range collect() {
+			if existing, ok := byName[f.Name]; ok {
+				existing.Samples = append(existing.Samples, f.Samples...)
+			} else {
+				f := f
+				byName[f.Name] = &f
+				names = append(names, f.Name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	families := make([]Family, len(names))
+	for i, name := range names {
+		families[i] = *byName[name]
+	}
+
+	return families
+}
+
+// Write all metrics in the Prometheus text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	for _, f := range r.Gather() {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, s := range f.Samples {
+			bw.WriteString(sampleName(s))
+			bw.WriteString(" ")
+			bw.WriteString(formatValue(s.Value))
+			bw.WriteString("\n")
+		}
+	}
+
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WritePrometheus(w)
+}
+
+// Return every sample as a map from its name and labels, as written in the
+// Prometheus format, to its value.
+func (r *Registry) Map() map[string]float64 {
+	m := make(map[string]float64)
+
+	for _, f := range r.Gather() {
+		for _, s := range f.Samples {
+			m[sampleName(s)] = s.Value
+		}
+	}
+
+	return m
+}
+
+// Publish the metrics through expvar under the given name.
+// Like expvar.Publish, this panics if the name is already in use.
+func (r *Registry) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return r.Map()
+	}))
+}
+
+func statsFamilies(name string, s cache.CacheStatsSnapshot) []Family {
+	families := []Family{
+		counter("sdsai_cache_hits_total", "Lookups that found an item.", "cache", name, float64(s.Hits)),
+		counter("sdsai_cache_misses_total", "Lookups that did not find an item.", "cache", name, float64(s.Misses)),
+		counter("sdsai_cache_negative_hits_total", "Hits on keys cached as missing.", "cache", name, float64(s.NegativeHits)),
+		counter("sdsai_cache_puts_total", "Items added or refreshed.", "cache", name, float64(s.Puts)),
+		gauge("sdsai_cache_hit_ratio", "Hits divided by lookups.", "cache", name, s.HitRatio()),
+	}
+
+	evictions := Family{Name: "sdsai_cache_evictions_total", Help: "Items that left the cache, by reason.", Type: "counter"}
+	for i, n := range s.Evictions {
+		evictions.Samples = append(evictions.Samples, Sample{
+			Name:   evictions.Name,
+			Labels: []Label{{"cache", name}, {"reason", cache.EvictionReason(i).String()}},
+			Value:  float64(n),
+		})
+	}
+
+	loads := Family{Name: "sdsai_cache_loads_total", Help: "Loads of missing items, by result.", Type: "counter"}
+	loads.Samples = []Sample{
+		{Name: loads.Name, Labels: []Label{{"cache", name}, {"result", "success"}}, Value: float64(s.LoadSuccesses)},
+		{Name: loads.Name, Labels: []Label{{"cache", name}, {"result", "failure"}}, Value: float64(s.LoadFailures)},
+	}
+
+	return append(families, evictions, loads, latencyFamily(name, s.LoadLatency))
+}
+
+func latencyFamily(name string, l cache.LatencySnapshot) Family {
+	f := Family{
+		Name: "sdsai_cache_load_duration_seconds",
+		Help: "How long loads take.",
+		Type: "histogram",
+	}
+
+	var cumulative int64
+	for i, c := range l.Counts {
+		cumulative += c
+
+		le := "+Inf"
+		if i < len(l.Counts)-1 {
+			le = formatValue(cache.LatencyBucketBound(i).Seconds())
+		}
+
+		f.Samples = append(f.Samples, Sample{
+			Name:   f.Name + "_bucket",
+			Labels: []Label{{"cache", name}, {"le", le}},
+			Value:  float64(cumulative),
+		})
+	}
+
+	f.Samples = append(f.Samples,
+		Sample{Name: f.Name + "_sum", Labels: []Label{{"cache", name}}, Value: l.Sum.Seconds()},
+		Sample{Name: f.Name + "_count", Labels: []Label{{"cache", name}}, Value: float64(l.Count)},
+	)
+
+	return f
+}
+
+func counter(metric, help, labelName, labelValue string, value float64) Family {
+	return single(metric, help, "counter", labelName, labelValue, value)
+}
+
+func gauge(metric, help, labelName, labelValue string, value float64) Family {
+	return single(metric, help, "gauge", labelName, labelValue, value)
+}
+
+func single(metric, help, typ, labelName, labelValue string, value float64) Family {
+	return Family{
+		Name: metric,
+		Help: help,
+		Type: typ,
+		Samples: []Sample{{
+			Name:   metric,
+			Labels: []Label{{labelName, labelValue}},
+			Value:  value,
+		}},
+	}
+}
+
+// The sample name with its labels, such as name{a="b"}.
+func sampleName(s Sample) string {
+	if len(s.Labels) == 0 {
+		return s.Name
+	}
+
+	parts := make([]string, len(s.Labels))
+	for i, l := range s.Labels {
+		parts[i] = l.Name + `="` + escapeLabel(l.Value) + `"`
+	}
+
+	return s.Name + "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/resourcepool"
+	"github.com/basking2/sdsai-go/pkg/sdsai/semaphore"
+)
+
+type intMaker struct{}
+
+func (intMaker) Create() (interface{}, error) { return 1, nil }
+func (intMaker) Check(interface{}) error      { return nil }
+func (intMaker) Destroy(interface{}) error    { return nil }
+
+func TestRegistry(t *testing.T) {
+	c := cache.NewConcurrentRingCache(2, 10, -1)
+	c.EnableStats()
+	c.Put("a", 1)
+	c.Get("a")
+	c.Get("b")
+
+	pool, _ := resourcepool.NewResourcePool(intMaker{}, 3, 0, -1)
+	r1, _ := pool.GetResource()
+	r2, _ := pool.GetResource()
+	r2.Close()
+
+	sem := semaphore.NewSemaphore(5)
+	sem.Down(2)
+
+	jobs := semaphore.NewPrioritySemaphore(1, 0)
+	jobs.Down(1, 0)
+	go jobs.Down(1, 3)
+	for jobs.Waiters() != 1 {
+		runtime.Gosched()
+	}
+	defer jobs.Up(1)
+
+	reg := NewRegistry()
+	reg.RegisterCache(`my "cache"`, c)
+	reg.RegisterResourcePool("db", pool)
+	reg.RegisterSemaphore("workers", sem)
+	reg.RegisterPrioritySemaphore("jobs", jobs)
+
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != ContentType {
+		t.Errorf("Unexpected content type %q.", resp.Header.Get("Content-Type"))
+	}
+
+	text := string(body)
+	for _, expected := range []string{
+		"# TYPE sdsai_cache_hits_total counter\n",
+		`sdsai_cache_hits_total{cache="my \"cache\""} 1` + "\n",
+		`sdsai_cache_misses_total{cache="my \"cache\""} 1` + "\n",
+		`sdsai_cache_hit_ratio{cache="my \"cache\""} 0.5` + "\n",
+		`sdsai_cache_items{cache="my \"cache\""} 1` + "\n",
+		`sdsai_cache_evictions_total{cache="my \"cache\"",reason="expired"} 0` + "\n",
+		`sdsai_cache_load_duration_seconds_bucket{cache="my \"cache\"",le="+Inf"} 0` + "\n",
+		"# TYPE sdsai_cache_load_duration_seconds histogram\n",
+		`sdsai_resourcepool_capacity{pool="db"} 3` + "\n",
+		`sdsai_resourcepool_idle{pool="db"} 1` + "\n",
+		`sdsai_resourcepool_in_use{pool="db"} 1` + "\n",
+		`sdsai_semaphore_capacity{semaphore="workers"} 5` + "\n",
+		`sdsai_semaphore_in_use{semaphore="workers"} 2` + "\n",
+		`sdsai_semaphore_level{semaphore="workers"} 3` + "\n",
+		`sdsai_semaphore_waiters{semaphore="workers"} 0` + "\n",
+		`sdsai_semaphore_waiters{semaphore="jobs"} 1` + "\n",
+		`sdsai_semaphore_waiting{semaphore="jobs",priority="3"} 1` + "\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Missing %q in:\n%s", expected, text)
+		}
+	}
+
+	// Each family is described once.
+	if strings.Count(text, "# TYPE sdsai_cache_evictions_total") != 1 {
+		t.Error("Family header repeated.")
+	}
+
+	r1.Close()
+
+	reg.PublishExpvar("sdsai_test")
+	m := map[string]float64{}
+	if err := json.Unmarshal([]byte(expvar.Get("sdsai_test").String()), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m[`sdsai_resourcepool_idle{pool="db"}`] != 2 {
+		t.Errorf("Unexpected expvar value %v.", m[`sdsai_resourcepool_idle{pool="db"}`])
+	}
+}
@@ -0,0 +1,228 @@
+package peercache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/consistenthash"
+)
+
+// The default path prefix peers serve keys under.
+const DefaultBasePath = "/_peercache/"
+
+// How long the default Client waits for a peer to answer.
+const DefaultTimeout = 5 * time.Second
+
+// Returned by Get when the owning peer answered with an error, such as
+// when its loader failed.
+type PeerError struct {
+	Peer       string
+	StatusCode int
+	Message    string
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("Peer %s returned %d: %s", e.Peer, e.StatusCode, e.Message)
+}
+
+// Loads the value for a key from the source of truth.
+//
+// A loader is only called by the peer that owns the key.
+type Loader interface {
+	Load(key string) ([]byte, error)
+}
+
+// Adapt a function to the Loader interface.
+type LoaderFunc func(key string) ([]byte, error)
+
+func (f LoaderFunc) Load(key string) ([]byte, error) {
+	return f(key)
+}
+
+// A cache that is spread across a set of peers.
+//
+// Each key is owned by exactly one peer, chosen with consistenthash.
+// The owner loads and caches the key in its MainCache. Other peers fetch the
+// key from the owner over HTTP and keep a copy in their HotCache.
+type PeerCache struct {
+	// The base URL of this peer, as other peers would reach it. Eg, "http://10.0.0.1:8080".
+	Self string
+
+	// The path prefix keys are served under.
+	BasePath string
+
+	// Loads keys this peer owns.
+	Loader Loader
+
+	// Keys this peer owns.
+	MainCache *cache.ConcurrentRingCache
+
+	// Keys owned by other peers.
+	HotCache *cache.ConcurrentRingCache
+
+	// Used to fetch keys from other peers. It should have a timeout, as
+	// Get waits for it.
+	Client *http.Client
+
+	lock  sync.RWMutex
+	peers []string
+}
+
+// Create a new peer cache.
+//
+// self is the base URL of this peer.
+// ringSize, cacheSize and ageLimit are used to build the MainCache.
+// hotSize is the size of each sub-cache in the HotCache which shares
+// the ringSize and ageLimit of the MainCache.
+func NewPeerCache(self string, loader Loader, ringSize int, cacheSize int, ageLimit time.Duration, hotSize int) *PeerCache {
+	self = strings.TrimSuffix(self, "/")
+	return &PeerCache{
+		Self:      self,
+		BasePath:  DefaultBasePath,
+		Loader:    loader,
+		MainCache: cache.NewConcurrentRingCache(ringSize, cacheSize, ageLimit),
+		HotCache:  cache.NewConcurrentRingCache(ringSize, hotSize, ageLimit),
+		Client:    &http.Client{Timeout: DefaultTimeout},
+		peers:     []string{self},
+	}
+}
+
+// Set the base URLs of every peer, including this one.
+//
+// Every peer must be given the same list, in any order, so they agree on
+// which peer owns which key.
+func (p *PeerCache) SetPeers(peers ...string) {
+	sorted := make([]string, len(peers))
+	for i, peer := range peers {
+		sorted[i] = strings.TrimSuffix(peer, "/")
+	}
+	sort.Strings(sorted)
+
+	p.lock.Lock()
+	p.peers = sorted
+	p.lock.Unlock()
+}
+
+// Return the base URL of the peer that owns the key.
+func (p *PeerCache) Owner(key string) string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if len(p.peers) == 0 {
+		return p.Self
+	}
+
+	return p.peers[consistenthash.HashToInt(key, len(p.peers))]
+}
+
+// Get the value of a key, from this peer or from the peer that owns it.
+//
+// If the owning peer cannot be reached, the key is loaded locally and kept
+// in the HotCache. If the owner answers with an error, a *PeerError is
+// returned and nothing is loaded here.
+func (p *PeerCache) Get(key string) ([]byte, error) {
+	owner := p.Owner(key)
+
+	if owner == p.Self {
+		return p.getLocal(key)
+	}
+
+	if v, ok := p.HotCache.Get(key); ok {
+		return v.([]byte), nil
+	}
+
+	v, err := p.fetch(owner, key)
+	if _, answered := err.(*PeerError); answered {
+		return nil, err
+	}
+
+	if err != nil {
+		if v, err = p.Loader.Load(key); err != nil {
+			return nil, err
+		}
+	}
+
+	p.HotCache.Put(key, v)
+	p.HotCache.EnforceSizeLimit()
+
+	return v, nil
+}
+
+// Remove a key from this peer's caches.
+func (p *PeerCache) Remove(key string) {
+	p.MainCache.Remove(key)
+	p.HotCache.Remove(key)
+}
+
+// Serve keys to other peers.
+//
+// Keys are loaded locally even if this peer does not think it owns them.
+// That keeps requests from bouncing between peers with different peer lists.
+func (p *PeerCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, p.BasePath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), p.BasePath))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	v, err := p.getLocal(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(v)
+}
+
+func (p *PeerCache) getLocal(key string) ([]byte, error) {
+	if v, ok := p.MainCache.Get(key); ok {
+		return v.([]byte), nil
+	}
+
+	v, err := p.Loader.Load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	p.MainCache.Put(key, v)
+	p.MainCache.EnforceSizeLimit()
+
+	return v, nil
+}
+
+func (p *PeerCache) fetch(peer string, key string) ([]byte, error) {
+	resp, err := p.Client.Get(peer + p.BasePath + url.PathEscape(key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &PeerError{Peer: peer, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+
+	return body, nil
+}
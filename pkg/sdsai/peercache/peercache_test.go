@@ -0,0 +1,163 @@
+package peercache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPeerCache(t *testing.T) {
+	lock := sync.Mutex{}
+	loads := map[string]int{}
+
+	peers := make([]*PeerCache, 3)
+	urls := make([]string, 3)
+
+	for i := range peers {
+		server := httptest.NewUnstartedServer(nil)
+		url := "http://" + server.Listener.Addr().String()
+
+		loader := LoaderFunc(func(key string) ([]byte, error) {
+			if key == "missing" {
+				return nil, errors.New("No such key.")
+			}
+
+			lock.Lock()
+			loads[key]++
+			lock.Unlock()
+
+			return []byte("value of " + key), nil
+		})
+
+		peers[i] = NewPeerCache(url, loader, 4, 100, -1, 10)
+		server.Config.Handler = peers[i]
+		server.Start()
+		defer server.Close()
+
+		urls[i] = url
+	}
+
+	for _, p := range peers {
+		p.SetPeers(urls...)
+	}
+
+	for _, p := range peers {
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("key/%d?", i)
+			v, err := p.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(v) != "value of "+key {
+				t.Errorf("Unexpected value %q.", v)
+			}
+		}
+	}
+
+	// Each key is loaded once, by its owner.
+	for k, n := range loads {
+		if n != 1 {
+			t.Errorf("Key %q was loaded %d times.", k, n)
+		}
+	}
+
+	// Keys are only in the main cache of their owner.
+	for _, p := range peers {
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("key/%d?", i)
+			_, inMain := p.MainCache.Get(key)
+			if inMain != (p.Owner(key) == p.Self) {
+				t.Errorf("Key %q in main cache of %s is %v.", key, p.Self, inMain)
+			}
+		}
+	}
+
+	if _, err := peers[0].Get("missing"); err == nil {
+		t.Error("Loader errors should be returned.")
+	}
+}
+
+func TestPeerCacheUnreachableOwner(t *testing.T) {
+	loads := 0
+	p := NewPeerCache("http://127.0.0.1:1", LoaderFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}), 1, 10, -1, 10)
+
+	// A peer that is not listening.
+	p.SetPeers("http://127.0.0.1:1", "http://127.0.0.1:2")
+
+	for i := 0; i < 10; i++ {
+		if v, err := p.Get(fmt.Sprintf("%d", i)); err != nil || string(v) != fmt.Sprintf("%d", i) {
+			t.Errorf("Unexpected result %q %v.", v, err)
+		}
+	}
+
+	if loads != 10 {
+		t.Errorf("Expected 10 loads but found %d.", loads)
+	}
+
+	// Keys loaded for an unreachable owner are not kept as if owned here.
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("%d", i)
+		if _, inMain := p.MainCache.Get(key); inMain != (p.Owner(key) == p.Self) {
+			t.Errorf("Key %s is in the MainCache: %v.", key, inMain)
+		}
+	}
+}
+
+func TestPeerCacheHungOwner(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	p := NewPeerCache("http://127.0.0.1:1", LoaderFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), 1, 10, -1, 10)
+	p.SetPeers(server.URL)
+
+	if p.Client.Timeout != DefaultTimeout {
+		t.Errorf("Expected a %v timeout but found %v.", DefaultTimeout, p.Client.Timeout)
+	}
+	p.Client.Timeout = 50 * time.Millisecond
+
+	// A peer that does not answer is treated as unreachable.
+	if v, err := p.Get("k"); err != nil || string(v) != "k" {
+		t.Errorf("Unexpected result %q %v.", v, err)
+	}
+}
+
+func TestPeerCacheOwnerError(t *testing.T) {
+	ownerLoads := 0
+	owner := NewPeerCache("", LoaderFunc(func(key string) ([]byte, error) {
+		ownerLoads++
+		return nil, errors.New("backend down")
+	}), 1, 10, -1, 10)
+	server := httptest.NewServer(owner)
+	defer server.Close()
+
+	localLoads := 0
+	p := NewPeerCache("http://127.0.0.1:1", LoaderFunc(func(key string) ([]byte, error) {
+		localLoads++
+		return []byte(key), nil
+	}), 1, 10, -1, 10)
+	p.SetPeers(server.URL)
+
+	_, err := p.Get("k")
+	if pe, ok := err.(*PeerError); !ok || pe.StatusCode != http.StatusInternalServerError || pe.Message != "backend down" {
+		t.Errorf("Expected the owner's error but found %v.", err)
+	}
+
+	if ownerLoads != 1 || localLoads != 0 || p.MainCache.Size() != 0 {
+		t.Errorf("Expected 1 owner load, no local load and nothing cached but found %d, %d and %d.",
+			ownerLoads, localLoads, p.MainCache.Size())
+	}
+}
@@ -2,6 +2,8 @@ package resourcepool
 
 import (
 	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
 )
 
 // How to move a resource through its lifetime.
@@ -22,8 +24,8 @@ type Resource struct {
 	// The number of times this resource was fetched from the pool.
 	Uses int
 
-	// The time.Now().Unix() for when this object was created.
-	CreatedAt int64
+	// When this object was created, according to the pool's Clock.
+	CreatedAt time.Time
 
 	// The created resource.
 	Resource interface{}
@@ -34,10 +36,13 @@ type Resource struct {
 
 type ResourcePool struct {
 	MaxUses         int
-	MaxAge          int64
+	MaxAge          time.Duration
 	ResourceManager ResourceManager
 	FreeResources   chan *Resource
 	CreateResources chan int
+
+	// Used to find the age of resources.
+	Clock clock.Clock
 }
 
 func (r *Resource) Close() error {
@@ -67,7 +72,7 @@ func (pool *ResourcePool) GetResource() (*Resource, error) {
 		if r, e := pool.ResourceManager.Create(); e == nil {
 			return &Resource{
 				Uses:      1,
-				CreatedAt: time.Now().Unix(),
+				CreatedAt: pool.Clock.Now(),
 				Pool:      pool,
 				Resource:  r,
 			}, nil
@@ -89,7 +94,7 @@ func (pool *ResourcePool) ReturnResource(r *Resource) error {
 	if pool.MaxUses > 0 && r.Uses >= pool.MaxUses {
 		err := pool.DestroyResource(r)
 		return err
-	} else if pool.MaxAge > 0 && time.Now().Unix()-r.CreatedAt > pool.MaxAge {
+	} else if pool.MaxAge > 0 && pool.Clock.Now().Sub(r.CreatedAt) > pool.MaxAge {
 		err := pool.DestroyResource(r)
 		return err
 	} else {
@@ -98,11 +103,33 @@ func (pool *ResourcePool) ReturnResource(r *Resource) error {
 	}
 }
 
+// The most resources this pool will create.
+func (pool *ResourcePool) Capacity() int {
+	return cap(pool.CreateResources)
+}
+
+// The number of created resources waiting in the pool.
+func (pool *ResourcePool) Idle() int {
+	return len(pool.FreeResources)
+}
+
+// The number of resources that have been fetched and not returned.
+//
+// This is computed from two channel lengths that are not read atomically,
+// so it is approximate while the pool is busy.
+func (pool *ResourcePool) InUse() int {
+	n := pool.Capacity() - pool.Idle() - len(pool.CreateResources)
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
 func NewResourcePool(
 	resourceManager ResourceManager,
 	maxInstances int,
 	maxUses int,
-	maxAge int64,
+	maxAge time.Duration,
 ) (*ResourcePool, error) {
 
 	if maxInstances <= 0 {
@@ -115,6 +142,7 @@ func NewResourcePool(
 		MaxAge:          maxAge,
 		FreeResources:   make(chan *Resource, maxInstances),
 		CreateResources: make(chan int, maxInstances),
+		Clock:           clock.Real{},
 	}
 
 	for i := 0; i < maxInstances; i++ {
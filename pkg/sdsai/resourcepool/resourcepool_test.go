@@ -3,6 +3,9 @@ package resourcepool
 import (
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
 )
 
 type IntMaker struct {
@@ -33,7 +36,7 @@ func TestResourcePool(t *testing.T) {
 		&im,
 		2,
 		2,
-		2,
+		2*time.Second,
 	)
 
 	if err != nil {
@@ -101,3 +104,33 @@ func TestResourcePoolLoad(t *testing.T) {
 	im.Wg.Wait()
 
 }
+
+func TestResourcePoolMaxAge(t *testing.T) {
+	im := IntMaker{}
+
+	pool, err := NewResourcePool(&im, 1, 0, time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	pool.Clock = clk
+
+	r, _ := pool.GetResource()
+	clk.Advance(time.Minute)
+	r.Close()
+
+	if pool.Idle() != 1 {
+		t.Errorf("Expected 1 but found %d.", pool.Idle())
+	}
+
+	r, _ = pool.GetResource()
+	clk.Advance(time.Second)
+	im.Wg.Add(1)
+	r.Close()
+	im.Wg.Wait()
+
+	if pool.Idle() != 0 {
+		t.Errorf("Expected 0 but found %d.", pool.Idle())
+	}
+}
@@ -0,0 +1,463 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
+)
+
+// Default limits on what a client may send.
+const (
+	DefaultMaxBulkLength = 1024 * 1024
+	DefaultMaxArgs       = 1024
+	DefaultMaxLineLength = 64 * 1024
+)
+
+// Serves a subset of the Redis RESP2 protocol from a ConcurrentRingCache.
+//
+// Supported commands are GET, SET (with EX and PX), DEL, EXISTS, TTL,
+// MGET, MSET, FLUSHALL, INFO, PING and QUIT.
+type Server struct {
+	// Counted here rather than by the cache, which cannot tell that an
+	// entry expired by EX or PX is missing. First for 64-bit alignment.
+	hits        uint64
+	misses      uint64
+	expiredKeys uint64
+
+	Cache *cache.ConcurrentRingCache
+
+	// Used for key expiration.
+	Clock clock.Clock
+
+	// The longest bulk string, the most arguments in one command and the
+	// longest line a client may send. Zero means the default.
+	//
+	// Bulk strings are read as their bytes arrive, so a client must send a
+	// value to make the server hold it.
+	MaxBulkLength int
+	MaxArgs       int
+	MaxLineLength int
+}
+
+// What is stored in the cache for each key.
+type entry struct {
+	value []byte
+
+	// When the key expires. The zero time means never.
+	expiresAt time.Time
+
+	// Set to 1 once the entry has been counted as expired.
+	expired uint32
+}
+
+// Create a server for the cache. Stats are enabled on the cache so INFO can report them.
+func NewServer(c *cache.ConcurrentRingCache) *Server {
+	c.EnableStats()
+
+	return &Server{
+		Cache: c,
+		Clock: clock.Real{},
+	}
+}
+
+// Accept connections until the listener is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			s.ServeConn(conn)
+		}()
+	}
+}
+
+// Read commands from the connection and write replies until the client
+// quits or an error occurs.
+func (s *Server) ServeConn(conn io.ReadWriter) error {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		args, err := s.readCommand(r)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			writeError(w, err.Error())
+			w.Flush()
+			return err
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.execute(w, args)
+
+		// Only flush once all pipelined commands have been answered.
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+
+		if quit {
+			return nil
+		}
+	}
+}
+
+// Run one command. Returns true if the connection should be closed.
+func (s *Server) execute(w *bufio.Writer, args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			writeBulk(w, args[0])
+		} else {
+			writeSimple(w, "PONG")
+		}
+	case "QUIT":
+		writeSimple(w, "OK")
+		return true
+	case "GET":
+		if len(args) != 1 {
+			writeArgCountError(w, name)
+			break
+		}
+		writeBulk(w, s.get(string(args[0])))
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		if len(args) < 1 {
+			writeArgCountError(w, name)
+			break
+		}
+		n := 0
+		for _, k := range args {
+			if v, ok := s.Cache.Remove(string(k)); ok && s.live(v.(*entry)) {
+				n++
+			}
+		}
+		writeInt(w, int64(n))
+	case "EXISTS":
+		if len(args) < 1 {
+			writeArgCountError(w, name)
+			break
+		}
+		n := 0
+		for _, k := range args {
+			if s.get(string(k)) != nil {
+				n++
+			}
+		}
+		writeInt(w, int64(n))
+	case "TTL":
+		if len(args) != 1 {
+			writeArgCountError(w, name)
+			break
+		}
+		writeInt(w, s.ttl(string(args[0])))
+	case "MGET":
+		if len(args) < 1 {
+			writeArgCountError(w, name)
+			break
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, k := range args {
+			writeBulk(w, s.get(string(k)))
+		}
+	case "MSET":
+		if len(args) < 2 || len(args)%2 != 0 {
+			writeArgCountError(w, name)
+			break
+		}
+		for i := 0; i < len(args); i += 2 {
+			s.put(string(args[i]), args[i+1], time.Time{})
+		}
+		writeSimple(w, "OK")
+	case "FLUSHALL":
+		s.Cache.Clear()
+		writeSimple(w, "OK")
+	case "INFO":
+		writeBulk(w, []byte(s.info()))
+	default:
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", name))
+	}
+
+	return false
+}
+
+// SET key value [EX seconds | PX milliseconds]
+func (s *Server) set(w *bufio.Writer, args [][]byte) {
+	if len(args) != 2 && len(args) != 4 {
+		writeArgCountError(w, "SET")
+		return
+	}
+
+	var expiresAt time.Time
+	if len(args) == 4 {
+		var unit time.Duration
+		switch strings.ToUpper(string(args[2])) {
+		case "EX":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+
+		// Reject times that overflow a time.Duration, as Redis does.
+		n, err := strconv.ParseInt(string(args[3]), 10, 64)
+		if err != nil || n <= 0 || n > math.MaxInt64/int64(unit) {
+			writeError(w, "ERR invalid expire time in 'set' command")
+			return
+		}
+
+		expiresAt = s.Clock.Now().Add(time.Duration(n) * unit)
+	}
+
+	s.put(string(args[0]), args[1], expiresAt)
+	writeSimple(w, "OK")
+}
+
+func (s *Server) put(key string, value []byte, expiresAt time.Time) {
+	s.Cache.Put(key, &entry{value: value, expiresAt: expiresAt})
+	s.Cache.EnforceSizeLimit()
+}
+
+// Return the value of a key or nil if it is missing or expired.
+// This counts as a keyspace hit or miss.
+func (s *Server) get(key string) []byte {
+	if e := s.lookup(key); e != nil {
+		atomic.AddUint64(&s.hits, 1)
+		return e.value
+	}
+
+	atomic.AddUint64(&s.misses, 1)
+	return nil
+}
+
+// Return the entry for a key or nil if it is missing or expired.
+//
+// Expired entries are left in place, since removing one here could remove
+// a value a concurrent SET just stored. They are replaced by the next SET
+// or evicted by the cache.
+func (s *Server) lookup(key string) *entry {
+	v, ok := s.Cache.Get(key)
+	if !ok {
+		return nil
+	}
+
+	e := v.(*entry)
+	if !s.live(e) {
+		return nil
+	}
+
+	return e
+}
+
+// Report whether an entry has not expired. An expired entry is counted
+// in expired_keys the first time it is found.
+func (s *Server) live(e *entry) bool {
+	if e.expiresAt.IsZero() || s.Clock.Now().Before(e.expiresAt) {
+		return true
+	}
+
+	if atomic.CompareAndSwapUint32(&e.expired, 0, 1) {
+		atomic.AddUint64(&s.expiredKeys, 1)
+	}
+
+	return false
+}
+
+// Seconds until the key expires, -1 if it never expires or -2 if it does not exist.
+func (s *Server) ttl(key string) int64 {
+	e := s.lookup(key)
+	if e == nil {
+		return -2
+	}
+
+	if e.expiresAt.IsZero() {
+		return -1
+	}
+
+	// Round up, as Redis does, so a key with time left never reports 0.
+	return int64((e.expiresAt.Sub(s.Clock.Now()) + time.Second - 1) / time.Second)
+}
+
+// As in Redis, evicted_keys counts only keys dropped to make room.
+// expired_keys counts keys expired by EX or PX and by the cache's AgeLimit.
+func (s *Server) info() string {
+	st := s.Cache.MergedStats()
+
+	hits := atomic.LoadUint64(&s.hits)
+	misses := atomic.LoadUint64(&s.misses)
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+
+	return fmt.Sprintf(
+		"# Stats\r\nkeyspace_hits:%d\r\nkeyspace_misses:%d\r\nevicted_keys:%d\r\n"+
+			"expired_keys:%d\r\nhit_ratio:%.4f\r\n"+
+			"# Keyspace\r\nkeys:%d\r\nshards:%d\r\n",
+		hits, misses, st.Evictions[cache.EvictionSize], atomic.LoadUint64(&s.expiredKeys)+uint64(st.Expirations()),
+		ratio, s.Cache.Size(), s.Cache.RingSize)
+}
+
+// Return the limit, or the default if it is not set.
+func limit(n, def int) int {
+	if n <= 0 {
+		return def
+	}
+
+	return n
+}
+
+// Read a RESP array of bulk strings or an inline command.
+func (s *Server) readCommand(r *bufio.Reader) ([][]byte, error) {
+	maxLine := limit(s.MaxLineLength, DefaultMaxLineLength)
+
+	line, err := readLine(r, maxLine)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		fields := strings.Fields(string(line))
+		args := make([][]byte, len(fields))
+		for i, f := range fields {
+			args[i] = []byte(f)
+		}
+		return args, nil
+	}
+
+	n, err := parseLength(line[1:], limit(s.MaxArgs, DefaultMaxArgs))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r, maxLine)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("ERR Protocol error: expected '$'")
+		}
+
+		l, err := parseLength(line[1:], limit(s.MaxBulkLength, DefaultMaxBulkLength))
+		if err != nil {
+			return nil, err
+		}
+
+		// Grow the buffer as the bytes arrive rather than trusting the length.
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(l+2)); err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		b := buf.Bytes()
+		if b[l] != '\r' || b[l+1] != '\n' {
+			return nil, errors.New("ERR Protocol error: bad bulk string terminator")
+		}
+
+		args = append(args, b[:l])
+	}
+
+	return args, nil
+}
+
+// Read a line of at most max bytes and strip the \r\n.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > max+2 {
+			return nil, errors.New("ERR Protocol error: too big line")
+		}
+		line = append(line, chunk...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		break
+	}
+
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	return line, nil
+}
+
+func parseLength(b []byte, max int) (int, error) {
+	n, err := strconv.Atoi(string(b))
+	if err != nil || n < 0 || n > max {
+		return 0, errors.New("ERR Protocol error: invalid length")
+	}
+
+	return n, nil
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func writeArgCountError(w *bufio.Writer, name string) {
+	writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+func writeInt(w *bufio.Writer, n int64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+// Write a bulk string. A nil value is written as the null bulk string.
+func writeBulk(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+
+	fmt.Fprintf(w, "$%d\r\n", len(b))
+	w.Write(b)
+	w.WriteString("\r\n")
+}
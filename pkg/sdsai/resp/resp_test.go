@@ -0,0 +1,168 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
+)
+
+func TestServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	clk := clock.NewFake(time.Unix(1000, 0))
+	server := NewServer(cache.NewConcurrentRingCache(4, 100, -1))
+	server.Clock = clk
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	// Send a command as a RESP array and compare the raw reply.
+	do := func(expected string, args ...string) {
+		t.Helper()
+
+		cmd := "*" + strconv.Itoa(len(args)) + "\r\n"
+		for _, a := range args {
+			cmd += "$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n"
+		}
+		conn.Write([]byte(cmd))
+
+		reply := ""
+		for len(reply) < len(expected) {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply += line
+		}
+
+		if reply != expected {
+			t.Errorf("%v: expected %q but got %q", args, expected, reply)
+		}
+	}
+
+	do("+PONG\r\n", "PING")
+	do("$-1\r\n", "GET", "a")
+	do("+OK\r\n", "SET", "a", "1")
+	do("$1\r\n1\r\n", "GET", "a")
+	do("+OK\r\n", "SET", "b", "two\r\nlines", "EX", "10")
+	do("$10\r\ntwo\r\nlines\r\n", "GET", "b")
+	do(":10\r\n", "TTL", "b")
+	do(":-1\r\n", "TTL", "a")
+	do(":-2\r\n", "TTL", "c")
+	do("+OK\r\n", "SET", "c", "3", "PX", "1500")
+	do(":2\r\n", "TTL", "c")
+	clk.Advance(2 * time.Second)
+	do("$-1\r\n", "GET", "c")
+	do(":2\r\n", "EXISTS", "a", "b", "c")
+	do("+OK\r\n", "MSET", "x", "X", "y", "Y")
+	do("*3\r\n$1\r\nX\r\n$-1\r\n$1\r\nY\r\n", "MGET", "x", "nope", "y")
+	do(":2\r\n", "DEL", "x", "y", "nope")
+	do("-ERR wrong number of arguments for 'get' command\r\n", "GET")
+	do("-ERR syntax error\r\n", "SET", "a", "1", "ZZ", "1")
+	do("-ERR invalid expire time in 'set' command\r\n", "SET", "a", "1", "EX", "9223372036854775807")
+	do("-ERR unknown command 'BOGUS'\r\n", "BOGUS")
+	do("+OK\r\n", "FLUSHALL")
+	do(":0\r\n", "EXISTS", "a", "b")
+
+	// Inline commands work too.
+	conn.Write([]byte("PING\r\n"))
+	if line, _ := r.ReadString('\n'); line != "+PONG\r\n" {
+		t.Errorf("Unexpected inline reply %q.", line)
+	}
+
+	conn.Write([]byte("*1\r\n$4\r\nINFO\r\n"))
+	header, _ := r.ReadString('\n')
+	n, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+	if err != nil {
+		t.Fatalf("Unexpected INFO reply %q.", header)
+	}
+	info := make([]byte, n+2)
+	if _, err := io.ReadFull(r, info); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(info), "evicted_keys:0\r\n") {
+		t.Errorf("Unexpected INFO %q.", info)
+	}
+
+	// The expired c is a miss, counted as expired once however often it is read.
+	if !strings.Contains(string(info), "keyspace_hits:6\r\nkeyspace_misses:6\r\n") ||
+		!strings.Contains(string(info), "expired_keys:1\r\n") {
+		t.Errorf("Unexpected INFO %q.", info)
+	}
+}
+
+// Reads a canned request and collects the reply.
+type conversation struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func (c *conversation) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+func TestServerLimits(t *testing.T) {
+	server := NewServer(cache.NewConcurrentRingCache(4, 100, -1))
+	server.MaxBulkLength = 4
+	server.MaxArgs = 2
+	server.MaxLineLength = 16
+
+	for _, tc := range []struct {
+		request string
+		reply   string
+	}{
+		{"*3\r\n", "-ERR Protocol error: invalid length\r\n"},
+		{"*1\r\n$5\r\n", "-ERR Protocol error: invalid length\r\n"},
+		{"*536870912\r\n", "-ERR Protocol error: invalid length\r\n"},
+		{"$536870912\r\n", "-ERR unknown command '$536870912'\r\n"},
+		{strings.Repeat("P", 17) + "\r\n", "-ERR Protocol error: too big line\r\n"},
+		{"*1\r\n$4\r\nPING\r\n", "+PONG\r\n"},
+		{strings.Repeat("P", 16) + "\r\n", "-ERR unknown command '" + strings.Repeat("P", 16) + "'\r\n"},
+	} {
+		c := &conversation{Reader: strings.NewReader(tc.request)}
+		server.ServeConn(c)
+
+		if c.String() != tc.reply {
+			t.Errorf("%q: expected %q but got %q", tc.request, tc.reply, c.String())
+		}
+	}
+
+	// A declared length that the client never sends is not allocated up front.
+	c := &conversation{Reader: strings.NewReader("*1\r\n$4\r\nPI")}
+	if err := server.ServeConn(c); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF but found %v.", err)
+	}
+}
+
+func TestLookupLeavesExpiredEntries(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	server := NewServer(cache.NewConcurrentRingCache(4, 100, -1))
+	server.Clock = clk
+
+	server.put("a", []byte("old"), clk.Now())
+
+	if v := server.get("a"); v != nil {
+		t.Errorf("Expected a miss but found %q.", v)
+	}
+	if server.Cache.Size() != 1 {
+		t.Errorf("Expected 1 item but found %d.", server.Cache.Size())
+	}
+}
@@ -0,0 +1,368 @@
+package semaphore
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
+)
+
+// A weighted semaphore that grants permits to the highest priority waiter
+// first. Waiters of equal priority are served in the order they arrived.
+//
+// So that low priority work is not starved forever, a waiter gains one
+// priority level for every AgingInterval it waits. As with Semaphore, a
+// waiter asking for more permits than are available holds back those
+// behind it, and DownContext and DownTimeout refuse a request that could
+// never be granted.
+type PrioritySemaphore struct {
+	// Updated atomically while holding lock, so they may be read without it.
+	// The level goes negative if the capacity shrinks below what is in use.
+	level    int32
+	capacity int32
+	waiters  int32
+
+	lock  sync.Mutex
+	queue priorityQueue
+
+	// The number of waiters at each priority they asked for.
+	waiting map[int]int
+
+	// Breaks ties between waiters, oldest first.
+	seq uint64
+
+	// How long a waiter waits to gain one priority level. 0 disables aging.
+	// Changing this affects only waiters that arrive afterwards.
+	// Priorities so large that aging them would overflow are clamped.
+	AgingInterval time.Duration
+
+	// Times aging and DownTimeout. If nil, the system clock is used.
+	Clock clock.Clock
+}
+
+// A caller blocked in PrioritySemaphore.Down.
+type priorityWaiter struct {
+	waiter
+
+	priority int
+
+	// Waiters with larger ranks are served first. Aging is folded in when
+	// the waiter arrives, so the rank never changes while it waits.
+	rank int64
+	seq  uint64
+
+	// The position in the queue, maintained by the heap.
+	index int
+}
+
+// A heap of waiters, highest rank first.
+type priorityQueue []*priorityWaiter
+
+func (q priorityQueue) Len() int {
+	return len(q)
+}
+
+func (q priorityQueue) Less(i, j int) bool {
+	if q[i].rank != q[j].rank {
+		return q[i].rank > q[j].rank
+	}
+
+	return q[i].seq < q[j].seq
+}
+
+func (q priorityQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *priorityQueue) Push(x interface{}) {
+	w := x.(*priorityWaiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *priorityQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return w
+}
+
+// Create a semaphore with the given number of permits and aging interval.
+func NewPrioritySemaphore(level int32, agingInterval time.Duration) *PrioritySemaphore {
+	return &PrioritySemaphore{
+		level:         level,
+		capacity:      level,
+		waiting:       make(map[int]int),
+		AgingInterval: agingInterval,
+		Clock:         clock.Real{},
+	}
+}
+
+// Wait for and take diff permits. Larger priorities are served first.
+func (s *PrioritySemaphore) Down(diff int32, priority int) {
+	s.down(diff, priority, nil, false)
+}
+
+// Like Down, but give up and return the context's error if it is done first.
+// No permits are taken if an error is returned. A request that could never
+// be granted returns ErrTooManyPermits.
+func (s *PrioritySemaphore) DownContext(ctx context.Context, diff int32, priority int) error {
+	return gaveUp(s.down(diff, priority, ctx.Done(), true), ctx.Err)
+}
+
+// Like Down, but give up and return ErrTimeout if the permits are not
+// available within d. No permits are taken if an error is returned.
+// A request that could never be granted returns ErrTooManyPermits.
+func (s *PrioritySemaphore) DownTimeout(diff int32, priority int, d time.Duration) error {
+	if s.TryDown(diff, priority) {
+		return nil
+	}
+
+	done, stop := timeout(getClock(s.Clock), d)
+	defer stop()
+
+	return gaveUp(s.down(diff, priority, done, true), func() error { return ErrTimeout })
+}
+
+// The largest priority, in either direction, that is aged without
+// overflow. Half the range is left for the arrival time.
+func (s *PrioritySemaphore) maxAgedPriority() int64 {
+	return math.MaxInt64 / 2 / int64(s.AgingInterval)
+}
+
+// The rank of a waiter of the given priority arriving at now.
+//
+// Every waiter gains a level per AgingInterval, so the waiter that is
+// ahead stays ahead. Only the time it arrived must be counted.
+func (s *PrioritySemaphore) rank(priority int, now time.Time) int64 {
+	if s.AgingInterval <= 0 {
+		return int64(priority)
+	}
+
+	p := int64(priority)
+	if max := s.maxAgedPriority(); p > max {
+		p = max
+	} else if p < -max {
+		p = -max
+	}
+
+	return p*int64(s.AgingInterval) - now.UnixNano()
+}
+
+// Wait for diff permits and take them, returning nil, or return errGaveUp
+// once done is closed. A nil done waits forever. If refusable is false, a
+// request that could never be granted waits too.
+func (s *PrioritySemaphore) down(diff int32, priority int, done <-chan struct{}, refusable bool) error {
+	s.lock.Lock()
+
+	if refusable && !fits(diff, s.capacity, s.level) {
+		s.lock.Unlock()
+		return ErrTooManyPermits
+	}
+
+	if s.queue.Len() == 0 && s.level >= diff {
+		atomic.AddInt32(&s.level, -diff)
+		s.lock.Unlock()
+		return nil
+	}
+
+	select {
+	case <-done:
+		s.lock.Unlock()
+		return errGaveUp
+	default:
+	}
+
+	w := &priorityWaiter{
+		waiter:   waiter{diff: diff, ready: make(chan struct{}), refusable: refusable},
+		priority: priority,
+		rank:     s.rank(priority, getClock(s.Clock).Now()),
+		seq:      s.seq,
+	}
+	s.seq++
+
+	if s.waiting == nil {
+		s.waiting = make(map[int]int)
+	}
+
+	heap.Push(&s.queue, w)
+	s.waiting[priority]++
+	atomic.AddInt32(&s.waiters, 1)
+
+	// This waiter may outrank one that does not fit.
+	s.grant()
+
+	s.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		return w.err
+	case <-done:
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		// The permits were granted as we gave up. Keep them.
+		return w.err
+	default:
+	}
+
+	front := w.index == 0
+	heap.Remove(&s.queue, w.index)
+	s.dequeued(w)
+
+	// The next waiter may fit in the permits we were waiting for.
+	if front {
+		s.grant()
+	}
+
+	return errGaveUp
+}
+
+// Account for a waiter leaving the queue. The caller must hold the lock.
+func (s *PrioritySemaphore) dequeued(w *priorityWaiter) {
+	if s.waiting[w.priority]--; s.waiting[w.priority] == 0 {
+		delete(s.waiting, w.priority)
+	}
+	atomic.AddInt32(&s.waiters, -1)
+}
+
+// Give permits to waiters, highest rank first, until one asks for more
+// than are available. The caller must hold the lock.
+func (s *PrioritySemaphore) grant() {
+	for s.queue.Len() > 0 {
+		w := s.queue[0]
+		if s.level < w.diff {
+			return
+		}
+
+		atomic.AddInt32(&s.level, -w.diff)
+		heap.Pop(&s.queue)
+		s.dequeued(w)
+		close(w.ready)
+	}
+}
+
+// Return true if the down succeeds.
+//
+// This fails if a waiter would be served before a Down of this priority,
+// even if there are enough permits.
+func (s *PrioritySemaphore) TryDown(diff int32, priority int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.level < diff {
+		return false
+	}
+
+	if s.queue.Len() > 0 && s.queue[0].rank >= s.rank(priority, getClock(s.Clock).Now()) {
+		return false
+	}
+
+	atomic.AddInt32(&s.level, -diff)
+	return true
+}
+
+func (s *PrioritySemaphore) Up(diff int32) {
+	s.lock.Lock()
+	atomic.AddInt32(&s.level, diff)
+	s.grant()
+	s.lock.Unlock()
+}
+
+// The permits available now. This is negative while more permits are in
+// use than a reduced capacity allows.
+func (s *PrioritySemaphore) GetLevel() int32 {
+	return atomic.LoadInt32(&s.level)
+}
+
+// Change the total number of permits while they may be held.
+//
+// As with Semaphore.SetCapacity, waiters in DownContext or DownTimeout
+// asking for more than the new capacity are refused with ErrTooManyPermits.
+func (s *PrioritySemaphore) SetCapacity(capacity int32) error {
+	if capacity < 0 {
+		return ErrNegativeCapacity
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	diff := capacity - s.capacity
+	atomic.StoreInt32(&s.capacity, capacity)
+	atomic.AddInt32(&s.level, diff)
+
+	kept := s.queue[:0]
+	for _, w := range s.queue {
+		if !w.refusable || fits(w.diff, capacity, s.level) {
+			kept = append(kept, w)
+		} else {
+			s.dequeued(w)
+			w.refuse()
+		}
+	}
+	for i := len(kept); i < len(s.queue); i++ {
+		s.queue[i] = nil
+	}
+	s.queue = kept
+	for i, w := range s.queue {
+		w.index = i
+	}
+	heap.Init(&s.queue)
+
+	s.grant()
+
+	return nil
+}
+
+// The total number of permits, given to the constructor or SetCapacity.
+func (s *PrioritySemaphore) GetCapacity() int32 {
+	return atomic.LoadInt32(&s.capacity)
+}
+
+// The number of permits taken and not yet returned. Up does not check that
+// it returns permits that were taken, so callers that Up more than they Down
+// will see this go negative.
+func (s *PrioritySemaphore) InUse() int32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.capacity - s.level
+}
+
+// The number of callers blocked in Down.
+func (s *PrioritySemaphore) Waiters() int32 {
+	return atomic.LoadInt32(&s.waiters)
+}
+
+// The number of callers blocked in Down with the given priority.
+func (s *PrioritySemaphore) Waiting(priority int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.waiting[priority]
+}
+
+// A copy of the number of callers blocked in Down at each priority.
+// Priorities with no waiters are left out.
+func (s *PrioritySemaphore) WaitingByPriority() map[int]int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m := make(map[int]int, len(s.waiting))
+	for p, n := range s.waiting {
+		m[p] = n
+	}
+
+	return m
+}
@@ -0,0 +1,280 @@
+package semaphore
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
+)
+
+// Start a goroutine that takes diff permits at a priority and then sends id.
+// Return once it is waiting.
+func downWithPriority(s *PrioritySemaphore, id int, diff int32, priority int, order chan int) {
+	waiters := s.Waiters()
+	go func() {
+		s.Down(diff, priority)
+		order <- id
+	}()
+
+	for s.Waiters() != waiters+1 {
+		runtime.Gosched()
+	}
+}
+
+func TestPrioritySemaphore(t *testing.T) {
+	s := NewPrioritySemaphore(0, 0)
+	order := make(chan int, 4)
+
+	downWithPriority(s, 0, 1, 0, order)
+	downWithPriority(s, 1, 1, 10, order)
+	downWithPriority(s, 2, 1, 5, order)
+	downWithPriority(s, 3, 1, 10, order)
+
+	waiting := s.WaitingByPriority()
+	if len(waiting) != 3 || waiting[0] != 1 || waiting[5] != 1 || waiting[10] != 2 {
+		t.Errorf("Unexpected waiting counts %v.", waiting)
+	}
+
+	// Highest priority first, then in arrival order.
+	for _, expected := range []int{1, 3, 2, 0} {
+		s.Up(1)
+		if id := <-order; id != expected {
+			t.Errorf("Expected waiter %d but found %d.", expected, id)
+		}
+	}
+
+	if s.Waiters() != 0 || s.Waiting(10) != 0 {
+		t.Errorf("Expected no waiters but found %d.", s.Waiters())
+	}
+}
+
+func TestPrioritySemaphoreLargeRequest(t *testing.T) {
+	s := NewPrioritySemaphore(0, 0)
+	order := make(chan int, 2)
+
+	downWithPriority(s, 0, 2, 10, order)
+	downWithPriority(s, 1, 1, 0, order)
+
+	// The lower priority waiter may not take the permit the other needs.
+	s.Up(1)
+	if s.Waiters() != 2 {
+		t.Errorf("Expected 2 waiters but found %d.", s.Waiters())
+	}
+
+	if s.TryDown(1, 5) {
+		t.Error("TryDown should not pass a higher priority waiter.")
+	}
+
+	if !s.TryDown(1, 20) {
+		t.Error("TryDown should pass a lower priority waiter.")
+	}
+
+	s.Up(3)
+	<-order
+	<-order
+
+	if s.GetLevel() != 0 {
+		t.Errorf("Expected level 0 but found %d.", s.GetLevel())
+	}
+}
+
+func TestPrioritySemaphoreAging(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	s := NewPrioritySemaphore(0, time.Second)
+	s.Clock = clk
+	order := make(chan int, 3)
+
+	downWithPriority(s, 0, 1, 0, order)
+
+	// Three levels up, but four intervals later.
+	clk.Advance(4 * time.Second)
+	downWithPriority(s, 1, 1, 3, order)
+
+	// Six levels up and five intervals later still wins.
+	clk.Advance(time.Second)
+	downWithPriority(s, 2, 1, 6, order)
+
+	for _, expected := range []int{2, 0, 1} {
+		s.Up(1)
+		if id := <-order; id != expected {
+			t.Errorf("Expected waiter %d but found %d.", expected, id)
+		}
+	}
+}
+
+func TestPrioritySemaphoreCancel(t *testing.T) {
+	s := NewPrioritySemaphore(2, 0)
+	s.Down(1, 0)
+	order := make(chan int, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		cancelled <- s.DownContext(ctx, 2, 10)
+	}()
+
+	for s.Waiters() != 1 {
+		runtime.Gosched()
+	}
+
+	downWithPriority(s, 0, 1, 0, order)
+
+	// The permit the first waiter could not use goes to the one behind it.
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("Expected context.Canceled but found %v.", err)
+	}
+
+	select {
+	case <-order:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The waiter behind the cancelled one was never woken.")
+	}
+
+	if s.Waiting(10) != 0 || s.Waiters() != 0 {
+		t.Errorf("Expected no waiters but found %d.", s.Waiters())
+	}
+}
+
+func TestPrioritySemaphoreDownTimeout(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	s := NewPrioritySemaphore(0, 0)
+	s.Clock = clk
+
+	result := make(chan error)
+	go func() {
+		result <- s.DownTimeout(1, 0, time.Second)
+	}()
+
+	for s.Waiters() != 1 || clk.Timers() != 1 {
+		runtime.Gosched()
+	}
+
+	clk.Advance(time.Second)
+
+	if err := <-result; err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout but found %v.", err)
+	}
+}
+
+func TestPrioritySemaphoreSetCapacity(t *testing.T) {
+	s := NewPrioritySemaphore(2, 0)
+	s.Down(2, 0)
+
+	s.SetCapacity(1)
+	if s.GetCapacity() != 1 || s.GetLevel() != -1 || s.InUse() != 2 {
+		t.Errorf("Expected capacity 1, level -1 and 2 in use but found %d, %d and %d.", s.GetCapacity(), s.GetLevel(), s.InUse())
+	}
+
+	order := make(chan int, 1)
+	downWithPriority(s, 0, 1, 0, order)
+
+	s.Up(1)
+	if s.Waiters() != 1 {
+		t.Errorf("Expected 1 waiter but found %d.", s.Waiters())
+	}
+
+	s.SetCapacity(2)
+	<-order
+
+	if s.InUse() != 2 {
+		t.Errorf("Expected 2 in use but found %d.", s.InUse())
+	}
+}
+
+func TestPrioritySemaphoreExtremePriorities(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	s := NewPrioritySemaphore(0, time.Second)
+	s.Clock = clk
+	order := make(chan int, 3)
+
+	downWithPriority(s, 0, 1, 0, order)
+	downWithPriority(s, 1, 1, math.MinInt64, order)
+	downWithPriority(s, 2, 1, math.MaxInt64, order)
+
+	// Aging these must not wrap them around to the other end.
+	for _, expected := range []int{2, 0, 1} {
+		s.Up(1)
+		if id := <-order; id != expected {
+			t.Errorf("Expected waiter %d but found %d.", expected, id)
+		}
+	}
+}
+
+func TestPrioritySemaphoreTooManyPermits(t *testing.T) {
+	s := NewPrioritySemaphore(2, 0)
+
+	if err := s.DownTimeout(3, 0, time.Second); err != ErrTooManyPermits {
+		t.Errorf("Expected ErrTooManyPermits but found %v.", err)
+	}
+
+	// Permits added by Up may be taken even beyond the capacity.
+	s.Up(1)
+	s.Down(3, 0)
+	s.Up(2)
+
+	// Free permits are taken without a timer.
+	clk := clock.NewFake(time.Unix(0, 0))
+	s.Clock = clk
+	if err := s.DownTimeout(2, 0, time.Second); err != nil || clk.Timers() != 0 {
+		t.Errorf("Expected no error and no timers but found %v and %d.", err, clk.Timers())
+	}
+}
+
+func TestPrioritySemaphoreZeroValue(t *testing.T) {
+	var s PrioritySemaphore
+
+	if err := s.DownTimeout(1, 0, time.Millisecond); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout but found %v.", err)
+	}
+
+	s.Up(1)
+	if err := s.DownTimeout(1, 0, time.Millisecond); err != nil {
+		t.Errorf("Expected no error but found %v.", err)
+	}
+}
+
+func TestPrioritySemaphoreShrinkRefusesWaiters(t *testing.T) {
+	s := NewPrioritySemaphore(4, 0)
+	s.Down(4, 0)
+
+	if err := s.SetCapacity(-1); err != ErrNegativeCapacity || s.GetCapacity() != 4 {
+		t.Errorf("Expected ErrNegativeCapacity and capacity 4 but found %v and %d.", err, s.GetCapacity())
+	}
+
+	refused := make(chan error)
+	go func() {
+		refused <- s.DownContext(context.Background(), 3, 10)
+	}()
+
+	for s.Waiters() != 1 {
+		runtime.Gosched()
+	}
+
+	order := make(chan int, 2)
+	downWithPriority(s, 0, 1, 0, order)
+	downWithPriority(s, 1, 2, 5, order)
+
+	s.SetCapacity(2)
+	if err := <-refused; err != ErrTooManyPermits {
+		t.Errorf("Expected ErrTooManyPermits but found %v.", err)
+	}
+
+	if s.Waiters() != 2 || s.Waiting(10) != 0 {
+		t.Errorf("Expected 2 waiters and none at 10 but found %d and %d.", s.Waiters(), s.Waiting(10))
+	}
+
+	// The rest are still served by priority.
+	s.Up(4)
+	if id := <-order; id != 1 {
+		t.Errorf("Expected waiter 1 but found %d.", id)
+	}
+
+	s.Up(2)
+	if id := <-order; id != 0 {
+		t.Errorf("Expected waiter 0 but found %d.", id)
+	}
+}
@@ -1,57 +1,295 @@
 package semaphore
 
 import (
+	"container/list"
+	"context"
+	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
 )
 
+// Returned by DownTimeout when the permits are not available in time.
+var ErrTimeout = errors.New("Timed out waiting for the semaphore.")
+
+// Returned when a caller asks for more permits than the capacity, which
+// could never be granted.
+var ErrTooManyPermits = errors.New("Asked for more permits than the semaphore holds.")
+
+// Returned by SetCapacity when asked for fewer than no permits.
+var ErrNegativeCapacity = errors.New("The capacity may not be negative.")
+
+// Returned by down when done is closed.
+var errGaveUp = errors.New("Gave up waiting for the semaphore.")
+
+// A weighted semaphore that grants permits in the order they are asked for.
+//
+// A caller waiting for many permits is not passed by later callers asking
+// for fewer, so it is never starved. Up wakes every waiter at the front of
+// the line whose request can now be met.
+//
+// DownContext and DownTimeout refuse a request for more permits than the
+// capacity, or than Up has made available, rather than leave it to hold
+// back everyone behind it. Down waits for such a request as long as it
+// takes. A semaphore created with no permits is instead filled by Up, and
+// has no capacity to check against.
 type Semaphore struct {
-	level int32
-	cond  *sync.Cond
+	// Updated atomically while holding lock, so they may be read without it.
+	// The level goes negative if the capacity shrinks below what is in use.
+	level    int32
+	capacity int32
+	waiters  int32
+
+	lock sync.Mutex
+
+	// Callers waiting in Down, oldest first. Each element is a *waiter.
+	queue list.List
+
+	// Times DownTimeout. If nil, the system clock is used.
+	Clock clock.Clock
+}
+
+// A caller blocked in Down.
+type waiter struct {
+	diff int32
+
+	// Closed when the permits have been taken for this waiter, or when it
+	// is refused.
+	ready chan struct{}
+
+	// Why the waiter was refused. Set before ready is closed.
+	err error
+
+	// False for Down, which waits rather than be refused.
+	refusable bool
+}
+
+// Wake the waiter with ErrTooManyPermits.
+func (w *waiter) refuse() {
+	w.err = ErrTooManyPermits
+	close(w.ready)
+}
+
+// Report whether a request for diff permits could ever be granted.
+// Up may raise the level above the capacity, so either will do.
+func fits(diff, capacity, level int32) bool {
+	return capacity == 0 || diff <= capacity || diff <= level
+}
+
+// The clock, or the system clock if none is set.
+func getClock(clk clock.Clock) clock.Clock {
+	if clk == nil {
+		return clock.Real{}
+	}
+
+	return clk
 }
 
 func NewSemaphore(level int32) *Semaphore {
-	m := sync.Mutex{}
-	c := sync.NewCond(&m)
 	return &Semaphore{
-		level: level,
-		cond:  c,
+		level:    level,
+		capacity: level,
+		Clock:    clock.Real{},
 	}
 }
 
+// Wait for and take diff permits.
 func (s *Semaphore) Down(diff int32) {
-	s.cond.L.Lock()
-	var v int32
-	for v = atomic.LoadInt32(&s.level); v < diff; v = atomic.LoadInt32(&s.level) {
-		// Wait for an up.
-		s.cond.Wait()
+	s.down(diff, nil, false)
+}
+
+// Like Down, but give up and return the context's error if it is done first.
+// No permits are taken if an error is returned. A request that could never
+// be granted returns ErrTooManyPermits.
+func (s *Semaphore) DownContext(ctx context.Context, diff int32) error {
+	return gaveUp(s.down(diff, ctx.Done(), true), ctx.Err)
+}
+
+// Like Down, but give up and return ErrTimeout if the permits are not
+// available within d. No permits are taken if an error is returned.
+// A request that could never be granted returns ErrTooManyPermits.
+func (s *Semaphore) DownTimeout(diff int32, d time.Duration) error {
+	if s.TryDown(diff) {
+		return nil
+	}
+
+	done, stop := timeout(getClock(s.Clock), d)
+	defer stop()
+
+	return gaveUp(s.down(diff, done, true), func() error { return ErrTimeout })
+}
+
+// Replace errGaveUp from down with the reason the caller gave up.
+func gaveUp(err error, reason func() error) error {
+	if err == errGaveUp {
+		return reason()
+	}
+
+	return err
+}
+
+// Return a channel that is closed once d has passed on clk and a function
+// that stops the timer once it is no longer needed.
+func timeout(clk clock.Clock, d time.Duration) (<-chan struct{}, func()) {
+	done := make(chan struct{})
+	timer := clk.AfterFunc(d, func() { close(done) })
+
+	return done, func() { timer.Stop() }
+}
+
+// Wait for diff permits and take them, returning nil, or return errGaveUp
+// once done is closed. A nil done waits forever. If refusable is false, a
+// request that could never be granted waits too.
+func (s *Semaphore) down(diff int32, done <-chan struct{}, refusable bool) error {
+	s.lock.Lock()
+
+	if refusable && !fits(diff, s.capacity, s.level) {
+		s.lock.Unlock()
+		return ErrTooManyPermits
+	}
+
+	if s.queue.Len() == 0 && s.level >= diff {
+		atomic.AddInt32(&s.level, -diff)
+		s.lock.Unlock()
+		return nil
+	}
+
+	select {
+	case <-done:
+		s.lock.Unlock()
+		return errGaveUp
+	default:
 	}
 
-	atomic.StoreInt32(&s.level, v-diff)
+	w := &waiter{diff: diff, ready: make(chan struct{}), refusable: refusable}
+	e := s.queue.PushBack(w)
+	atomic.AddInt32(&s.waiters, 1)
 
-	s.cond.L.Unlock()
+	s.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		return w.err
+	case <-done:
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		// The permits were granted as we gave up. Keep them.
+		return w.err
+	default:
+	}
+
+	front := s.queue.Front() == e
+	s.queue.Remove(e)
+	atomic.AddInt32(&s.waiters, -1)
+
+	// Waiters behind us may fit in the permits we were waiting for.
+	if front {
+		s.grant()
+	}
+
+	return errGaveUp
+}
+
+// Give permits to waiters, oldest first, until one asks for more than
+// are available. The caller must hold the lock.
+func (s *Semaphore) grant() {
+	for e := s.queue.Front(); e != nil; e = s.queue.Front() {
+		w := e.Value.(*waiter)
+		if s.level < w.diff {
+			return
+		}
+
+		atomic.AddInt32(&s.level, -w.diff)
+		s.queue.Remove(e)
+		atomic.AddInt32(&s.waiters, -1)
+		close(w.ready)
+	}
 }
 
 // Return true if the down succeeds.
+//
+// This fails if other callers are waiting, even if there are enough permits.
 func (s *Semaphore) TryDown(diff int32) bool {
-	s.cond.L.Lock()
-	defer s.cond.L.Unlock()
-	if v := atomic.LoadInt32(&s.level); v >= diff {
-		atomic.StoreInt32(&s.level, v-diff)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.queue.Len() == 0 && s.level >= diff {
+		atomic.AddInt32(&s.level, -diff)
 		return true
 	} else {
 		return false
 	}
-
 }
 
 func (s *Semaphore) Up(diff int32) {
-	s.cond.L.Lock()
+	s.lock.Lock()
 	atomic.AddInt32(&s.level, diff)
-	s.cond.Signal()
-	s.cond.L.Unlock()
+	s.grant()
+	s.lock.Unlock()
 }
 
+// The permits available now. This is negative while more permits are in
+// use than a reduced capacity allows.
 func (s *Semaphore) GetLevel() int32 {
 	return atomic.LoadInt32(&s.level)
 }
+
+// Change the total number of permits while they may be held.
+//
+// Growing wakes waiters that now fit. Shrinking takes permits from those
+// available and the rest as they are returned by Up. Waiters in DownContext
+// or DownTimeout asking for more than the new capacity are refused with
+// ErrTooManyPermits. A capacity of 0 refuses no one.
+func (s *Semaphore) SetCapacity(capacity int32) error {
+	if capacity < 0 {
+		return ErrNegativeCapacity
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	diff := capacity - s.capacity
+	atomic.StoreInt32(&s.capacity, capacity)
+	atomic.AddInt32(&s.level, diff)
+
+	for e := s.queue.Front(); e != nil; {
+		next := e.Next()
+		if w := e.Value.(*waiter); w.refusable && !fits(w.diff, capacity, s.level) {
+			s.queue.Remove(e)
+			atomic.AddInt32(&s.waiters, -1)
+			w.refuse()
+		}
+		e = next
+	}
+
+	s.grant()
+
+	return nil
+}
+
+// The total number of permits, given to the constructor or SetCapacity.
+func (s *Semaphore) GetCapacity() int32 {
+	return atomic.LoadInt32(&s.capacity)
+}
+
+// The number of permits taken and not yet returned. Up does not check that
+// it returns permits that were taken, so callers that Up more than they Down
+// will see this go negative.
+func (s *Semaphore) InUse() int32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.capacity - s.level
+}
+
+// The number of callers blocked in Down.
+func (s *Semaphore) Waiters() int32 {
+	return atomic.LoadInt32(&s.waiters)
+}
@@ -1,8 +1,13 @@
 package semaphore
 
 import (
+	"context"
+	"runtime"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/clock"
 )
 
 func TestSemaphore(t *testing.T) {
@@ -28,6 +33,11 @@ func TestSemaphore(t *testing.T) {
 		t.Error("Failed.")
 	}
 
+	// Permits are granted in order, so the goroutine must be waiting first.
+	for s.Waiters() != 1 {
+		runtime.Gosched()
+	}
+
 	s.Up(5)
 	s.Down(10)
 	if !b {
@@ -49,3 +59,359 @@ func TestSemaphoreTryDown(t *testing.T) {
 		t.Error("TryDown should fail.")
 	}
 }
+
+func TestSemaphoreWaiters(t *testing.T) {
+	s := NewSemaphore(0)
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			s.Down(1)
+			wg.Done()
+		}()
+	}
+
+	for s.Waiters() != 2 {
+		runtime.Gosched()
+	}
+
+	s.Up(1)
+	s.Up(1)
+	wg.Wait()
+
+	if s.Waiters() != 0 {
+		t.Errorf("Expected 0 waiters but found %d.", s.Waiters())
+	}
+}
+
+func TestSemaphoreDownContext(t *testing.T) {
+	s := NewSemaphore(1)
+
+	if err := s.DownContext(context.Background(), 1); err != nil {
+		t.Errorf("Expected no error but found %v.", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	result := make(chan error)
+	go func() {
+		result <- s.DownContext(ctx, 1)
+	}()
+
+	for s.Waiters() != 1 {
+		runtime.Gosched()
+	}
+
+	cancel()
+
+	if err := <-result; err != context.Canceled {
+		t.Errorf("Expected context.Canceled but found %v.", err)
+	}
+
+	if s.Waiters() != 0 || s.GetLevel() != 0 {
+		t.Errorf("Expected 0 waiters and level 0 but found %d and %d.", s.Waiters(), s.GetLevel())
+	}
+
+	// A done context fails without waiting.
+	if err := s.DownContext(ctx, 1); err != context.Canceled {
+		t.Errorf("Expected context.Canceled but found %v.", err)
+	}
+}
+
+func TestSemaphoreDownTimeout(t *testing.T) {
+	s := NewSemaphore(0)
+	clk := clock.NewFake(time.Unix(0, 0))
+	s.Clock = clk
+
+	result := make(chan error)
+	go func() {
+		result <- s.DownTimeout(1, time.Second)
+	}()
+
+	for s.Waiters() != 1 || clk.Timers() != 1 {
+		runtime.Gosched()
+	}
+
+	clk.Advance(time.Second)
+
+	if err := <-result; err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout but found %v.", err)
+	}
+
+	s.Up(1)
+	if err := s.DownTimeout(1, time.Second); err != nil {
+		t.Errorf("Expected no error but found %v.", err)
+	}
+}
+
+func TestSemaphoreCancelKeepsWakeups(t *testing.T) {
+	s := NewSemaphore(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancelled := make(chan error)
+	go func() {
+		cancelled <- s.DownContext(ctx, 1)
+	}()
+
+	waiting := make(chan struct{})
+	go func() {
+		s.Down(1)
+		close(waiting)
+	}()
+
+	for s.Waiters() != 2 {
+		runtime.Gosched()
+	}
+
+	// The Up may wake the waiter that is giving up. It must pass it on.
+	s.Up(1)
+	cancel()
+
+	// Or the cancelled waiter may have taken the permit first.
+	if err := <-cancelled; err == nil {
+		s.Up(1)
+	}
+
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The remaining waiter was never woken.")
+	}
+
+	if s.GetLevel() != 0 {
+		t.Errorf("Expected level 0 but found %d.", s.GetLevel())
+	}
+}
+
+// Start a goroutine that takes diff permits and then sends id. Return once
+// it is waiting.
+func downInOrder(s *Semaphore, id int, diff int32, order chan int) {
+	waiters := s.Waiters()
+	go func() {
+		s.Down(diff)
+		order <- id
+	}()
+
+	for s.Waiters() != waiters+1 {
+		runtime.Gosched()
+	}
+}
+
+func TestSemaphoreFIFO(t *testing.T) {
+	s := NewSemaphore(0)
+	order := make(chan int, 3)
+
+	downInOrder(s, 0, 3, order)
+	downInOrder(s, 1, 1, order)
+	downInOrder(s, 2, 1, order)
+
+	// The small requests may not pass the large one.
+	s.Up(2)
+	if s.Waiters() != 3 {
+		t.Errorf("Expected 3 waiters but found %d.", s.Waiters())
+	}
+
+	// Permits are granted by Up, so the first waiter is served here.
+	s.Up(1)
+	if s.Waiters() != 2 || s.GetLevel() != 0 {
+		t.Errorf("Expected 2 waiters and level 0 but found %d and %d.", s.Waiters(), s.GetLevel())
+	}
+	if id := <-order; id != 0 {
+		t.Errorf("Expected waiter 0 but found %d.", id)
+	}
+
+	// One Up wakes every waiter it can.
+	s.Up(2)
+	if s.Waiters() != 0 || s.GetLevel() != 0 {
+		t.Errorf("Expected 0 waiters and level 0 but found %d and %d.", s.Waiters(), s.GetLevel())
+	}
+	<-order
+	<-order
+
+	// Nor may TryDown pass a waiter.
+	downInOrder(s, 3, 2, order)
+	s.Up(1)
+	if s.TryDown(1) {
+		t.Error("TryDown should not pass a waiter.")
+	}
+	s.Up(1)
+	if id := <-order; id != 3 {
+		t.Errorf("Expected waiter 3 but found %d.", id)
+	}
+}
+
+func TestSemaphoreCancelWakesNext(t *testing.T) {
+	s := NewSemaphore(2)
+	s.Down(1)
+	order := make(chan int, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		cancelled <- s.DownContext(ctx, 2)
+	}()
+
+	for s.Waiters() != 1 {
+		runtime.Gosched()
+	}
+
+	downInOrder(s, 0, 1, order)
+
+	// The permit the first waiter could not use goes to the one behind it.
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("Expected context.Canceled but found %v.", err)
+	}
+
+	select {
+	case <-order:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The waiter behind the cancelled one was never woken.")
+	}
+}
+
+func TestSemaphoreSetCapacity(t *testing.T) {
+	s := NewSemaphore(4)
+	s.Down(3)
+
+	if s.GetCapacity() != 4 || s.InUse() != 3 {
+		t.Errorf("Expected capacity 4 and 3 in use but found %d and %d.", s.GetCapacity(), s.InUse())
+	}
+
+	// Shrinking below what is in use takes effect as permits return.
+	s.SetCapacity(2)
+	if s.GetLevel() != -1 || s.InUse() != 3 {
+		t.Errorf("Expected level -1 and 3 in use but found %d and %d.", s.GetLevel(), s.InUse())
+	}
+
+	s.Up(1)
+	if s.TryDown(1) {
+		t.Error("TryDown should fail while at the reduced capacity.")
+	}
+
+	order := make(chan int, 2)
+	downInOrder(s, 0, 1, order)
+	downInOrder(s, 1, 1, order)
+
+	// Growing wakes everyone who now fits.
+	s.SetCapacity(4)
+	<-order
+	<-order
+
+	if s.Waiters() != 0 || s.GetLevel() != 0 || s.InUse() != 4 {
+		t.Errorf("Expected 0 waiters, level 0 and 4 in use but found %d, %d and %d.", s.Waiters(), s.GetLevel(), s.InUse())
+	}
+}
+
+func TestSemaphoreTooManyPermits(t *testing.T) {
+	s := NewSemaphore(2)
+
+	if err := s.DownContext(context.Background(), 3); err != ErrTooManyPermits {
+		t.Errorf("Expected ErrTooManyPermits but found %v.", err)
+	}
+
+	if err := s.DownTimeout(3, time.Second); err != ErrTooManyPermits {
+		t.Errorf("Expected ErrTooManyPermits but found %v.", err)
+	}
+
+	// Permits added by Up may be taken even beyond the capacity.
+	s.Up(1)
+	if err := s.DownTimeout(3, time.Second); err != nil {
+		t.Errorf("Expected no error but found %v.", err)
+	}
+
+	// Down waits rather than refuse.
+	done := make(chan struct{})
+	go func() {
+		s.Down(3)
+		close(done)
+	}()
+
+	for s.Waiters() != 1 {
+		runtime.Gosched()
+	}
+
+	s.Up(3)
+	<-done
+}
+
+func TestSemaphoreDownTimeoutFastPath(t *testing.T) {
+	s := NewSemaphore(1)
+	clk := clock.NewFake(time.Unix(0, 0))
+	s.Clock = clk
+
+	if err := s.DownTimeout(1, time.Second); err != nil {
+		t.Errorf("Expected no error but found %v.", err)
+	}
+
+	if clk.Timers() != 0 {
+		t.Errorf("Expected no timers but found %d.", clk.Timers())
+	}
+
+	// A timeout that is not needed is stopped.
+	go s.Up(1)
+	if err := s.DownTimeout(1, time.Hour); err != nil {
+		t.Errorf("Expected no error but found %v.", err)
+	}
+
+	if clk.Timers() != 0 {
+		t.Errorf("Expected no timers but found %d.", clk.Timers())
+	}
+}
+
+func TestSemaphoreZeroValue(t *testing.T) {
+	var s Semaphore
+
+	if err := s.DownTimeout(1, time.Millisecond); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout but found %v.", err)
+	}
+
+	s.Up(1)
+	if err := s.DownTimeout(1, time.Millisecond); err != nil {
+		t.Errorf("Expected no error but found %v.", err)
+	}
+}
+
+func TestSemaphoreShrinkRefusesWaiters(t *testing.T) {
+	s := NewSemaphore(4)
+	s.Down(2)
+
+	if err := s.SetCapacity(-1); err != ErrNegativeCapacity || s.GetCapacity() != 4 {
+		t.Errorf("Expected ErrNegativeCapacity and capacity 4 but found %v and %d.", err, s.GetCapacity())
+	}
+
+	refused := make(chan error)
+	go func() {
+		refused <- s.DownContext(context.Background(), 3)
+	}()
+
+	for s.Waiters() != 1 {
+		runtime.Gosched()
+	}
+
+	order := make(chan int, 1)
+	downInOrder(s, 0, 1, order)
+
+	// The large waiter still fits, so it keeps its place.
+	s.SetCapacity(3)
+	if s.Waiters() != 2 {
+		t.Errorf("Expected 2 waiters but found %d.", s.Waiters())
+	}
+
+	// Now it never can, and must not hold back the waiter behind it.
+	s.SetCapacity(2)
+	if err := <-refused; err != ErrTooManyPermits {
+		t.Errorf("Expected ErrTooManyPermits but found %v.", err)
+	}
+
+	s.Up(1)
+	if id := <-order; id != 0 {
+		t.Errorf("Expected waiter 0 but found %d.", id)
+	}
+
+	if s.Waiters() != 0 || s.InUse() != 2 {
+		t.Errorf("Expected 0 waiters and 2 in use but found %d and %d.", s.Waiters(), s.InUse())
+	}
+}
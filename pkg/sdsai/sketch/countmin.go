@@ -0,0 +1,219 @@
+package sketch
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// The most counters a sketch may have. At four bytes each, this is 4 GiB.
+const MaxCounters = 1 << 30
+
+// A count-min sketch estimates how often each key was seen using a fixed
+// amount of memory. Estimates are never too low and are too high by at most
+// epsilon times the total count with probability 1 - delta.
+//
+// Counters are updated atomically so a sketch may be shared between goroutines.
+// Aging halves every counter so old traffic fades away.
+type CountMinSketch struct {
+	// Updated atomically. First for 64-bit alignment.
+	additions  uint64
+	generation uint64
+
+	// Age the sketch after this many additions. Zero disables aging.
+	//
+	// The Add that reaches the limit starts aging in the background. If
+	// aging is already running, that turn is skipped. See Wait.
+	AgeEvery uint64
+
+	width  uint32
+	depth  uint32
+	counts []uint32
+
+	// Closed when the background aging in progress finishes, or nil.
+	ageLock sync.Mutex
+	aging   chan struct{}
+}
+
+// Create a sketch with depth rows of width counters.
+//
+// This panics if the sketch would have more than MaxCounters counters.
+func NewCountMinSketch(width, depth uint32) *CountMinSketch {
+	if width == 0 {
+		width = 1
+	}
+
+	if depth == 0 {
+		depth = 1
+	}
+
+	if int64(width)*int64(depth) > MaxCounters {
+		panic("Count-min sketches may not have more than MaxCounters counters.")
+	}
+
+	return &CountMinSketch{
+		width:  width,
+		depth:  depth,
+		counts: make([]uint32, int(width)*int(depth)),
+	}
+}
+
+// Create a sketch whose estimates are within epsilon times the total count
+// with probability 1 - delta.
+//
+// This panics if the sketch would have more than MaxCounters counters.
+func NewCountMinSketchWithEstimates(epsilon, delta float64) *CountMinSketch {
+	width := math.Ceil(math.E / epsilon)
+	depth := math.Ceil(math.Log(1 / delta))
+
+	if !(width*depth <= MaxCounters) {
+		panic("Count-min sketches may not have more than MaxCounters counters.")
+	}
+
+	return NewCountMinSketch(uint32(width), uint32(depth))
+}
+
+func (s *CountMinSketch) Width() uint32 {
+	return s.width
+}
+
+func (s *CountMinSketch) Depth() uint32 {
+	return s.depth
+}
+
+// Add n to the count of key and return its new estimate.
+func (s *CountMinSketch) Add(key string, n uint32) uint32 {
+	h1, h2 := hashes(key)
+
+	estimate := uint32(math.MaxUint32)
+	for i := uint32(0); i < s.depth; i++ {
+		c := &s.counts[s.index(h1, h2, i)]
+
+		v := atomic.LoadUint32(c)
+		for {
+			next := v + n
+			if next < v {
+				// Saturate rather than wrap.
+				next = math.MaxUint32
+			}
+
+			if atomic.CompareAndSwapUint32(c, v, next) {
+				v = next
+				break
+			}
+
+			v = atomic.LoadUint32(c)
+		}
+
+		if v < estimate {
+			estimate = v
+		}
+	}
+
+	if s.AgeEvery > 0 && atomic.AddUint64(&s.additions, 1)%s.AgeEvery == 0 {
+		s.ageInBackground()
+	}
+
+	return estimate
+}
+
+// Start aging in another goroutine, unless it is already running.
+func (s *CountMinSketch) ageInBackground() {
+	s.ageLock.Lock()
+	defer s.ageLock.Unlock()
+
+	if s.aging != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	s.aging = done
+
+	go func() {
+		s.Age()
+
+		s.ageLock.Lock()
+		s.aging = nil
+		s.ageLock.Unlock()
+
+		close(done)
+	}()
+}
+
+// Wait for any aging started by Add to finish.
+func (s *CountMinSketch) Wait() {
+	s.ageLock.Lock()
+	done := s.aging
+	s.ageLock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// Return the estimated count of key.
+func (s *CountMinSketch) Estimate(key string) uint32 {
+	h1, h2 := hashes(key)
+
+	estimate := uint32(math.MaxUint32)
+	for i := uint32(0); i < s.depth; i++ {
+		if v := atomic.LoadUint32(&s.counts[s.index(h1, h2, i)]); v < estimate {
+			estimate = v
+		}
+	}
+
+	return estimate
+}
+
+// Halve every counter.
+//
+// Counters are halved one at a time, so concurrent additions may see a
+// partially aged sketch.
+func (s *CountMinSketch) Age() {
+	for i := range s.counts {
+		c := &s.counts[i]
+		for {
+			v := atomic.LoadUint32(c)
+			if atomic.CompareAndSwapUint32(c, v, v/2) {
+				break
+			}
+		}
+	}
+
+	atomic.AddUint64(&s.generation, 1)
+}
+
+// The number of times the sketch has been aged.
+func (s *CountMinSketch) Generation() uint64 {
+	return atomic.LoadUint64(&s.generation)
+}
+
+// Return true if candidate has been seen more often than victim.
+// This is the TinyLFU rule for admitting a new key in place of an old one.
+func (s *CountMinSketch) Admit(candidate, victim string) bool {
+	return s.Estimate(candidate) > s.Estimate(victim)
+}
+
+// Set every counter to zero.
+func (s *CountMinSketch) Reset() {
+	for i := range s.counts {
+		atomic.StoreUint32(&s.counts[i], 0)
+	}
+	atomic.StoreUint64(&s.additions, 0)
+}
+
+func (s *CountMinSketch) index(h1, h2 uint64, row uint32) uint32 {
+	return row*s.width + uint32((h1+uint64(row)*h2)%uint64(s.width))
+}
+
+func hashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+
+	// Mix the first hash for the second, as in double hashing.
+	h2 := h1*0x9E3779B97F4A7C15 | 1
+
+	return h1, h2
+}
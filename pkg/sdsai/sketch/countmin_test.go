@@ -0,0 +1,81 @@
+package sketch
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	s := NewCountMinSketchWithEstimates(0.001, 0.01)
+
+	if s.Width() != 2719 || s.Depth() != 5 {
+		t.Errorf("Unexpected size %dx%d.", s.Width(), s.Depth())
+	}
+
+	for i := 0; i < 1000; i++ {
+		s.Add(fmt.Sprintf("key-%d", i), 1)
+	}
+	s.Add("hot", 500)
+
+	if e := s.Estimate("hot"); e < 500 || e > 510 {
+		t.Errorf("Unexpected estimate %d for hot.", e)
+	}
+
+	if e := s.Estimate("key-1"); e < 1 || e > 5 {
+		t.Errorf("Unexpected estimate %d for key-1.", e)
+	}
+
+	if !s.Admit("hot", "key-1") || s.Admit("key-1", "hot") {
+		t.Error("hot should be admitted over key-1 and not the reverse.")
+	}
+
+	s.Age()
+	if e := s.Estimate("hot"); e < 250 || e > 255 {
+		t.Errorf("Unexpected aged estimate %d for hot.", e)
+	}
+
+	if s.Generation() != 1 {
+		t.Errorf("Expected generation 1 but found %d.", s.Generation())
+	}
+
+	s.Reset()
+	if s.Estimate("hot") != 0 {
+		t.Error("Reset did not clear the sketch.")
+	}
+}
+
+func TestCountMinSketchAgeEvery(t *testing.T) {
+	s := NewCountMinSketch(100, 3)
+	s.AgeEvery = 10
+
+	for i := 0; i < 9; i++ {
+		s.Add("a", 2)
+	}
+
+	if s.Estimate("a") != 18 {
+		t.Errorf("Expected 18 but found %d.", s.Estimate("a"))
+	}
+
+	s.Add("a", 2)
+	s.Wait()
+	if s.Estimate("a") != 10 || s.Generation() != 1 {
+		t.Errorf("Expected an aged count of 10 but found %d.", s.Estimate("a"))
+	}
+}
+
+func TestCountMinSketchTooLarge(t *testing.T) {
+	for _, create := range []func(){
+		func() { NewCountMinSketch(1<<20, 1<<20) },
+		func() { NewCountMinSketchWithEstimates(1e-12, 0.01) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected a panic.")
+				}
+			}()
+
+			create()
+		}()
+	}
+}
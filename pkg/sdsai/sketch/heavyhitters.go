@@ -0,0 +1,187 @@
+package sketch
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A key and its estimated count.
+type Hitter struct {
+	Key   string
+	Count uint32
+}
+
+// Tracks the K keys with the highest counts in a CountMinSketch.
+//
+// A HeavyHitters is safe for concurrent use and may be set as the
+// Observer of a ConcurrentRingCache, which gives it keys in batches.
+type HeavyHitters struct {
+	// The sketch generation the tracked counts were read in.
+	// First for 64-bit alignment.
+	generation uint64
+
+	Sketch *CountMinSketch
+
+	k int
+
+	// The smallest count in a full heap. Read without the lock to skip
+	// keys that cannot enter the heap.
+	minCount uint32
+
+	lock    sync.Mutex
+	hitters hitterHeap
+}
+
+// Track the top k keys using the given sketch. A k of 0 or less tracks none.
+func NewHeavyHitters(k int, sketch *CountMinSketch) *HeavyHitters {
+	return &HeavyHitters{
+		Sketch:  sketch,
+		k:       k,
+		hitters: hitterHeap{index: make(map[string]int)},
+	}
+}
+
+// Count one occurrence of key.
+func (h *HeavyHitters) Observe(key string) {
+	h.Add(key, 1)
+}
+
+// Count one occurrence of each key, taking the lock at most once.
+func (h *HeavyHitters) ObserveBatch(keys []string) {
+	var candidates []Hitter
+
+	for _, key := range keys {
+		if count := h.Sketch.Add(key, 1); h.mayEnter(count) {
+			candidates = append(candidates, Hitter{Key: key, Count: count})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.refresh()
+	for _, c := range candidates {
+		h.offer(c.Key, c.Count)
+	}
+	h.updateMin()
+}
+
+// Count n occurrences of key.
+func (h *HeavyHitters) Add(key string, n uint32) {
+	count := h.Sketch.Add(key, n)
+	if !h.mayEnter(count) {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.refresh()
+	h.offer(key, count)
+	h.updateMin()
+}
+
+// Report whether a key with this count may belong in the heap.
+//
+// A key already in a full heap has a count of at least minCount,
+// so anything below it can be skipped without locking.
+func (h *HeavyHitters) mayEnter(count uint32) bool {
+	return count >= atomic.LoadUint32(&h.minCount) || h.Sketch.Generation() != atomic.LoadUint64(&h.generation)
+}
+
+// Update or add the key if its count belongs in the heap. Must hold the lock.
+func (h *HeavyHitters) offer(key string, count uint32) {
+	if i, ok := h.hitters.index[key]; ok {
+		h.hitters.items[i].Count = count
+		heap.Fix(&h.hitters, i)
+	} else if h.hitters.Len() < h.k {
+		heap.Push(&h.hitters, Hitter{Key: key, Count: count})
+	} else if h.hitters.Len() > 0 && count > h.hitters.items[0].Count {
+		heap.Pop(&h.hitters)
+		heap.Push(&h.hitters, Hitter{Key: key, Count: count})
+	}
+}
+
+// Return the tracked keys, highest count first.
+func (h *HeavyHitters) Top() []Hitter {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.refresh()
+
+	top := make([]Hitter, len(h.hitters.items))
+	copy(top, h.hitters.items)
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+
+	return top
+}
+
+// Re-read every tracked count if the sketch has aged. Must hold the lock.
+func (h *HeavyHitters) refresh() {
+	g := h.Sketch.Generation()
+	if g == atomic.LoadUint64(&h.generation) {
+		return
+	}
+
+	for i := range h.hitters.items {
+		h.hitters.items[i].Count = h.Sketch.Estimate(h.hitters.items[i].Key)
+	}
+	heap.Init(&h.hitters)
+
+	atomic.StoreUint64(&h.generation, g)
+	h.updateMin()
+}
+
+// Must hold the lock.
+func (h *HeavyHitters) updateMin() {
+	if h.hitters.Len() == 0 || h.hitters.Len() < h.k {
+		atomic.StoreUint32(&h.minCount, 0)
+	} else {
+		atomic.StoreUint32(&h.minCount, h.hitters.items[0].Count)
+	}
+}
+
+// A min-heap of hitters that tracks where each key is.
+type hitterHeap struct {
+	items []Hitter
+	index map[string]int
+}
+
+func (h *hitterHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *hitterHeap) Less(i, j int) bool {
+	return h.items[i].Count < h.items[j].Count
+}
+
+func (h *hitterHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].Key] = i
+	h.index[h.items[j].Key] = j
+}
+
+func (h *hitterHeap) Push(x interface{}) {
+	hitter := x.(Hitter)
+	h.index[hitter.Key] = len(h.items)
+	h.items = append(h.items, hitter)
+}
+
+func (h *hitterHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.index, last.Key)
+	return last
+}
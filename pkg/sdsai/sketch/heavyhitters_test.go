@@ -0,0 +1,91 @@
+package sketch
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+)
+
+func TestHeavyHitters(t *testing.T) {
+	h := NewHeavyHitters(3, NewCountMinSketch(1000, 4))
+
+	for i := 0; i < 100; i++ {
+		h.Observe(fmt.Sprintf("cold-%d", i))
+		for j := 0; j < 3; j++ {
+			h.Observe(fmt.Sprintf("hot-%d", j))
+			if j < 2 {
+				h.Observe(fmt.Sprintf("hot-%d", j))
+			}
+		}
+	}
+
+	top := h.Top()
+	if len(top) != 3 {
+		t.Fatalf("Expected 3 hitters but found %d.", len(top))
+	}
+
+	if top[0].Key != "hot-0" || top[1].Key != "hot-1" || top[2].Key != "hot-2" {
+		t.Errorf("Unexpected hitters %v.", top)
+	}
+
+	if top[0].Count < 200 || top[2].Count < 100 {
+		t.Errorf("Unexpected counts %v.", top)
+	}
+
+	h.Sketch.Age()
+	if top = h.Top(); top[0].Count > 110 {
+		t.Errorf("Counts should be aged: %v.", top)
+	}
+}
+
+func TestHeavyHittersObserveCache(t *testing.T) {
+	h := NewHeavyHitters(2, NewCountMinSketch(1000, 4))
+	c := cache.NewConcurrentRingCache(4, 100, -1)
+	c.Observer = h
+
+	var _ cache.BatchObserver = h
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				c.Get("popular")
+				c.Put(fmt.Sprintf("%d-%d", g, i), i)
+			}
+		}(g)
+	}
+	c.Put("popular", 1)
+	wg.Wait()
+	c.FlushReads()
+
+	top := h.Top()
+	if len(top) == 0 || top[0].Key != "popular" || top[0].Count < 801 {
+		t.Errorf("Unexpected hitters %v.", top)
+	}
+}
+
+func TestHeavyHittersObserveBatch(t *testing.T) {
+	h := NewHeavyHitters(2, NewCountMinSketch(1000, 4))
+
+	h.ObserveBatch([]string{"a", "b", "a", "c", "a", "b"})
+
+	top := h.Top()
+	if len(top) != 2 || top[0] != (Hitter{"a", 3}) || top[1] != (Hitter{"b", 2}) {
+		t.Errorf("Unexpected hitters %v.", top)
+	}
+}
+
+func TestHeavyHittersNone(t *testing.T) {
+	h := NewHeavyHitters(0, NewCountMinSketch(64, 4))
+
+	h.Add("a", 1)
+	h.ObserveBatch([]string{"a", "b"})
+
+	if top := h.Top(); len(top) != 0 {
+		t.Errorf("Expected no hitters but found %v.", top)
+	}
+}
@@ -0,0 +1,196 @@
+package sketch
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// Estimates the number of distinct keys added using 2^precision one-byte
+// registers. The standard error is about 1.04 / sqrt(2^precision).
+//
+// Registers are packed four to a word and updated atomically, so a
+// HyperLogLog may be shared between goroutines and used as a KeyObserver.
+type HyperLogLog struct {
+	precision uint8
+	m         uint32
+	registers []uint32
+}
+
+// Create a HyperLogLog with 2^precision registers. Precision must be in [4, 16].
+func NewHyperLogLog(precision uint8) (*HyperLogLog, error) {
+	if precision < 4 || precision > 16 {
+		return nil, errors.New("Precision must be between 4 and 16.")
+	}
+
+	m := uint32(1) << precision
+
+	return &HyperLogLog{
+		precision: precision,
+		m:         m,
+		registers: make([]uint32, m/4),
+	}, nil
+}
+
+func (h *HyperLogLog) Precision() uint8 {
+	return h.precision
+}
+
+// Count a key.
+func (h *HyperLogLog) Add(key string) {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	h.AddHash(mix(f.Sum64()))
+}
+
+// Count a key, for use as a KeyObserver.
+func (h *HyperLogLog) Observe(key string) {
+	h.Add(key)
+}
+
+// Count an already hashed key. The hash should be uniformly distributed.
+func (h *HyperLogLog) AddHash(x uint64) {
+	index := uint32(x >> (64 - h.precision))
+
+	// The position of the first set bit after the index bits.
+	rest := x<<h.precision | 1<<(h.precision-1)
+	rank := uint8(bits.LeadingZeros64(rest) + 1)
+
+	h.setMax(index, rank)
+}
+
+// The estimated number of distinct keys added.
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(h.m)
+
+	sum := 0.0
+	zeros := 0
+	for i := uint32(0); i < h.m; i++ {
+		r := h.get(i)
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha(h.m) * m * m / sum
+
+	// Use linear counting while many registers are still empty.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+// Add every key counted by other to this HyperLogLog. Both must have the same precision.
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if h.precision != other.precision {
+		return errors.New("HyperLogLogs must have the same precision to be merged.")
+	}
+
+	for i := uint32(0); i < h.m; i++ {
+		h.setMax(i, other.get(i))
+	}
+
+	return nil
+}
+
+// Forget every key.
+func (h *HyperLogLog) Reset() {
+	for i := range h.registers {
+		atomic.StoreUint32(&h.registers[i], 0)
+	}
+}
+
+var hyperLogLogMagic = "HLL1"
+
+// Encode as "HLL1", the precision byte and then one byte per register.
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 5+h.m)
+	copy(data, hyperLogLogMagic)
+	data[4] = h.precision
+
+	for i := uint32(0); i < h.m; i++ {
+		data[5+i] = h.get(i)
+	}
+
+	return data, nil
+}
+
+func (h *HyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) < 5 || string(data[0:4]) != hyperLogLogMagic {
+		return errors.New("Data is not a serialized HyperLogLog.")
+	}
+
+	n, err := NewHyperLogLog(data[4])
+	if err != nil {
+		return err
+	}
+
+	if uint32(len(data)-5) != n.m {
+		return errors.New("HyperLogLog data is the wrong length.")
+	}
+
+	// A rank counts the bits after the index bits, plus one.
+	maxRank := 64 - n.precision + 1
+
+	for i := uint32(0); i < n.m; i++ {
+		if data[5+i] > maxRank {
+			return errors.New("HyperLogLog register is larger than its precision allows.")
+		}
+		n.setMax(i, data[5+i])
+	}
+
+	*h = *n
+
+	return nil
+}
+
+func (h *HyperLogLog) get(i uint32) uint8 {
+	return uint8(atomic.LoadUint32(&h.registers[i/4]) >> (8 * (i % 4)))
+}
+
+// Raise register i to rank if it is lower.
+func (h *HyperLogLog) setMax(i uint32, rank uint8) {
+	word := &h.registers[i/4]
+	shift := 8 * (i % 4)
+
+	for {
+		old := atomic.LoadUint32(word)
+		if uint8(old>>shift) >= rank {
+			return
+		}
+
+		next := old&^(0xff<<shift) | uint32(rank)<<shift
+		if atomic.CompareAndSwapUint32(word, old, next) {
+			return
+		}
+	}
+}
+
+func alpha(m uint32) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	default:
+		return 0.7213 / (1 + 1.079/float64(m))
+	}
+}
+
+// Spread the bits of a hash. FNV leaves the high bits poorly mixed for
+// short keys, and HyperLogLog indexes registers by the high bits.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
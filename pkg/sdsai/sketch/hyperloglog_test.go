@@ -0,0 +1,106 @@
+package sketch
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/basking2/sdsai-go/pkg/sdsai/cache"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	if _, err := NewHyperLogLog(3); err == nil {
+		t.Error("Precision 3 should be rejected.")
+	}
+
+	h, _ := NewHyperLogLog(14)
+
+	if h.Count() != 0 {
+		t.Errorf("Expected 0 but found %d.", h.Count())
+	}
+
+	for _, n := range []int{10, 1000, 100000} {
+		h.Reset()
+		for i := 0; i < n; i++ {
+			h.Add(fmt.Sprintf("key-%d", i))
+			h.Add(fmt.Sprintf("key-%d", i))
+		}
+
+		if e := math.Abs(float64(h.Count())-float64(n)) / float64(n); e > 0.03 {
+			t.Errorf("Estimate %d for %d keys is off by %.2f%%.", h.Count(), n, e*100)
+		}
+	}
+}
+
+func TestHyperLogLogMergeAndSerialize(t *testing.T) {
+	a, _ := NewHyperLogLog(12)
+	b, _ := NewHyperLogLog(12)
+
+	for i := 0; i < 5000; i++ {
+		a.Add(fmt.Sprintf("a-%d", i))
+		b.Add(fmt.Sprintf("b-%d", i))
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := a.Count(); c < 9500 || c > 10500 {
+		t.Errorf("Expected about 10000 but found %d.", c)
+	}
+
+	other, _ := NewHyperLogLog(10)
+	if err := a.Merge(other); err == nil {
+		t.Error("Merging different precisions should fail.")
+	}
+
+	data, _ := a.MarshalBinary()
+	c := &HyperLogLog{}
+	if err := c.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Count() != a.Count() || c.Precision() != 12 {
+		t.Errorf("Expected %d but found %d after serialization.", a.Count(), c.Count())
+	}
+
+	if err := c.UnmarshalBinary(data[:100]); err == nil {
+		t.Error("Truncated data should fail.")
+	}
+
+	// No register of a precision 12 sketch may exceed 53.
+	data[len(data)-1] = 54
+	if err := c.UnmarshalBinary(data); err == nil {
+		t.Error("An out of range register should fail.")
+	}
+}
+
+func TestHyperLogLogCacheLookups(t *testing.T) {
+	h, _ := NewHyperLogLog(10)
+
+	c := cache.NewConcurrentRingCache(4, 100, -1)
+	c.ObserveLookups(h)
+
+	// Enabling stats again keeps the observer.
+	c.EnableStats()
+
+	for i := 0; i < 300; i++ {
+		c.Get(fmt.Sprintf("key-%d", i%30))
+	}
+
+	// Puts are not lookups.
+	c.Put("not counted", 1)
+
+	if n := h.Count(); n < 28 || n > 32 {
+		t.Errorf("Expected about 30 distinct keys but found %d.", n)
+	}
+
+	lifo := cache.NewLIFOCache()
+	lifo.Stats = &cache.CacheStats{Lookups: h}
+	h.Reset()
+	lifo.Get("a")
+	lifo.Get("b")
+	if h.Count() != 2 {
+		t.Errorf("Expected 2 distinct keys but found %d.", h.Count())
+	}
+}